@@ -0,0 +1,152 @@
+package outbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+// tmpDir is the name of the directory, relative to the outbox directory, that
+// entries are written to before they are moved into the outbox.
+const tmpDir = ".tmp"
+
+// DirStore is a Store kept in a directory on the file system. Each entry is a
+// file named after the time it was added, as a zero-padded count of
+// nanoseconds since the Unix epoch, and its ID.
+//
+// The directory should be on the same file system as the rest of the data the
+// events belong to, so that they are written under the same guarantees.
+type DirStore struct {
+	dir string
+
+	// Protects names.
+	mu sync.Mutex
+
+	// The file names of the entries seen in the outbox, keyed by ID, so that
+	// entries can be marked done without reading the directory each time.
+	names map[string][]string
+}
+
+// NewDirStore returns a DirStore for the directory dir, creating it if it
+// does not exist.
+func NewDirStore(dir string) (*DirStore, error) {
+	tmp := dir + "/" + tmpDir
+	if err := os.MkdirAll(tmp, 0777); err != nil {
+		return nil, fmt.Errorf("cannot create directory %s: %s", tmp, err)
+	}
+	return &DirStore{dir: dir, names: make(map[string][]string)}, nil
+}
+
+// Dir returns the directory the outbox is kept in.
+func (s *DirStore) Dir() string {
+	return s.dir
+}
+
+// Add adds the entry e to the outbox. The entry is written to a temporary
+// file and then moved into place, so it is either in the outbox in full, or
+// not at all, and is synced to disk before Add returns.
+func (s *DirStore) Add(e Entry) error {
+	if err := store.ValidName("entry", e.ID); err != nil {
+		return err
+	}
+	path := s.dir + "/" + store.TimedName(e.ID, e.Time)
+	return store.WriteFileAtomic(s.dir+"/"+tmpDir, path, e.Data, store.DurabilitySyncDir)
+}
+
+// AddEvent adds event to the outbox as a new entry, and returns its ID. See
+// NewEntry.
+func (s *DirStore) AddEvent(event interface{}) (string, error) {
+	e, err := NewEntry(event)
+	if err != nil {
+		return "", err
+	}
+	if err := s.Add(e); err != nil {
+		return "", err
+	}
+	return e.ID, nil
+}
+
+// Pending implements Store for DirStore.
+func (s *DirStore) Pending(n int) ([]Entry, error) {
+	// ReadDir sorts by name, which is the order the entries were added in.
+	fs, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading outbox directory %s: %s", s.dir, err)
+	}
+	s.remember(fs)
+	var es []Entry
+	for _, f := range fs {
+		if len(es) == n {
+			break
+		}
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		id, t, ok := store.ParseTimedName(f.Name())
+		if !ok {
+			continue
+		}
+		data, err := ioutil.ReadFile(s.dir + "/" + f.Name())
+		switch {
+		case err != nil && os.IsNotExist(err):
+			// Marked done since the directory was read.
+			continue
+		case err != nil:
+			return nil, fmt.Errorf("error reading entry %s: %s", id, err)
+		}
+		es = append(es, Entry{ID: id, Time: t, Data: data})
+	}
+	return es, nil
+}
+
+// remember records the file names of the entries in fs, which were read from
+// the outbox directory, replacing the names recorded before.
+func (s *DirStore) remember(fs []os.FileInfo) {
+	names := make(map[string][]string)
+	for _, f := range fs {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		if id, _, ok := store.ParseTimedName(f.Name()); ok {
+			names[id] = append(names[id], f.Name())
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.names = names
+}
+
+// Done implements Store for DirStore. The file for the entry is removed. The
+// file is looked up among the entries seen by the last call to Pending, and
+// the directory is only read again if the entry was not among them.
+func (s *DirStore) Done(id string) error {
+	s.mu.Lock()
+	files, ok := s.names[id]
+	s.mu.Unlock()
+	if !ok {
+		fs, err := ioutil.ReadDir(s.dir)
+		if err != nil {
+			return fmt.Errorf("error reading outbox directory %s: %s", s.dir, err)
+		}
+		s.remember(fs)
+		s.mu.Lock()
+		files, ok = s.names[id]
+		s.mu.Unlock()
+		if !ok {
+			// Marked done already.
+			return nil
+		}
+	}
+	for _, name := range files {
+		if err := os.Remove(s.dir + "/" + name); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing entry %s: %s", id, err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.names, id)
+	return nil
+}
@@ -0,0 +1,118 @@
+package outbox
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDirStoreAdd(t *testing.T) {
+	cases := []struct {
+		Name string
+		ID   string
+		Err  string
+	}{
+		{
+			Name: "basic success case",
+			ID:   "foo",
+		},
+		{
+			Name: "empty ID",
+			Err:  "entry name cannot be empty",
+		},
+		{
+			Name: "dot ID",
+			ID:   ".foo",
+			Err:  "cannot start with a dot",
+		},
+		{
+			Name: "path separator",
+			ID:   "foo/bar",
+			Err:  "cannot contain a path separator",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "outboxtest")
+			defer os.RemoveAll(dir)
+			s, err := NewDirStore(dir)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			e := Entry{ID: tc.ID, Time: time.Unix(0, 1), Data: []byte(`{"Text":"foo"}`)}
+			err = s.Add(e)
+			switch {
+			case err != nil && tc.Err == "":
+				t.Fatalf("bad: %s", err)
+			case err == nil && tc.Err != "":
+				t.Fatal("expected error, got none")
+			case err != nil && tc.Err != "":
+				if !strings.Contains(err.Error(), tc.Err) {
+					t.Fatalf("expected error to match %q, got %q", tc.Err, err)
+				}
+				return
+			}
+			es, err := s.Pending(10)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if !reflect.DeepEqual([]Entry{e}, es) {
+				t.Fatalf("expected %#v, got %#v", []Entry{e}, es)
+			}
+		})
+	}
+}
+
+func TestDirStorePendingDone(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "outboxtest")
+	defer os.RemoveAll(dir)
+	s, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	now := time.Now()
+	for i, id := range []string{"c", "a", "b"} {
+		if err := s.Add(Entry{ID: id, Time: now.Add(time.Duration(i)), Data: []byte("{}")}); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+	ids := func(n int) []string {
+		es, err := s.Pending(n)
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		var ids []string
+		for _, e := range es {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+	if expected, actual := []string{"c", "a"}, ids(2); !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+	// Marking done twice is not an error.
+	for i := 0; i < 2; i++ {
+		if err := s.Done("a"); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+	if expected, actual := []string{"c", "b"}, ids(10); !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+
+	// Entries not seen by Pending can be marked done too.
+	s, err = NewDirStore(dir)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := s.Done("b"); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if expected, actual := []string{"c"}, ids(10); !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+}
@@ -0,0 +1,63 @@
+// Package outbox implements the transactional outbox pattern on top of event
+// streams.
+//
+// Rather than publishing events directly, which can lose or duplicate events
+// if the process crashes between a database write and the publish, events are
+// written to an outbox as part of the same transaction as the rest of the
+// change. A Relay then publishes the events in the outbox to the stream, and
+// marks them done. Events are published with the ID they were given when they
+// were added to the outbox, so an event that is published again after a crash
+// is not duplicated.
+//
+// Any store that implements Store can be used as an outbox - a table in the
+// database the rest of the change is written to, for example. DirStore is a
+// Store kept in a directory on the file system.
+package outbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Entry is an event in an outbox.
+type Entry struct {
+	// The ID the event is published with.
+	ID string
+
+	// The time the event was added to the outbox. Entries are published in
+	// this order.
+	Time time.Time
+
+	// The JSON encoded event.
+	Data []byte
+}
+
+// NewEntry returns an entry for event, with a v4 UUID as its ID, ready to be
+// added to an outbox.
+func NewEntry(event interface{}) (Entry, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return Entry{}, fmt.Errorf("could not generate ID: %s", err)
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return Entry{}, fmt.Errorf("could not marshal event data: %s", err)
+	}
+	return Entry{ID: id.String(), Time: time.Now(), Data: data}, nil
+}
+
+// Store is a store for an outbox. Adding entries is left to the
+// implementation, as it needs to be done as part of the transaction the
+// events belong to.
+type Store interface {
+	// Pending returns up to n of the entries that have not been marked done,
+	// in the order they were added.
+	Pending(n int) ([]Entry, error)
+
+	// Done marks the entry with the ID id done, so that it is not returned by
+	// Pending again. Marking an entry that is already done is not an error.
+	Done(id string) error
+}
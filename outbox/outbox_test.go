@@ -0,0 +1,30 @@
+package outbox
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+type TestEvent struct {
+	Text string
+}
+
+func TestNewEntry(t *testing.T) {
+	e, err := NewEntry(TestEvent{Text: "foo"})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if e.ID == "" || e.Time.IsZero() {
+		t.Fatalf("expected ID and time to be set, got %#v", e)
+	}
+	var actual TestEvent
+	if err := json.Unmarshal(e.Data, &actual); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if actual.Text != "foo" {
+		t.Fatalf("expected foo, got %#v", actual)
+	}
+	if _, err := NewEntry(func() {}); err == nil {
+		t.Fatal("expected error, got none")
+	}
+}
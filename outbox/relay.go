@@ -0,0 +1,260 @@
+package outbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/vancluever/fspubsub/pub"
+	"github.com/vancluever/fspubsub/store"
+)
+
+const (
+	// defaultRelayInterval is the default interval a Relay checks its outbox
+	// for new entries on.
+	defaultRelayInterval = time.Second
+
+	// defaultRelayBatchSize is the default number of entries a Relay reads
+	// from its outbox at a time.
+	defaultRelayBatchSize = 100
+)
+
+// Relay publishes the entries in an outbox to a stream, in the order they
+// were added, and marks them done. Each entry is published with its own ID
+// using Publisher.PublishWithID, so an entry that was published but not
+// marked done - because the relay crashed in between, for example - is not
+// published twice when it is relayed again.
+//
+// Entries that can never be published are skipped, and reported as a
+// BadEntryError to the handler set with OnRelayError. They are left in the
+// outbox, so that they can be fixed or removed, but are not tried again by
+// the relay.
+type Relay struct {
+	// The outbox the entries are read from.
+	store Store
+
+	// The publisher the entries are published with.
+	p *pub.Publisher
+
+	// The interval the outbox is checked on.
+	interval time.Duration
+
+	// The number of entries read from the outbox at a time.
+	batchSize int
+
+	// The handler for errors that do not stop the relay, if any.
+	onError func(error)
+
+	// The IDs of the entries that have been skipped.
+	skipped map[string]bool
+
+	// Closed to stop the relay.
+	stop chan struct{}
+
+	// Makes sure stop is only closed once.
+	closeOnce sync.Once
+
+	// Closed when the relay has stopped.
+	done chan struct{}
+
+	// Protects err.
+	mu sync.Mutex
+
+	// The error the relay stopped with, if any.
+	err error
+}
+
+// RelayOption is a functional option that can be passed to NewRelay to change
+// the behavior of the relay.
+type RelayOption func(*Relay) error
+
+// RelayInterval sets the interval the relay checks the outbox for new entries
+// on. The default is one second.
+func RelayInterval(d time.Duration) RelayOption {
+	return func(r *Relay) error {
+		if d <= 0 {
+			return errors.New("relay interval must be positive")
+		}
+		r.interval = d
+		return nil
+	}
+}
+
+// RelayBatchSize sets the number of entries the relay reads from the outbox
+// at a time. The default is 100.
+func RelayBatchSize(n int) RelayOption {
+	return func(r *Relay) error {
+		if n < 1 {
+			return errors.New("relay batch size must be at least 1")
+		}
+		r.batchSize = n
+		return nil
+	}
+}
+
+// OnRelayError sets a handler for errors that do not stop the relay, such as a
+// BadEntryError. The handler is called from the relay's goroutine. Errors are
+// discarded if no handler is set.
+func OnRelayError(f func(error)) RelayOption {
+	return func(r *Relay) error {
+		r.onError = f
+		return nil
+	}
+}
+
+// BadEntryError is reported when an entry cannot be published - because it
+// cannot be decoded, fails validation, or has the ID of a different event
+// already in the stream - and the relay has skipped it.
+type BadEntryError struct {
+	// The ID of the entry.
+	ID string
+
+	// The error the entry was skipped for.
+	Err error
+}
+
+func (e BadEntryError) Error() string {
+	return fmt.Sprintf("bad entry %s: %s", e.ID, e.Err)
+}
+
+// NewRelay starts relaying the entries in the outbox s to the stream of the
+// publisher p. The data of each entry is decoded into the event type of the
+// stream before it is published, so the middleware of the publisher sees the
+// event as usual.
+//
+// The relay stops if it cannot read the outbox, or relay an entry for any
+// reason other than the entry being bad. Block on Done and check Error for
+// the reason.
+func NewRelay(s Store, p *pub.Publisher, opts ...RelayOption) (*Relay, error) {
+	r := &Relay{
+		store:     s,
+		p:         p,
+		interval:  defaultRelayInterval,
+		batchSize: defaultRelayBatchSize,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		skipped:   make(map[string]bool),
+	}
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
+	go r.run()
+	return r, nil
+}
+
+// run relays entries on the interval, until the relay is stopped or fails.
+func (r *Relay) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if err := r.relayPending(); err != nil {
+			r.mu.Lock()
+			r.err = err
+			r.mu.Unlock()
+			return
+		}
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayPending relays entries until the outbox is empty, or the relay is
+// stopped.
+func (r *Relay) relayPending() error {
+	for {
+		// Skipped entries stay in the outbox, so read past them.
+		n := r.batchSize + len(r.skipped)
+		es, err := r.store.Pending(n)
+		if err != nil {
+			return err
+		}
+		for _, e := range es {
+			if r.skipped[e.ID] {
+				continue
+			}
+			select {
+			case <-r.stop:
+				return nil
+			default:
+			}
+			err := r.relay(e)
+			if bad, ok := err.(BadEntryError); ok {
+				r.skipped[e.ID] = true
+				r.report(bad)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if len(es) < n {
+			return nil
+		}
+	}
+}
+
+// report passes err to the error handler, if there is one.
+func (r *Relay) report(err error) {
+	if r.onError != nil {
+		r.onError(err)
+	}
+}
+
+// relay publishes the entry e and marks it done. A BadEntryError is returned
+// if e can never be published. The entry is only marked done
+// once its event can be read back from the stream, so that an entry is never
+// dropped because a publish reported success without writing it - such as
+// one rejected by middleware that does not return an error.
+func (r *Relay) relay(e Entry) error {
+	v := reflect.New(r.p.EventType())
+	if err := json.Unmarshal(e.Data, v.Interface()); err != nil {
+		return BadEntryError{ID: e.ID, Err: fmt.Errorf("error decoding entry: %s", err)}
+	}
+	id, err := r.p.PublishWithID(e.ID, v.Elem().Interface())
+	switch err.(type) {
+	case nil:
+	case store.ConflictError, store.ValidationError:
+		return BadEntryError{ID: e.ID, Err: err}
+	default:
+		return fmt.Errorf("error publishing entry %s: %s", e.ID, err)
+	}
+	if _, err := store.DecodeEvent(r.p.Dir()+"/"+id, r.p.EventType()); err != nil {
+		return fmt.Errorf("error checking entry %s was published: %s", e.ID, err)
+	}
+	if err := r.store.Done(e.ID); err != nil {
+		return fmt.Errorf("error marking entry %s done: %s", e.ID, err)
+	}
+	return nil
+}
+
+// Done returns a channel that closes when the relay stops, either because it
+// was closed or because it failed. Check Error for the reason.
+func (r *Relay) Done() <-chan struct{} {
+	return r.done
+}
+
+// Error returns the error the relay stopped with, if any. This is guaranteed
+// to be nil if the relay has not stopped, so block on Done before checking
+// it.
+func (r *Relay) Error() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Close stops the relay, and waits for it to finish relaying the entry it is
+// on, if any. Entries that have not been relayed yet stay in the outbox, to be
+// relayed by the next relay to run against it.
+func (r *Relay) Close() {
+	r.closeOnce.Do(func() { close(r.stop) })
+	<-r.done
+}
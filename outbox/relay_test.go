@@ -0,0 +1,228 @@
+package outbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/pub"
+	"github.com/vancluever/fspubsub/store"
+)
+
+func TestRelay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "outboxtest")
+	defer os.RemoveAll(dir)
+	s, err := NewDirStore(dir + "/outbox")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	p, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	var expected []string
+	for _, text := range []string{"foo", "bar", "baz"} {
+		id, err := s.AddEvent(TestEvent{Text: text})
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		expected = append(expected, id)
+	}
+	// Simulate a relay that crashed after publishing the first entry, but
+	// before marking it done.
+	if _, err := p.PublishWithID(expected[0], TestEvent{Text: "foo"}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	r, err := NewRelay(s, p, RelayInterval(10*time.Millisecond), RelayBatchSize(2))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	r.Close()
+	if r.Error() != nil {
+		t.Fatalf("bad: %s", r.Error())
+	}
+	actual, _, err := p.EventIDsAfter(store.Checkpoint{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+	if es, err := s.Pending(10); err != nil || len(es) != 0 {
+		t.Fatalf("expected outbox to be empty, got %#v, %v", es, err)
+	}
+}
+
+func TestRelayBadEntry(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "outboxtest")
+	defer os.RemoveAll(dir)
+	s, err := NewDirStore(dir + "/outbox")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	p, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if _, err := p.PublishWithID("conflict", TestEvent{Text: "foo"}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	now := time.Now()
+	entries := []Entry{
+		{ID: "undecodable", Time: now, Data: []byte("not json")},
+		{ID: "conflict", Time: now.Add(1), Data: []byte(`{"Text":"bar"}`)},
+		{ID: "good", Time: now.Add(2), Data: []byte(`{"Text":"baz"}`)},
+	}
+	for _, e := range entries {
+		if err := s.Add(e); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+	var mu sync.Mutex
+	var reported []string
+	r, err := NewRelay(s, p, RelayInterval(10*time.Millisecond), RelayBatchSize(1), OnRelayError(func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		bad, ok := err.(BadEntryError)
+		if !ok {
+			t.Errorf("expected BadEntryError, got %v", err)
+			return
+		}
+		reported = append(reported, bad.ID)
+	}))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	r.Close()
+	if r.Error() != nil {
+		t.Fatalf("bad: %s", r.Error())
+	}
+	// Each bad entry is reported once, and does not hold up the entries after
+	// it.
+	mu.Lock()
+	defer mu.Unlock()
+	if expected := []string{"undecodable", "conflict"}; !reflect.DeepEqual(expected, reported) {
+		t.Fatalf("expected %q to be reported, got %q", expected, reported)
+	}
+	if _, err := store.Fetch(dir, TestEvent{}, "good"); err != nil {
+		t.Fatalf("expected good entry to be published: %s", err)
+	}
+	es, err := s.Pending(10)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if len(es) != 2 || es[0].ID != "undecodable" || es[1].ID != "conflict" {
+		t.Fatalf("expected bad entries to stay in the outbox, got %#v", es)
+	}
+}
+
+func TestRelayAfterCrash(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "outboxtest")
+	defer os.RemoveAll(dir)
+	s, err := NewDirStore(dir + "/outbox")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	p, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	id, err := s.AddEvent(TestEvent{Text: "foo"})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// Simulate a relay that crashed after claiming the ID of the entry, but
+	// before publishing it. The claim is fresh, so the restarted relay must
+	// not take the entry to be published.
+	claim := p.Dir() + "/.tmp/" + id
+	if err := os.MkdirAll(filepath.Dir(claim), 0777); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := ioutil.WriteFile(claim, []byte(`{"Text":"foo"}`), 0666); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	r, err := NewRelay(s, p, RelayInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	r.Close()
+	if r.Error() != nil {
+		t.Fatalf("bad: %s", r.Error())
+	}
+	e, err := store.Fetch(dir, TestEvent{}, id)
+	if err != nil {
+		t.Fatalf("expected entry to be published: %s", err)
+	}
+	if e.Data.(TestEvent).Text != "foo" {
+		t.Fatalf("expected foo, got %#v", e.Data)
+	}
+	if es, err := s.Pending(10); err != nil || len(es) != 0 {
+		t.Fatalf("expected outbox to be empty, got %#v, %v", es, err)
+	}
+}
+
+func TestRelayNotPublished(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "outboxtest")
+	defer os.RemoveAll(dir)
+	s, err := NewDirStore(dir + "/outbox")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	p, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// Middleware that drops the event without reporting an error.
+	p.Use(func(next pub.PublishFunc) pub.PublishFunc {
+		return func(m *pub.Message) error {
+			return nil
+		}
+	})
+	id, err := s.AddEvent(TestEvent{Text: "foo"})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	r, err := NewRelay(s, p, RelayInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	select {
+	case <-r.Done():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for relay to stop")
+	}
+	if r.Error() == nil || !strings.Contains(r.Error().Error(), "entry "+id) {
+		t.Fatalf("expected relay to fail on entry %s, got %v", id, r.Error())
+	}
+	if es, err := s.Pending(10); err != nil || len(es) != 1 {
+		t.Fatalf("expected entry to stay in the outbox, got %#v, %v", es, err)
+	}
+}
+
+func TestNewRelayBadOptions(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "outboxtest")
+	defer os.RemoveAll(dir)
+	s, err := NewDirStore(dir + "/outbox")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	p, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	for _, opt := range []RelayOption{RelayInterval(0), RelayBatchSize(0)} {
+		if _, err := NewRelay(s, p, opt); err == nil {
+			t.Fatal("expected error, got none")
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package pub
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// defaultAsyncQueueSize is the default number of events an AsyncPublisher
+// holds in memory while they wait to be written.
+const defaultAsyncQueueSize = 100
+
+// ErrQueueFull is the error an asynchronous publish fails with when the queue
+// is full, under the QueueFullFail policy.
+var ErrQueueFull = errors.New("publish queue is full")
+
+// ErrClosed is the error an asynchronous publish fails with once the
+// publisher has been closed.
+var ErrClosed = errors.New("publisher is closed")
+
+// QueueFullPolicy describes what an AsyncPublisher does with an event when
+// its queue is full.
+type QueueFullPolicy int
+
+const (
+	// QueueFullBlock makes the publish wait for room in the queue. This is the
+	// default.
+	QueueFullBlock QueueFullPolicy = iota
+
+	// QueueFullFail fails the publish straight away with ErrQueueFull.
+	QueueFullFail
+)
+
+// validate returns an error if p is not a known queue-full policy.
+func (p QueueFullPolicy) validate() error {
+	switch p {
+	case QueueFullBlock, QueueFullFail:
+		return nil
+	}
+	return fmt.Errorf("unknown queue-full policy %d", p)
+}
+
+// Future is the pending result of an asynchronous publish.
+type Future struct {
+	// Closed once the result is available.
+	done chan struct{}
+
+	// The ID of the published event, or the reason the publish failed.
+	id  string
+	err error
+}
+
+// newFuture returns a new pending future.
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// complete sets the result of the future.
+func (f *Future) complete(id string, err error) *Future {
+	f.id, f.err = id, err
+	close(f.done)
+	return f
+}
+
+// Done returns a channel that closes once the result is available.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait waits for the event to be written, and returns its ID, or the reason it
+// could not be published.
+func (f *Future) Wait() (string, error) {
+	<-f.done
+	return f.id, f.err
+}
+
+// asyncEvent is an event waiting in an AsyncPublisher's queue.
+type asyncEvent struct {
+	event   interface{}
+	headers map[string]string
+	future  *Future
+
+	// The sequence number the event was accepted with.
+	seq uint64
+}
+
+// AsyncPublisher publishes events in the background. Events are held in a
+// bounded in-memory queue, and written by a pool of workers through a
+// Publisher, so the middleware and durability level of the publisher apply.
+//
+// When a worker takes events off the queue, it takes all of the events
+// waiting there, and writes them together, sharing the syncs required by the
+// durability level of the publisher. The busier the publisher, the more
+// events share each sync. With more than one worker and
+// store.DurabilityGroupCommit set on the publisher, the syncs of the workers
+// are batched too.
+type AsyncPublisher struct {
+	// The publisher the events are written through.
+	p *Publisher
+
+	// The size of the queue.
+	queueSize int
+
+	// The number of workers writing events.
+	workers int
+
+	// The policy for events published while the queue is full.
+	queueFullPolicy QueueFullPolicy
+
+	// The handler called with the outcome of each publish, if any.
+	onPublished func(id string, err error)
+
+	// The queue of events waiting to be written.
+	queue chan asyncEvent
+
+	// Protects closed. Publishes hold a read lock while queueing, so the
+	// queue is not closed under them.
+	mu sync.RWMutex
+
+	// True once the publisher has been closed.
+	closed bool
+
+	// Protects the fields below, and signals when flushed moves on.
+	flushMu   sync.Mutex
+	flushCond *sync.Cond
+
+	// The sequence number for the next event accepted.
+	next uint64
+
+	// All events accepted with sequence numbers below flushed have been
+	// written, or have failed. finished holds the sequence numbers of the
+	// events above it that have.
+	flushed  uint64
+	finished map[uint64]bool
+
+	// Tracks the workers.
+	wg sync.WaitGroup
+}
+
+// AsyncOption is a functional option that can be passed to NewAsyncPublisher
+// to change the behavior of the publisher.
+type AsyncOption func(*AsyncPublisher) error
+
+// AsyncQueueSize sets the number of events the publisher holds in memory while
+// they wait to be written. The default is 100.
+func AsyncQueueSize(n int) AsyncOption {
+	return func(a *AsyncPublisher) error {
+		if n < 1 {
+			return errors.New("queue size must be at least 1")
+		}
+		a.queueSize = n
+		return nil
+	}
+}
+
+// AsyncWorkers sets the number of workers writing events concurrently. Events
+// are written in the order they were published with a single worker, which is
+// the default.
+func AsyncWorkers(n int) AsyncOption {
+	return func(a *AsyncPublisher) error {
+		if n < 1 {
+			return errors.New("number of workers must be at least 1")
+		}
+		a.workers = n
+		return nil
+	}
+}
+
+// OnQueueFull sets the policy for events published while the queue is full.
+func OnQueueFull(p QueueFullPolicy) AsyncOption {
+	return func(a *AsyncPublisher) error {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		a.queueFullPolicy = p
+		return nil
+	}
+}
+
+// OnPublished sets a handler that is called with the outcome of each publish,
+// as an alternative to waiting on futures. The handler is called from the
+// worker that wrote the event, so it should not block.
+func OnPublished(f func(id string, err error)) AsyncOption {
+	return func(a *AsyncPublisher) error {
+		a.onPublished = f
+		return nil
+	}
+}
+
+// NewAsyncPublisher starts publishing events asynchronously through p.
+func NewAsyncPublisher(p *Publisher, opts ...AsyncOption) (*AsyncPublisher, error) {
+	a := &AsyncPublisher{
+		p:         p,
+		queueSize: defaultAsyncQueueSize,
+		workers:   1,
+	}
+	for _, opt := range opts {
+		if err := opt(a); err != nil {
+			return nil, err
+		}
+	}
+	a.flushCond = sync.NewCond(&a.flushMu)
+	a.finished = make(map[uint64]bool)
+	a.queue = make(chan asyncEvent, a.queueSize)
+	for i := 0; i < a.workers; i++ {
+		a.wg.Add(1)
+		go a.work()
+	}
+	return a, nil
+}
+
+// work writes events from the queue until it is closed. Each event taken off
+// the queue is written along with any others waiting behind it.
+func (a *AsyncPublisher) work() {
+	defer a.wg.Done()
+	for e := range a.queue {
+		es := []asyncEvent{e}
+	drain:
+		for len(es) < a.queueSize {
+			select {
+			case e, ok := <-a.queue:
+				if !ok {
+					break drain
+				}
+				es = append(es, e)
+			default:
+				break drain
+			}
+		}
+		a.write(es)
+	}
+}
+
+// write writes the events in es together, and completes their futures.
+func (a *AsyncPublisher) write(es []asyncEvent) {
+	events := make([]interface{}, len(es))
+	headers := make([]map[string]string, len(es))
+	for i, e := range es {
+		events[i], headers[i] = e.event, e.headers
+	}
+	ids, errs := a.p.publishEach(events, headers)
+	for i, e := range es {
+		e.future.complete(ids[i], errs[i])
+		if a.onPublished != nil {
+			a.onPublished(ids[i], errs[i])
+		}
+		a.finish(e.seq)
+	}
+}
+
+// finish records the event accepted with the sequence number seq as written,
+// or failed, waking up any flushes waiting on it.
+func (a *AsyncPublisher) finish(seq uint64) {
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+	a.finished[seq] = true
+	moved := false
+	for a.finished[a.flushed] {
+		delete(a.finished, a.flushed)
+		a.flushed++
+		moved = true
+	}
+	if moved {
+		a.flushCond.Broadcast()
+	}
+}
+
+// Publish queues an event to be published, and returns a future for the
+// outcome. Under QueueFullBlock, Publish waits for room in the queue.
+func (a *AsyncPublisher) Publish(event interface{}) *Future {
+	return a.PublishWithHeaders(event, nil)
+}
+
+// PublishWithHeaders works as per Publish, but also attaches the supplied
+// headers to the event. See Publisher.PublishWithHeaders.
+func (a *AsyncPublisher) PublishWithHeaders(event interface{}, headers map[string]string) *Future {
+	f := newFuture()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return f.complete("", ErrClosed)
+	}
+	e := asyncEvent{event: event, headers: headers, future: f}
+	a.flushMu.Lock()
+	e.seq = a.next
+	a.next++
+	a.flushMu.Unlock()
+	if a.queueFullPolicy == QueueFullBlock {
+		a.queue <- e
+		return f
+	}
+	select {
+	case a.queue <- e:
+		return f
+	default:
+	}
+	f.complete("", ErrQueueFull)
+	a.finish(e.seq)
+	return f
+}
+
+// Flush waits for all of the events published before Flush was called to be
+// written. Events published while Flush is waiting are not waited for, so
+// Flush returns even while other goroutines keep publishing.
+func (a *AsyncPublisher) Flush() {
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+	target := a.next
+	for a.flushed < target {
+		a.flushCond.Wait()
+	}
+}
+
+// Close stops the publisher from accepting new events, and waits for the
+// events already queued to be written. Publishes after Close fail with
+// ErrClosed. It is safe to call Close more than once.
+func (a *AsyncPublisher) Close() {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.mu.Unlock()
+	a.wg.Wait()
+}
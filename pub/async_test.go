@@ -0,0 +1,293 @@
+package pub
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+func TestAsyncPublisher(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Options []AsyncOption
+	}{
+		{
+			Name: "defaults",
+		},
+		{
+			Name:    "single slot queue",
+			Options: []AsyncOption{AsyncQueueSize(1)},
+		},
+		{
+			Name:    "workers",
+			Options: []AsyncOption{AsyncWorkers(4)},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "pubtest")
+			defer os.RemoveAll(dir)
+			p, err := NewPublisher(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			var mu sync.Mutex
+			published := make(map[string]bool)
+			opts := append(tc.Options, OnPublished(func(id string, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if err == nil {
+					published[id] = true
+				}
+			}))
+			a, err := NewAsyncPublisher(p, opts...)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			var futures []*Future
+			for i := 0; i < 10; i++ {
+				futures = append(futures, a.Publish(TestEvent{Text: "foo"}))
+			}
+			a.Flush()
+			for _, f := range futures {
+				select {
+				case <-f.Done():
+				default:
+					t.Fatal("expected future to be done after flush")
+				}
+				id, err := f.Wait()
+				if err != nil {
+					t.Fatalf("bad: %s", err)
+				}
+				if !published[id] {
+					t.Fatalf("expected callback for %s", id)
+				}
+				if _, err := store.Fetch(dir, TestEvent{}, id); err != nil {
+					t.Fatalf("bad: %s", err)
+				}
+			}
+			a.Close()
+			if _, err := a.Publish(TestEvent{Text: "foo"}).Wait(); err != ErrClosed {
+				t.Fatalf("expected %v, got %v", ErrClosed, err)
+			}
+			es, err := store.Dump(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if len(es) != 10 {
+				t.Fatalf("expected 10 events, got %d", len(es))
+			}
+		})
+	}
+}
+
+func TestAsyncPublisherQueueFull(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pubtest")
+	defer os.RemoveAll(dir)
+	p, err := NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// Hold the worker up in middleware so the queue fills.
+	block := make(chan struct{})
+	p.Use(func(next PublishFunc) PublishFunc {
+		return func(m *Message) error {
+			<-block
+			return next(m)
+		}
+	})
+	a, err := NewAsyncPublisher(p, AsyncQueueSize(1), OnQueueFull(QueueFullFail))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	var futures []*Future
+	var full int
+	for i := 0; i < 5; i++ {
+		f := a.Publish(TestEvent{Text: "foo"})
+		select {
+		case <-f.Done():
+			if _, err := f.Wait(); err != ErrQueueFull {
+				t.Fatalf("expected %v, got %v", ErrQueueFull, err)
+			}
+			full++
+		default:
+			futures = append(futures, f)
+		}
+	}
+	// At most one event is being written and one is queued.
+	if full < 3 {
+		t.Fatalf("expected at least 3 publishes to fail, got %d", full)
+	}
+	close(block)
+	a.Close()
+	for _, f := range futures {
+		if _, err := f.Wait(); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+	es, err := store.Dump(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if len(es) != len(futures) {
+		t.Fatalf("expected %d events, got %d", len(futures), len(es))
+	}
+}
+
+func TestAsyncPublisherInvalidQueueFullPolicy(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pubtest")
+	defer os.RemoveAll(dir)
+	p, err := NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if _, err := NewAsyncPublisher(p, OnQueueFull(QueueFullPolicy(99))); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestAsyncPublisherFlushWhilePublishing(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pubtest")
+	defer os.RemoveAll(dir)
+	p, err := NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	a, err := NewAsyncPublisher(p, AsyncQueueSize(4))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer a.Close()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				a.Publish(TestEvent{Text: "foo"})
+			}
+		}()
+	}
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	// Flush must return while the other publishers keep the queue busy.
+	for i := 0; i < 5; i++ {
+		f := a.Publish(TestEvent{Text: "bar"})
+		done := make(chan struct{})
+		go func() {
+			a.Flush()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for flush")
+		}
+		select {
+		case <-f.Done():
+		default:
+			t.Fatal("expected future to be done after flush")
+		}
+	}
+}
+
+func TestAsyncPublisherDrainsQueue(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pubtest")
+	defer os.RemoveAll(dir)
+	p, err := NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// Hold the worker up on the first event, and record the order the rest
+	// of the events pass through the middleware in.
+	entered := make(chan struct{})
+	block := make(chan struct{})
+	var mu sync.Mutex
+	var calls []string
+	p.Use(func(next PublishFunc) PublishFunc {
+		return func(m *Message) error {
+			text := m.Event.(TestEvent).Text
+			if text == "first" {
+				close(entered)
+				<-block
+				return next(m)
+			}
+			if text == "reject" {
+				return errors.New("rejected")
+			}
+			mu.Lock()
+			calls = append(calls, "enter "+text)
+			mu.Unlock()
+			err := next(m)
+			mu.Lock()
+			calls = append(calls, "exit "+text)
+			mu.Unlock()
+			return err
+		}
+	})
+	a, err := NewAsyncPublisher(p)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	first := a.Publish(TestEvent{Text: "first"})
+	<-entered
+	var futures []*Future
+	for _, text := range []string{"a", "b", "reject", "c"} {
+		futures = append(futures, a.Publish(TestEvent{Text: text}))
+	}
+	close(block)
+	a.Close()
+
+	// The queued events are written together, so every one of them reaches
+	// the write before any of them is written.
+	expected := []string{"enter a", "enter b", "enter c", "exit c", "exit b", "exit a"}
+	if !reflect.DeepEqual(expected, calls) {
+		t.Fatalf("expected %q, got %q", expected, calls)
+	}
+	id, err := first.Wait()
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	ids := []string{id}
+	for i, f := range futures {
+		id, err := f.Wait()
+		if i == 2 {
+			if err == nil || err.Error() != "rejected" {
+				t.Fatalf("expected rejection, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		ids = append(ids, id)
+	}
+	s, err := store.NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	got, _, err := s.EventIDsAfter(store.Checkpoint{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if !reflect.DeepEqual(ids, got) {
+		t.Fatalf("expected stream order %q, got %q", ids, got)
+	}
+}
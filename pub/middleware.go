@@ -0,0 +1,114 @@
+package pub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+// Message is an event on its way to being published. Middleware can change
+// any of its fields before passing it on.
+type Message struct {
+	// The ID the event is published with.
+	ID string
+
+	// The event data.
+	Event interface{}
+
+	// The headers the event is published with.
+	Headers map[string]string
+}
+
+// PublishFunc publishes a message. It is the next step in a middleware
+// chain, ending with the function that writes the event to the stream.
+type PublishFunc func(*Message) error
+
+// ErrDropped is returned when middleware returns without calling next, but
+// also without returning an error. The event is not published.
+var ErrDropped = errors.New("event dropped by middleware")
+
+// Middleware wraps the publishing of an event. A middleware can inspect or
+// change the message before calling next, reject it by returning an error
+// without calling next, or act on the outcome of next, which is the error
+// from the write if the rest of the chain passed. A middleware that returns
+// nil without calling next drops the event, and the publish fails with
+// ErrDropped.
+type Middleware func(next PublishFunc) PublishFunc
+
+// Use adds middleware to the chain run around every publish. Middleware is run
+// in the order it is added, so the first middleware added sees the message
+// first and the outcome of the write last. Use is not safe to call while
+// events are being published.
+func (p *Publisher) Use(mw ...Middleware) {
+	p.middleware = append(p.middleware, mw...)
+}
+
+// publish runs the middleware chain for the message m, ending in write.
+// ErrDropped is returned if the chain passes without reaching write.
+func (p *Publisher) publish(m *Message, write PublishFunc) error {
+	reached := false
+	f := func(m *Message) error {
+		reached = true
+		return write(m)
+	}
+	for i := len(p.middleware) - 1; i >= 0; i-- {
+		f = p.middleware[i](f)
+	}
+	if err := f(m); err != nil {
+		return err
+	}
+	if !reached {
+		return ErrDropped
+	}
+	return nil
+}
+
+// Validate returns middleware that rejects events that fail their own
+// validation. See store.Validate.
+func Validate() Middleware {
+	return func(next PublishFunc) PublishFunc {
+		return func(m *Message) error {
+			if err := store.Validate(m.Event); err != nil {
+				return err
+			}
+			return next(m)
+		}
+	}
+}
+
+// MaxSize returns middleware that rejects events whose encoded data is larger
+// than n bytes.
+func MaxSize(n int) Middleware {
+	return func(next PublishFunc) PublishFunc {
+		return func(m *Message) error {
+			b, err := json.Marshal(m.Event)
+			if err != nil {
+				return fmt.Errorf("could not marshal event data: %s", err)
+			}
+			if len(b) > n {
+				return fmt.Errorf("event data is %d bytes, larger than the maximum of %d", len(b), n)
+			}
+			return next(m)
+		}
+	}
+}
+
+// SetHeaders returns middleware that sets the supplied headers on every
+// event, replacing any headers of the same name.
+func SetHeaders(headers map[string]string) Middleware {
+	return func(next PublishFunc) PublishFunc {
+		return func(m *Message) error {
+			h := make(map[string]string, len(m.Headers)+len(headers))
+			for k, v := range m.Headers {
+				h[k] = v
+			}
+			for k, v := range headers {
+				h[k] = v
+			}
+			m.Headers = h
+			return next(m)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package pub
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+type ValidatedEvent struct {
+	Text string
+}
+
+func (e *ValidatedEvent) Validate() error {
+	if e.Text == "" {
+		return errors.New("text cannot be empty")
+	}
+	return nil
+}
+
+func TestUse(t *testing.T) {
+	cases := []struct {
+		Name       string
+		Middleware []Middleware
+		Event      ValidatedEvent
+		Headers    map[string]string
+		Err        string
+	}{
+		{
+			Name:  "no middleware",
+			Event: ValidatedEvent{Text: ""},
+		},
+		{
+			Name:       "valid event",
+			Middleware: []Middleware{Validate()},
+			Event:      ValidatedEvent{Text: "foo"},
+		},
+		{
+			Name:       "invalid event",
+			Middleware: []Middleware{Validate()},
+			Event:      ValidatedEvent{Text: ""},
+			Err:        "invalid event: text cannot be empty",
+		},
+		{
+			Name:       "oversized event",
+			Middleware: []Middleware{MaxSize(10)},
+			Event:      ValidatedEvent{Text: "foobarbaz"},
+			Err:        "event data is 20 bytes, larger than the maximum of 10",
+		},
+		{
+			Name:       "headers",
+			Middleware: []Middleware{SetHeaders(map[string]string{"tenant": "a"}), SetHeaders(map[string]string{"user": "b"})},
+			Event:      ValidatedEvent{Text: "foo"},
+			Headers:    map[string]string{"tenant": "a", "user": "b"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "pubtest")
+			defer os.RemoveAll(dir)
+			pub, err := NewPublisher(dir, ValidatedEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			pub.Use(tc.Middleware...)
+			// Each publish method goes through the chain.
+			publish := []func() (string, error){
+				func() (string, error) { return pub.Publish(tc.Event) },
+				func() (string, error) { return pub.PublishWithID("id", tc.Event) },
+				func() (string, error) {
+					id, _, err := pub.PublishToAggregate("agg", store.AnyVersion, tc.Event)
+					return id, err
+				},
+				func() (string, error) {
+					ids, err := pub.PublishBatch(tc.Event)
+					if err != nil {
+						return "", err
+					}
+					return ids[0], nil
+				},
+			}
+			for _, f := range publish {
+				id, err := f()
+				switch {
+				case err != nil && tc.Err == "":
+					t.Fatalf("bad: %s", err)
+				case err == nil && tc.Err != "":
+					t.Fatal("expected error, got none")
+				case err != nil && tc.Err != "":
+					if !strings.Contains(err.Error(), tc.Err) {
+						t.Fatalf("expected error to match %q, got %q", tc.Err, err)
+					}
+					continue
+				}
+				e, err := store.Fetch(dir, ValidatedEvent{}, id)
+				if err != nil {
+					t.Fatalf("bad: %s", err)
+				}
+				if !reflect.DeepEqual(tc.Headers, e.Headers) {
+					t.Fatalf("expected headers %#v, got %#v", tc.Headers, e.Headers)
+				}
+			}
+			if tc.Err != "" {
+				if es, err := store.Dump(dir, ValidatedEvent{}); err != nil || len(es) != 0 {
+					t.Fatalf("expected nothing published, got %#v, %v", es, err)
+				}
+			}
+		})
+	}
+}
+
+func TestUseOrder(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pubtest")
+	defer os.RemoveAll(dir)
+	pub, err := NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next PublishFunc) PublishFunc {
+			return func(m *Message) error {
+				calls = append(calls, name+" before")
+				err := next(m)
+				calls = append(calls, name+" after")
+				return err
+			}
+		}
+	}
+	pub.Use(trace("a"), trace("b"))
+	if _, err := pub.Publish(TestEvent{Text: "foo"}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	expected := []string{"a before", "b before", "b after", "a after"}
+	if !reflect.DeepEqual(expected, calls) {
+		t.Fatalf("expected %q, got %q", expected, calls)
+	}
+}
+
+func TestUseBatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pubtest")
+	defer os.RemoveAll(dir)
+	pub, err := NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	existing, err := pub.Publish(TestEvent{Text: "existing"})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	var calls []string
+	var outcomes []error
+	pub.Use(func(next PublishFunc) PublishFunc {
+		return func(m *Message) error {
+			text := m.Event.(TestEvent).Text
+			calls = append(calls, text+" before")
+			// Give the last event an ID that is already taken, so that the
+			// batch write fails.
+			if text == "collide" {
+				m.ID = existing
+			}
+			err := next(m)
+			calls = append(calls, text+" after")
+			outcomes = append(outcomes, err)
+			return err
+		}
+	})
+	if _, err := pub.PublishBatch(TestEvent{Text: "foo"}, TestEvent{Text: "collide"}); err == nil {
+		t.Fatal("expected error, got none")
+	}
+	expected := []string{"foo before", "collide before", "collide after", "foo after"}
+	if !reflect.DeepEqual(expected, calls) {
+		t.Fatalf("expected %q, got %q", expected, calls)
+	}
+	// Every middleware sees the outcome of the batch write.
+	for _, err := range outcomes {
+		if _, ok := err.(store.IDCollisionError); !ok {
+			t.Fatalf("expected IDCollisionError, got %v", err)
+		}
+	}
+}
+
+func TestUseDropped(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pubtest")
+	defer os.RemoveAll(dir)
+	pub, err := NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// Drop every event but "keep" without reporting an error.
+	pub.Use(func(next PublishFunc) PublishFunc {
+		return func(m *Message) error {
+			if m.Event.(TestEvent).Text != "keep" {
+				return nil
+			}
+			return next(m)
+		}
+	})
+	a, err := NewAsyncPublisher(pub)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer a.Close()
+
+	publishes := map[string]func() (string, error){
+		"publish": func() (string, error) { return pub.Publish(TestEvent{Text: "foo"}) },
+		"batch": func() (string, error) {
+			ids, err := pub.PublishBatch(TestEvent{Text: "keep"}, TestEvent{Text: "foo"})
+			return strings.Join(ids, ","), err
+		},
+		"aggregate": func() (string, error) {
+			id, _, err := pub.PublishToAggregate("agg", 0, TestEvent{Text: "foo"})
+			return id, err
+		},
+		"scheduled": func() (string, error) { return pub.PublishAt(time.Now(), TestEvent{Text: "foo"}) },
+		"with ID":   func() (string, error) { return pub.PublishWithID("foo", TestEvent{Text: "foo"}) },
+		"async":     func() (string, error) { return a.Publish(TestEvent{Text: "foo"}).Wait() },
+	}
+	for name, f := range publishes {
+		id, err := f()
+		if err != ErrDropped {
+			t.Fatalf("%s: expected %v, got %v", name, ErrDropped, err)
+		}
+		if id != "" {
+			t.Fatalf("%s: expected no ID, got %q", name, id)
+		}
+	}
+
+	// Events kept by the middleware are still published.
+	if _, err := a.Publish(TestEvent{Text: "keep"}).Wait(); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	es, err := store.Dump(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if len(es) != 1 || es[0].Data.(TestEvent).Text != "keep" {
+		t.Fatalf("expected only the kept event, got %#v", es)
+	}
+	if s, err := pub.Scheduled(); err != nil || len(s) != 0 {
+		t.Fatalf("expected no scheduled events, got %#v, %v", s, err)
+	}
+}
@@ -3,16 +3,25 @@
 package pub
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/vancluever/fspubsub/store"
 )
 
+// IdempotencyNamespace is the namespace used to derive event IDs from
+// idempotency keys passed to PublishWithKey.
+var IdempotencyNamespace = uuid.MustParse("3c8055e3-a7d8-48d6-b675-56d4a974a7da")
+
 // Publisher is a simple event publisher, designed to publish events to the
 // file system.
 type Publisher struct {
 	*store.Stream
+
+	// The middleware run around each publish, outermost first.
+	middleware []Middleware
 }
 
 // NewPublisher creates a publisher for the specific type. The events are
@@ -21,11 +30,47 @@ type Publisher struct {
 //
 // Any data in event is ignored - it just serves to infer the type of event
 // this publisher is locked to.
+//
+// Any batches left partially published in the stream, and any aggregate
+// events left staged, by a publisher that crashed while publishing them, are
+// completed when the publisher is created.
 func NewPublisher(dir string, event interface{}) (*Publisher, error) {
 	stream, err := store.NewStream(dir, event)
 	if err != nil {
 		return nil, err
 	}
+	if err := stream.RecoverBatches(); err != nil {
+		return nil, err
+	}
+	if err := stream.RecoverAggregates(); err != nil {
+		return nil, err
+	}
+	p := &Publisher{
+		Stream: stream,
+	}
+	return p, nil
+}
+
+// NewTopicPublisher creates a publisher for the topic in the base directory
+// dir. Topics are made up of segments separated by dots, and each segment is a
+// level of directory, kept apart from the streams named after event types -
+// events for "orders.eu.created" are published to
+// dir/.topics/orders/eu/created. Subscribers can watch more than one topic at
+// once using wildcards.
+//
+// Any data in event is ignored - it just serves to infer the type of event
+// this publisher is locked to.
+func NewTopicPublisher(dir, topic string, event interface{}) (*Publisher, error) {
+	stream, err := store.NewTopicStream(dir, topic, event)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.RecoverBatches(); err != nil {
+		return nil, err
+	}
+	if err := stream.RecoverAggregates(); err != nil {
+		return nil, err
+	}
 	p := &Publisher{
 		Stream: stream,
 	}
@@ -35,14 +80,236 @@ func NewPublisher(dir string, event interface{}) (*Publisher, error) {
 // Publish publishes an event. The event is a single file in the directory,
 // with a v4 UUID as the ID and filename. The ID is returned as a string.
 func (p *Publisher) Publish(event interface{}) (string, error) {
+	return p.PublishWithHeaders(event, nil)
+}
+
+// PublishWithHeaders works as per Publish, but also attaches the supplied
+// headers to the event. Headers are kept separate from the event data, and
+// are delivered to subscribers in the Headers field of the event.
+func (p *Publisher) PublishWithHeaders(event interface{}, headers map[string]string) (string, error) {
 	id, err := uuid.NewRandom()
 	if err != nil {
 		return "", fmt.Errorf("could not generate ID: %s", err)
 	}
 
-	if err := p.Stream.WriteEvent(id.String(), event); err != nil {
+	m := &Message{ID: id.String(), Event: event, Headers: headers}
+	if err := p.publish(m, func(m *Message) error {
+		return p.Stream.WriteEventWithHeaders(m.ID, m.Event, m.Headers)
+	}); err != nil {
 		return "", err
 	}
 
-	return id.String(), nil
+	return m.ID, nil
+}
+
+// PublishBatch publishes the events in events as a single batch. Either all
+// of the events become visible to subscribers and in dumps of the stream, or
+// none of them do, and they are ordered one after the other. Each event gets a
+// v4 UUID as its ID, and the IDs are returned in the same order as events.
+//
+// The middleware chains for the events are nested, one inside the other in
+// the order of the events, with the batch written at the end of the innermost
+// chain. The batch is only written if every chain passes, and every
+// middleware sees the outcome of the batch write.
+func (p *Publisher) PublishBatch(events ...interface{}) ([]string, error) {
+	batch, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate batch ID: %s", err)
+	}
+	ms := make([]*Message, len(events))
+	for i, event := range events {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return nil, fmt.Errorf("could not generate ID: %s", err)
+		}
+		ms[i] = &Message{ID: id.String(), Event: event}
+	}
+
+	if err := p.publishBatch(batch.String(), ms, 0); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(ms))
+	for i, m := range ms {
+		ids[i] = m.ID
+	}
+	return ids, nil
+}
+
+// publishBatch runs the middleware chain for the message ms[i], ending in the
+// chain for the next message, and writes the batch once the chains have been
+// run for all of them.
+func (p *Publisher) publishBatch(batch string, ms []*Message, i int) error {
+	if i == len(ms) {
+		ids := make([]string, len(ms))
+		data := make([]interface{}, len(ms))
+		headers := make([]map[string]string, len(ms))
+		for j, m := range ms {
+			ids[j], data[j], headers[j] = m.ID, m.Event, m.Headers
+		}
+		return p.Stream.WriteBatch(batch, ids, data, headers)
+	}
+	return p.publish(ms[i], func(m *Message) error {
+		ms[i] = m
+		return p.publishBatch(batch, ms, i+1)
+	})
+}
+
+// publishEach publishes each of the events in events, with the headers in
+// headers, which can be nil, in order. Unlike PublishBatch, the events are
+// published independently - an event rejected by its middleware chain, or
+// that fails to be written, does not stop the others from being published -
+// but they are written together, sharing the syncs for the durability level
+// of the stream. The IDs of the events, and the outcome of each publish, are
+// returned in the same order as events.
+//
+// The middleware chains are nested as per PublishBatch. If a chain rejects its
+// event, the chains for the events after it are run in its place, so each
+// event's own chain still sees only the outcome of its own write.
+func (p *Publisher) publishEach(events []interface{}, headers []map[string]string) ([]string, []error) {
+	ms := make([]*Message, len(events))
+	errs := make([]error, len(events))
+	for i, event := range events {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			errs[i] = fmt.Errorf("could not generate ID: %s", err)
+			continue
+		}
+		ms[i] = &Message{ID: id.String(), Event: event}
+		if headers != nil {
+			ms[i].Headers = headers[i]
+		}
+	}
+	written := make([]bool, len(events))
+	p.publishEachFrom(ms, written, errs, 0)
+
+	ids := make([]string, len(ms))
+	for i, m := range ms {
+		if m != nil && errs[i] == nil {
+			ids[i] = m.ID
+		}
+	}
+	return ids, errs
+}
+
+// publishEachFrom runs the middleware chain for the message ms[i], ending in
+// the chain for the next message, and writes the messages whose chains passed
+// once the chains have been run for all of them. written records the messages
+// that reached the write, and errs the outcome for each message.
+func (p *Publisher) publishEachFrom(ms []*Message, written []bool, errs []error, i int) {
+	if i == len(ms) {
+		var ids []string
+		var data []interface{}
+		var headers []map[string]string
+		var idx []int
+		for j, m := range ms {
+			if written[j] {
+				ids, data, headers = append(ids, m.ID), append(data, m.Event), append(headers, m.Headers)
+				idx = append(idx, j)
+			}
+		}
+		if len(idx) == 0 {
+			return
+		}
+		for k, err := range p.Stream.WriteEvents(ids, data, headers) {
+			errs[idx[k]] = err
+		}
+		return
+	}
+	if ms[i] == nil {
+		p.publishEachFrom(ms, written, errs, i+1)
+		return
+	}
+	reached := false
+	err := p.publish(ms[i], func(m *Message) error {
+		reached = true
+		ms[i] = m
+		written[i] = true
+		p.publishEachFrom(ms, written, errs, i+1)
+		return errs[i]
+	})
+	if !reached {
+		p.publishEachFrom(ms, written, errs, i+1)
+	}
+	errs[i] = err
+}
+
+// PublishToAggregate publishes an event to the aggregate with the ID
+// aggregate, checking that the aggregate is at expectedVersion first. If it is
+// not - usually because another publisher appended to it first - a
+// store.ConcurrencyError is returned and the event is not published. Pass zero
+// for a new aggregate, or store.AnyVersion to skip the check.
+//
+// The event is published to the stream like any other event. The ID of the
+// event and the new version of the aggregate are returned. Use
+// store.DumpAggregate to read the events of an aggregate back in version
+// order.
+func (p *Publisher) PublishToAggregate(aggregate string, expectedVersion int64, event interface{}) (string, int64, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", 0, fmt.Errorf("could not generate ID: %s", err)
+	}
+
+	var v int64
+	m := &Message{ID: id.String(), Event: event}
+	if err := p.publish(m, func(m *Message) error {
+		var err error
+		v, err = p.Stream.WriteAggregateEvent(aggregate, expectedVersion, m.ID, m.Event, m.Headers)
+		return err
+	}); err != nil {
+		return "", 0, err
+	}
+
+	return m.ID, v, nil
+}
+
+// PublishAt publishes an event that only becomes visible to subscribers, and
+// in dumps of the stream, at t. The event is kept in the stream until then,
+// so it survives restarts, and is released by a Scheduler running against the
+// stream. The event is published at the time it is released, so a late
+// release orders it after the events published before it. The event gets a v4
+// UUID as its ID, which is returned as a string.
+func (p *Publisher) PublishAt(t time.Time, event interface{}) (string, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("could not generate ID: %s", err)
+	}
+
+	m := &Message{ID: id.String(), Event: event}
+	if err := p.publish(m, func(m *Message) error {
+		return p.Stream.WriteScheduledEvent(m.ID, m.Event, m.Headers, t)
+	}); err != nil {
+		return "", err
+	}
+
+	return m.ID, nil
+}
+
+// PublishWithID publishes an event with the supplied ID, rather than a
+// generated one. Publishing the same event with the same ID again succeeds
+// without publishing a second event, so a publish that failed ambiguously -
+// such as one that timed out, or one from a publisher that crashed - can be
+// retried safely. A retry made while another publish of the same ID is still
+// in progress waits for it to finish. A store.ConflictError is returned if an
+// event with the ID has already been published with different data.
+func (p *Publisher) PublishWithID(id string, event interface{}) (string, error) {
+	m := &Message{ID: id, Event: event}
+	if err := p.publish(m, func(m *Message) error {
+		_, err := p.Stream.WriteEventOnce(m.ID, m.Event, m.Headers)
+		return err
+	}); err != nil {
+		return "", err
+	}
+
+	return m.ID, nil
+}
+
+// PublishWithKey works as per PublishWithID, but derives the ID from the
+// idempotency key key, as a v5 UUID in IdempotencyNamespace. The ID is
+// returned as a string.
+func (p *Publisher) PublishWithKey(key string, event interface{}) (string, error) {
+	if key == "" {
+		return "", errors.New("idempotency key cannot be empty")
+	}
+	return p.PublishWithID(uuid.NewSHA1(IdempotencyNamespace, []byte(key)).String(), event)
 }
@@ -135,6 +135,50 @@ func TestNewPublisher(t *testing.T) {
 	}
 }
 
+func TestNewTopicPublisher(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Topic string
+		Err   string
+	}{
+		{
+			Name:  "basic success case",
+			Topic: "orders.eu.created",
+		},
+		{
+			Name:  "wildcard",
+			Topic: "orders.*.created",
+			Err:   "cannot contain wildcards",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "pubtest")
+			defer os.RemoveAll(dir)
+			pub, err := NewTopicPublisher(dir, tc.Topic, TestEvent{})
+			switch {
+			case err != nil && tc.Err == "":
+				t.Fatalf("bad: %s", err)
+			case err == nil && tc.Err != "":
+				t.Fatal("expected error, got none")
+			case err != nil && tc.Err != "":
+				if !strings.Contains(err.Error(), tc.Err) {
+					t.Fatalf("expected error to match %q, got %q", tc.Err, err)
+				}
+				return
+			}
+			id, err := pub.Publish(TestEvent{Text: "foo"})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if _, err := os.Stat(dir + "/.topics/orders/eu/created/" + id); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+		})
+	}
+}
+
 func TestPublish(t *testing.T) {
 	cases := []struct {
 		Name        string
@@ -235,3 +279,145 @@ func TestPublish(t *testing.T) {
 		})
 	}
 }
+
+func TestPublishWithHeaders(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pubtest")
+	defer os.RemoveAll(dir)
+	uuid.SetRand(nil)
+	pub, err := NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	headers := map[string]string{"foo": "bar"}
+	id, err := pub.PublishWithHeaders(TestEvent{Text: "foobar"}, headers)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	expected := store.Event{ID: id, Data: TestEvent{Text: "foobar"}, Headers: headers}
+	actual, err := store.Fetch(dir, TestEvent{}, id)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %#v, got %#v", expected, actual)
+	}
+}
+
+func TestPublishBatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pubtest")
+	defer os.RemoveAll(dir)
+	uuid.SetRand(nil)
+	pub, err := NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if _, err := pub.PublishBatch(TestEvent{Text: "foo"}, BadEvent{Text: "bar"}); err == nil {
+		t.Fatal("expected error, got none")
+	}
+	ids, err := pub.PublishBatch(TestEvent{Text: "foo"}, TestEvent{Text: "bar"})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	actual, _, err := pub.Stream.EventIDsAfter(store.Checkpoint{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if !reflect.DeepEqual(ids, actual) {
+		t.Fatalf("expected %q, got %q", ids, actual)
+	}
+}
+
+func TestPublishToAggregate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pubtest")
+	defer os.RemoveAll(dir)
+	uuid.SetRand(nil)
+	pub, err := NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	id, v, err := pub.PublishToAggregate("order-1", 0, TestEvent{Text: "created"})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+	if _, _, err := pub.PublishToAggregate("order-1", 0, TestEvent{Text: "created"}); err == nil {
+		t.Fatal("expected error, got none")
+	} else if _, ok := err.(store.ConcurrencyError); !ok {
+		t.Fatalf("expected store.ConcurrencyError, got %T", err)
+	}
+	es, err := store.DumpAggregate(dir, TestEvent{}, "order-1")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if len(es) != 1 || es[0].ID != id {
+		t.Fatalf("expected event %s, got %#v", id, es)
+	}
+}
+
+func TestPublishWithIDAfterCrash(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pubtest")
+	defer os.RemoveAll(dir)
+	pub, err := NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// A publisher that crashed after claiming the ID leaves its claim in the
+	// stream's staging directory.
+	claim := pub.Stream.Dir() + "/.tmp/abc"
+	if err := os.MkdirAll(filepath.Dir(claim), 0777); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := ioutil.WriteFile(claim, []byte(`{"Text":"foo"}`), 0666); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if _, err := pub.PublishWithID("abc", TestEvent{Text: "foo"}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	es, err := store.Dump(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if len(es) != 1 || es[0].ID != "abc" {
+		t.Fatalf("expected event abc to be published on retry, got %#v", es)
+	}
+}
+
+func TestPublishWithKey(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pubtest")
+	defer os.RemoveAll(dir)
+	pub, err := NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	id, err := pub.PublishWithKey("order-1-created", TestEvent{Text: "foo"})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if expected := uuid.NewSHA1(IdempotencyNamespace, []byte("order-1-created")).String(); id != expected {
+		t.Fatalf("expected ID %s, got %s", expected, id)
+	}
+	retried, err := pub.PublishWithKey("order-1-created", TestEvent{Text: "foo"})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if retried != id {
+		t.Fatalf("expected ID %s on retry, got %s", id, retried)
+	}
+	if _, err := pub.PublishWithKey("order-1-created", TestEvent{Text: "bar"}); err == nil {
+		t.Fatal("expected error, got none")
+	} else if _, ok := err.(store.ConflictError); !ok {
+		t.Fatalf("expected store.ConflictError, got %T", err)
+	}
+	if _, err := pub.PublishWithKey("", TestEvent{Text: "foo"}); err == nil {
+		t.Fatal("expected error for empty key, got none")
+	}
+	es, err := store.Dump(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if len(es) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(es))
+	}
+}
@@ -0,0 +1,173 @@
+package pub
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+// defaultScheduleInterval is the default interval a Scheduler checks its
+// stream for newly scheduled events on.
+const defaultScheduleInterval = time.Second
+
+// Scheduler releases the scheduled events of a stream as they fall due,
+// making them visible to subscribers and in dumps of the stream.
+//
+// Scheduled events are kept on the file system, so they survive restarts, and
+// any number of schedulers can run against the same stream, in one process or
+// several - each event is released by exactly one of them.
+type Scheduler struct {
+	// The stream the scheduler releases events in.
+	stream *store.Stream
+
+	// The longest the scheduler waits between checks of the stream.
+	interval time.Duration
+
+	// Closed to stop the scheduler.
+	stop chan struct{}
+
+	// Makes sure stop is only closed once.
+	closeOnce sync.Once
+
+	// Closed when the scheduler has stopped.
+	done chan struct{}
+
+	// The handler for errors releasing events, if any.
+	onError func(error)
+}
+
+// SchedulerOption is a functional option that can be passed to NewScheduler
+// to change the behavior of the scheduler.
+type SchedulerOption func(*Scheduler) error
+
+// ScheduleInterval sets the longest the scheduler waits between checks of the
+// stream. Events scheduled by the scheduler's own process are not released
+// any sooner than events scheduled elsewhere, so this bounds how late an
+// event can be released. The default is one second.
+func ScheduleInterval(d time.Duration) SchedulerOption {
+	return func(s *Scheduler) error {
+		if d <= 0 {
+			return errors.New("schedule interval must be positive")
+		}
+		s.interval = d
+		return nil
+	}
+}
+
+// OnScheduleError sets a handler for errors the scheduler runs into while
+// releasing events. The scheduler keeps running after an error, and tries
+// again on its next check of the stream. The handler is called from the
+// scheduler's goroutine. Errors are discarded if no handler is set.
+func OnScheduleError(f func(error)) SchedulerOption {
+	return func(s *Scheduler) error {
+		s.onError = f
+		return nil
+	}
+}
+
+// NewScheduler starts releasing the scheduled events in the stream for the
+// type of event in the base directory dir. Any releases abandoned by a
+// scheduler that crashed are completed on every check of the stream.
+//
+// Any data in event is ignored - it just serves to infer the type of event
+// this scheduler is locked to.
+func NewScheduler(dir string, event interface{}, opts ...SchedulerOption) (*Scheduler, error) {
+	stream, err := store.NewStream(dir, event)
+	if err != nil {
+		return nil, err
+	}
+	return newScheduler(stream, opts...)
+}
+
+// NewTopicScheduler works as per NewScheduler, but for the topic in the base
+// directory dir. See NewTopicPublisher.
+func NewTopicScheduler(dir, topic string, event interface{}, opts ...SchedulerOption) (*Scheduler, error) {
+	stream, err := store.NewTopicStream(dir, topic, event)
+	if err != nil {
+		return nil, err
+	}
+	return newScheduler(stream, opts...)
+}
+
+// newScheduler starts a scheduler for stream.
+func newScheduler(stream *store.Stream, opts ...SchedulerOption) (*Scheduler, error) {
+	s := &Scheduler{
+		stream:   stream,
+		interval: defaultScheduleInterval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	go s.run()
+	return s, nil
+}
+
+// run releases events as they fall due, until the scheduler is stopped.
+// Errors are reported, and the release is tried again on the next check of
+// the stream.
+func (s *Scheduler) run() {
+	defer close(s.done)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-timer.C:
+		}
+		_, err := s.stream.ReleaseDue(time.Now())
+		if err == nil {
+			err = s.stream.RecoverScheduled()
+		}
+		if err != nil {
+			s.report(err)
+			timer.Reset(s.interval)
+			continue
+		}
+		timer.Reset(s.next())
+	}
+}
+
+// report passes err to the error handler, if there is one.
+func (s *Scheduler) report(err error) {
+	if s.onError != nil {
+		s.onError(err)
+	}
+}
+
+// next returns how long to wait before the next check of the stream - until
+// the next event is due, or the interval, whichever is sooner.
+func (s *Scheduler) next() time.Duration {
+	es, err := s.stream.Scheduled()
+	if err != nil || len(es) == 0 {
+		return s.interval
+	}
+	d := time.Until(es[0].Due)
+	switch {
+	case d < 0:
+		return 0
+	case d > s.interval:
+		return s.interval
+	}
+	return d
+}
+
+// Done returns a channel that closes when the scheduler has stopped after
+// being closed.
+func (s *Scheduler) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close stops the scheduler, and waits for it to finish releasing any events
+// it has started on. Events that are not released yet stay scheduled, to be
+// released by the next scheduler to run against the stream.
+func (s *Scheduler) Close() {
+	s.closeOnce.Do(func() { close(s.stop) })
+	<-s.done
+}
@@ -0,0 +1,111 @@
+package pub
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+func TestScheduler(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pubtest")
+	defer os.RemoveAll(dir)
+	p, err := NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	soon, err := p.PublishAt(time.Now().Add(100*time.Millisecond), TestEvent{Text: "soon"})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if _, err := p.PublishAt(time.Now().Add(time.Hour), TestEvent{Text: "later"}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if _, err := p.PublishAt(time.Now(), BadEvent{Text: "bad"}); err == nil {
+		t.Fatal("expected error, got none")
+	}
+
+	// Several schedulers release each event once.
+	var ss []*Scheduler
+	errs := make(chan error, 100)
+	for i := 0; i < 3; i++ {
+		s, err := NewScheduler(dir, TestEvent{}, ScheduleInterval(10*time.Millisecond), OnScheduleError(func(err error) { errs <- err }))
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		ss = append(ss, s)
+	}
+	if es, err := store.Dump(dir, TestEvent{}); err != nil || len(es) != 0 {
+		t.Fatalf("expected nothing visible yet, got %#v, %v", es, err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	for _, s := range ss {
+		s.Close()
+	}
+	close(errs)
+	for err := range errs {
+		t.Fatalf("bad: %s", err)
+	}
+	es, err := store.Dump(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if len(es) != 1 || es[0].ID != soon || !reflect.DeepEqual(TestEvent{Text: "soon"}, es[0].Data) {
+		t.Fatalf("expected only %s visible, got %#v", soon, es)
+	}
+}
+
+func TestNewSchedulerBadInterval(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pubtest")
+	defer os.RemoveAll(dir)
+	if _, err := NewScheduler(dir, TestEvent{}, ScheduleInterval(0)); err == nil {
+		t.Fatal("expected error, got none")
+	}
+}
+
+func TestSchedulerError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pubtest")
+	defer os.RemoveAll(dir)
+	p, err := NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	id, err := p.PublishAt(time.Now(), TestEvent{Text: "foo"})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// A file in the way of the release directory makes releases fail until it
+	// is removed.
+	release := p.Stream.Dir() + "/.scheduled/.release"
+	if err := ioutil.WriteFile(release, nil, 0666); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	errs := make(chan error, 100)
+	s, err := NewScheduler(dir, TestEvent{}, ScheduleInterval(10*time.Millisecond), OnScheduleError(func(err error) { errs <- err }))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer s.Close()
+	select {
+	case <-errs:
+	case <-time.After(time.Second * 2):
+		t.Fatal("timed out waiting for error")
+	}
+	if err := os.Remove(release); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	timeout := time.After(time.Second * 2)
+	for {
+		if _, err := store.Fetch(dir, TestEvent{}, id); err == nil {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for the scheduler to recover")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
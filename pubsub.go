@@ -4,8 +4,12 @@
 // inotify. It also has facilities to pull the entire current store, and a single
 // event.
 //
-// Note that the hook on inotify events currently means that this package is
-// supported on Linux only.
+// Subscribers use inotify where it is available, and fall back to polling the
+// stream directory where it is not. inotify does not see writes made to network
+// filesystems such as NFS or CIFS by other hosts - for these, select the polling
+// watcher explicitly with the UseWatcher option:
+//
+//   s, err := sub.NewSubscriber(wd, TestEvent{}, sub.UseWatcher(sub.NewPollWatcher(time.Second)))
 //
 // Usage Synopsis
 //
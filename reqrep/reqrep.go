@@ -0,0 +1,271 @@
+// Package reqrep implements request/reply messaging on top of event streams.
+//
+// A Requester publishes requests with a correlation ID and the name of the
+// stream to send the reply to in their headers, and waits for the reply with
+// the matching correlation ID. A responder, started with NewResponder, handles
+// the requests and publishes the replies.
+package reqrep
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vancluever/fspubsub/pub"
+	"github.com/vancluever/fspubsub/store"
+	"github.com/vancluever/fspubsub/sub"
+)
+
+const (
+	// CorrelationIDHeader is the header holding the ID that ties a reply to
+	// its request.
+	CorrelationIDHeader = "Correlation-Id"
+
+	// ReplyToHeader is the header holding the topic that the reply to a
+	// request is published to.
+	ReplyToHeader = "Reply-To"
+
+	// ErrorHeader is the header holding the error message for a request that
+	// failed.
+	ErrorHeader = "Error"
+)
+
+// ErrTimeout is returned by Request when no reply arrives within the timeout.
+var ErrTimeout = errors.New("timed out waiting for reply")
+
+// ErrClosed is returned by Request once the requester has been closed.
+var ErrClosed = errors.New("requester is closed")
+
+// ReplyError is the error returned by Request when the responder failed to
+// handle the request.
+type ReplyError struct {
+	// The ID of the reply event.
+	ID string
+
+	// The error message sent by the responder.
+	Message string
+}
+
+// Error implements error for ReplyError.
+func (e ReplyError) Error() string {
+	return fmt.Sprintf("request failed: %s", e.Message)
+}
+
+// Requester publishes requests and waits for their replies.
+type Requester struct {
+	// The publisher for requests.
+	requests *pub.Publisher
+
+	// The topic that replies are published to.
+	replyTo string
+
+	// The subscriber for replies.
+	replies *sub.MultiSubscriber
+
+	// Protects pending.
+	mu sync.Mutex
+
+	// The channels waiting for replies, by correlation ID.
+	pending map[string]chan store.Event
+
+	// Closed once the reply subscription has terminated.
+	done chan struct{}
+}
+
+// NewRequester creates a requester that publishes requests to the stream for
+// the type of request, and waits for replies of the type of reply on the
+// topic replyTo, both in the base directory dir. The options in opts are
+// applied to the reply subscriber.
+//
+// Replies are matched to requests by correlation ID, so a reply topic can be
+// shared by requesters that send different requests. Replies to requests that
+// have already timed out are discarded.
+//
+// Any data in request and reply is ignored - they just serve to infer the
+// types of the events.
+func NewRequester(dir string, request, reply interface{}, replyTo string, opts ...sub.Option) (*Requester, error) {
+	requests, err := pub.NewPublisher(dir, request)
+	if err != nil {
+		return nil, err
+	}
+	// Create the reply topic up front, so that the subscriber watches it from
+	// the start.
+	if _, err := store.NewTopicStream(dir, replyTo, reply); err != nil {
+		return nil, err
+	}
+	replies, err := sub.NewTopicSubscriber(dir, replyTo, reply, opts...)
+	if err != nil {
+		return nil, err
+	}
+	r := &Requester{
+		requests: requests,
+		replyTo:  replyTo,
+		replies:  replies,
+		pending:  make(map[string]chan store.Event),
+		done:     make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+// run hands replies to the requests waiting for them, until the reply
+// subscription terminates.
+func (r *Requester) run() {
+	defer close(r.done)
+	for {
+		select {
+		case e := <-r.replies.Queue():
+			r.mu.Lock()
+			c, ok := r.pending[e.Headers[CorrelationIDHeader]]
+			r.mu.Unlock()
+			if ok {
+				select {
+				case c <- e:
+				default:
+				}
+			}
+		case <-r.replies.Done():
+			return
+		}
+	}
+}
+
+// Request publishes a request with the supplied data, and waits for its
+// reply, up to timeout. ErrTimeout is returned if no reply arrives in time,
+// and a ReplyError is returned, along with the reply, if the responder failed
+// to handle the request.
+func (r *Requester) Request(data interface{}, timeout time.Duration) (store.Event, error) {
+	select {
+	case <-r.done:
+		return store.Event{}, r.closed()
+	default:
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return store.Event{}, fmt.Errorf("could not generate correlation ID: %s", err)
+	}
+	c := make(chan store.Event, 1)
+	r.mu.Lock()
+	r.pending[id.String()] = c
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, id.String())
+		r.mu.Unlock()
+	}()
+
+	headers := map[string]string{
+		CorrelationIDHeader: id.String(),
+		ReplyToHeader:       r.replyTo,
+	}
+	if _, err := r.requests.PublishWithHeaders(data, headers); err != nil {
+		return store.Event{}, err
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case e := <-c:
+		if msg, ok := e.Headers[ErrorHeader]; ok {
+			return e, ReplyError{ID: e.ID, Message: msg}
+		}
+		return e, nil
+	case <-t.C:
+		return store.Event{}, ErrTimeout
+	case <-r.done:
+		return store.Event{}, r.closed()
+	}
+}
+
+// closed returns the reason the reply subscription terminated.
+func (r *Requester) closed() error {
+	if err := r.replies.Error(); err != nil {
+		return err
+	}
+	return ErrClosed
+}
+
+// Close stops the requester. Any requests still waiting for a reply return
+// ErrClosed.
+func (r *Requester) Close() {
+	r.replies.Close()
+	<-r.done
+}
+
+// ReplyHandler handles a request, returning the data for the reply. The data
+// must be of the reply type given to NewResponder.
+type ReplyHandler func(store.Event) (interface{}, error)
+
+// responder publishes the replies for a ReplyHandler.
+type responder struct {
+	// The base directory of the reply topics.
+	dir string
+
+	// The type of the replies.
+	reply interface{}
+
+	// The handler for requests.
+	handler ReplyHandler
+
+	// Protects publishers.
+	mu sync.Mutex
+
+	// The publishers for the reply topics that have been seen, by topic.
+	publishers map[string]*pub.Publisher
+}
+
+// NewResponder starts a processor that handles the requests from src with h,
+// and publishes each reply of the type of reply to the topic named in the
+// request, in the base directory dir. The options in opts are applied to the
+// processor.
+//
+// If h returns an error, the error is sent back to the requester in place of
+// a reply, and the request is not retried. Requests that cannot be replied to
+// at all, such as those without a reply topic, fail in the processor, and are
+// retried and reported according to its options.
+func NewResponder(dir string, reply interface{}, src sub.Source, h ReplyHandler, opts ...sub.ProcessorOption) (*sub.Processor, error) {
+	r := &responder{
+		dir:        dir,
+		reply:      reply,
+		handler:    h,
+		publishers: make(map[string]*pub.Publisher),
+	}
+	return sub.NewProcessor(src, r.handle, opts...)
+}
+
+// handle handles the request e and publishes the reply.
+func (r *responder) handle(e store.Event) error {
+	replyTo, id := e.Headers[ReplyToHeader], e.Headers[CorrelationIDHeader]
+	if replyTo == "" || id == "" {
+		return fmt.Errorf("request %s has no reply topic or correlation ID", e.ID)
+	}
+	p, err := r.publisher(replyTo)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{CorrelationIDHeader: id}
+	data, err := r.handler(e)
+	if err != nil {
+		headers[ErrorHeader] = err.Error()
+		data = reflect.Zero(p.EventType()).Interface()
+	}
+	_, err = p.PublishWithHeaders(data, headers)
+	return err
+}
+
+// publisher returns the publisher for the reply topic replyTo.
+func (r *responder) publisher(replyTo string) (*pub.Publisher, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p, ok := r.publishers[replyTo]; ok {
+		return p, nil
+	}
+	p, err := pub.NewTopicPublisher(r.dir, replyTo, r.reply)
+	if err != nil {
+		return nil, err
+	}
+	r.publishers[replyTo] = p
+	return p, nil
+}
@@ -0,0 +1,155 @@
+package reqrep
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/store"
+	"github.com/vancluever/fspubsub/sub"
+)
+
+type TestRequestEvent struct {
+	Text string
+}
+
+type TestReplyEvent struct {
+	Text string
+}
+
+func TestRequest(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Text      string
+		Responder bool
+		Expected  TestReplyEvent
+		Err       string
+	}{
+		{
+			Name:      "basic success case",
+			Text:      "foo",
+			Responder: true,
+			Expected:  TestReplyEvent{Text: "FOO"},
+		},
+		{
+			Name:      "handler error",
+			Text:      "",
+			Responder: true,
+			Err:       "request failed: empty request",
+		},
+		{
+			Name: "no responder",
+			Text: "foo",
+			Err:  ErrTimeout.Error(),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "reqreptest")
+			defer os.RemoveAll(dir)
+			if tc.Responder {
+				s, err := sub.NewSubscriber(dir, TestRequestEvent{})
+				if err != nil {
+					t.Fatalf("bad: %s", err)
+				}
+				p, err := NewResponder(dir, TestReplyEvent{}, s, func(e store.Event) (interface{}, error) {
+					text := e.Data.(TestRequestEvent).Text
+					if text == "" {
+						return nil, errors.New("empty request")
+					}
+					return TestReplyEvent{Text: strings.ToUpper(text)}, nil
+				})
+				if err != nil {
+					t.Fatalf("bad: %s", err)
+				}
+				defer p.Close()
+			}
+			r, err := NewRequester(dir, TestRequestEvent{}, TestReplyEvent{}, "replies.test")
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			defer r.Close()
+
+			e, err := r.Request(TestRequestEvent{Text: tc.Text}, time.Millisecond*500)
+			switch {
+			case err != nil && tc.Err == "":
+				t.Fatalf("bad: %s", err)
+			case err == nil && tc.Err != "":
+				t.Fatal("expected error, got none")
+			case err != nil && tc.Err != "":
+				if !strings.Contains(err.Error(), tc.Err) {
+					t.Fatalf("expected error to match %q, got %q", tc.Err, err)
+				}
+				return
+			}
+			if !reflect.DeepEqual(tc.Expected, e.Data) {
+				t.Fatalf("expected %#v, got %#v", tc.Expected, e.Data)
+			}
+		})
+	}
+}
+
+func TestRequestConcurrent(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "reqreptest")
+	defer os.RemoveAll(dir)
+	s, err := sub.NewSubscriber(dir, TestRequestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	p, err := NewResponder(dir, TestReplyEvent{}, s, func(e store.Event) (interface{}, error) {
+		return TestReplyEvent{Text: e.Data.(TestRequestEvent).Text}, nil
+	}, sub.Workers(4))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer p.Close()
+	r, err := NewRequester(dir, TestRequestEvent{}, TestReplyEvent{}, "replies.test")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer r.Close()
+
+	texts := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	errs := make(chan error, len(texts))
+	for _, text := range texts {
+		go func(text string) {
+			e, err := r.Request(TestRequestEvent{Text: text}, time.Second*2)
+			if err == nil && e.Data != (TestReplyEvent{Text: text}) {
+				err = errors.New("reply to " + text + " did not match request")
+			}
+			errs <- err
+		}(text)
+	}
+	for range texts {
+		if err := <-errs; err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+}
+
+func TestRequestClosed(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "reqreptest")
+	defer os.RemoveAll(dir)
+	r, err := NewRequester(dir, TestRequestEvent{}, TestReplyEvent{}, "replies.test")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	errs := make(chan error)
+	go func() {
+		_, err := r.Request(TestRequestEvent{Text: "foo"}, time.Second*5)
+		errs <- err
+	}()
+	time.Sleep(time.Millisecond * 100)
+	r.Close()
+	if err := <-errs; err != ErrClosed {
+		t.Fatalf("expected %q, got %v", ErrClosed, err)
+	}
+	if _, err := r.Request(TestRequestEvent{Text: "foo"}, time.Second); err != ErrClosed {
+		t.Fatalf("expected %q, got %v", ErrClosed, err)
+	}
+}
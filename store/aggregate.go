@@ -0,0 +1,436 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// aggregatesDir is the name of the directory, relative to the stream
+// directory, that aggregate indexes are kept in.
+//
+// Each aggregate gets its own directory, holding a file for every version of
+// the aggregate, named for the version zero-padded so that the files sort in
+// version order. The file holds the ID of the event in the stream that created
+// the version. Versions are claimed by creating their file exclusively, so
+// only one writer can ever append a given version.
+const aggregatesDir = ".aggregates"
+
+// AnyVersion can be passed as the expected version when writing an aggregate
+// event to append the event whatever the current version of the aggregate is.
+const AnyVersion int64 = -1
+
+// ConcurrencyError is the error returned when an event is written to an
+// aggregate at an expected version, but the aggregate is at a different
+// version - usually because another writer appended to it first.
+type ConcurrencyError struct {
+	// The ID of the aggregate.
+	Aggregate string
+
+	// The version the writer expected the aggregate to be at.
+	Expected int64
+
+	// The version the aggregate was actually at.
+	Actual int64
+}
+
+// Error implements error for ConcurrencyError.
+func (e ConcurrencyError) Error() string {
+	return fmt.Sprintf("aggregate %s is at version %d, expected %d", e.Aggregate, e.Actual, e.Expected)
+}
+
+// AggregateEvent is an event read from an aggregate, along with the version of
+// the aggregate it created.
+type AggregateEvent struct {
+	Event
+
+	// The version of the aggregate the event created.
+	Version int64
+}
+
+// aggregateDir returns the index directory for the aggregate agg.
+func (s *Stream) aggregateDir(agg string) (string, error) {
+	if err := ValidName("aggregate", agg); err != nil {
+		return "", err
+	}
+	return s.Dir() + "/" + aggregatesDir + "/" + agg, nil
+}
+
+// versionName returns the file name for version v of an aggregate.
+func versionName(v int64) string {
+	return fmt.Sprintf("%020d", v)
+}
+
+// aggregateVersions returns the versions in the index directory dir, in
+// order.
+func aggregateVersions(dir string) ([]int64, error) {
+	fs, err := ioutil.ReadDir(dir)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("error reading aggregate directory %s: %s", dir, err)
+	}
+	var vs []int64
+	for _, f := range fs {
+		if !f.Mode().IsRegular() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		v, err := strconv.ParseInt(f.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+// AggregateVersion returns the current version of the aggregate agg - the
+// number of events that have been written to it. Aggregates that have not been
+// written to are at version zero.
+func (s *Stream) AggregateVersion(agg string) (int64, error) {
+	dir, err := s.aggregateDir(agg)
+	if err != nil {
+		return 0, err
+	}
+	vs, err := aggregateVersions(dir)
+	if err != nil || len(vs) == 0 {
+		return 0, err
+	}
+	return vs[len(vs)-1], nil
+}
+
+// WriteAggregateEvent writes an event to the stream with the ID id, appending
+// it to the aggregate agg. The aggregate must be at the version expected, or a
+// ConcurrencyError is returned and nothing is written - pass zero for an
+// aggregate that should not exist yet, or AnyVersion to skip the check. The
+// new version of the aggregate is returned.
+//
+// The event is also written to the stream like any other event, with the
+// aggregate and version recorded in its metadata. The event is committed once
+// its version is claimed - if moving it into the stream fails after that, or
+// the writer crashes, the move is finished by the next write to or read of
+// the aggregate, or by RecoverAggregates, whichever comes first. The event is
+// published at the time the move is finished.
+func (s *Stream) WriteAggregateEvent(agg string, expected int64, id string, event interface{}, headers map[string]string) (int64, error) {
+	dir, err := s.aggregateDir(agg)
+	if err != nil {
+		return 0, err
+	}
+	if expected < AnyVersion {
+		return 0, fmt.Errorf("invalid expected version %d", expected)
+	}
+	if err := ValidName("event", id); err != nil {
+		return 0, err
+	}
+	data, err := s.marshalEvent(event)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := os.Stat(s.Dir() + "/" + id); err == nil {
+		return 0, IDCollisionError{s: fmt.Sprintf("id collision: %s", id)}
+	}
+	// Finish committing any events left behind by writers that failed, so
+	// that they are not held back behind this one.
+	if err := s.recoverAggregate(dir); err != nil {
+		return 0, err
+	}
+	current, err := s.AggregateVersion(agg)
+	if err != nil {
+		return 0, err
+	}
+	if expected != AnyVersion && current != expected {
+		return 0, ConcurrencyError{Aggregate: agg, Expected: expected, Actual: current}
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return 0, fmt.Errorf("cannot create directory %s: %s", dir, err)
+	}
+	if err := stageAggregateEvent(dir, id, data, Metadata{Headers: headers, Aggregate: agg}); err != nil {
+		return 0, err
+	}
+	// The staged event is synced before its version is claimed, as anyone
+	// reading the aggregate can move it into the stream from then on.
+	if err := s.syncData(stagedMetadataPath(dir, id), stagedPath(dir, id)); err != nil {
+		unstageAggregateEvent(dir, id)
+		return 0, fmt.Errorf("error staging event at %s: %s", stagedPath(dir, id), err)
+	}
+	var v int64
+	for {
+		v = current + 1
+		ok, err := s.claimVersion(dir+"/"+versionName(v), id)
+		if err != nil {
+			unstageAggregateEvent(dir, id)
+			return 0, err
+		}
+		if ok {
+			break
+		}
+		// Another writer claimed the version first.
+		if expected != AnyVersion {
+			unstageAggregateEvent(dir, id)
+			return 0, ConcurrencyError{Aggregate: agg, Expected: expected, Actual: v}
+		}
+		if current, err = s.AggregateVersion(agg); err != nil {
+			unstageAggregateEvent(dir, id)
+			return 0, err
+		}
+	}
+
+	if err := s.commitAggregateEvent(dir, v, id); err != nil {
+		return 0, err
+	}
+	if err := s.syncDirs(dir + "/" + versionName(v)); err != nil {
+		return 0, err
+	}
+	return v, nil
+}
+
+// stagingDir is the name of the directory, relative to the index directory of
+// an aggregate, that events are staged in before their version is claimed.
+// Their metadata is staged in the metaDir directory within it.
+const stagingDir = ".staged"
+
+// stagedPath returns the path the event with the ID id is staged at in the
+// aggregate directory dir.
+func stagedPath(dir, id string) string {
+	return dir + "/" + stagingDir + "/" + id
+}
+
+// stagedMetadataPath returns the path the metadata for the event with the ID
+// id is staged at in the aggregate directory dir.
+func stagedMetadataPath(dir, id string) string {
+	return dir + "/" + stagingDir + "/" + metaDir + "/" + id
+}
+
+// stageAggregateEvent stages the event data for the event with the ID id in
+// the aggregate directory dir, along with its metadata, leaving the version
+// and publish time to be filled in when it is committed.
+func stageAggregateEvent(dir, id string, data []byte, m Metadata) error {
+	path := stagedPath(dir, id)
+	meta := stagedMetadataPath(dir, id)
+	if err := os.MkdirAll(filepath.Dir(meta), 0777); err != nil {
+		return fmt.Errorf("cannot create directory %s: %s", filepath.Dir(meta), err)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("could not marshal metadata for event %s: %s", id, err)
+	}
+	if err := writeFileAtomic(filepath.Dir(meta), meta, b); err != nil {
+		return fmt.Errorf("error staging event at %s: %s", path, err)
+	}
+	if err := writeFileAtomic(filepath.Dir(path), path, data); err != nil {
+		os.Remove(meta)
+		return fmt.Errorf("error staging event at %s: %s", path, err)
+	}
+	return nil
+}
+
+// unstageAggregateEvent removes the staged event with the ID id from the
+// aggregate directory dir, if its version was not claimed.
+func unstageAggregateEvent(dir, id string) {
+	os.Remove(stagedPath(dir, id))
+	os.Remove(stagedMetadataPath(dir, id))
+}
+
+// commitAggregateEvent moves the staged event with the ID id, which created
+// version v of the aggregate in the directory dir, into the stream. It does
+// nothing if the event is already in the stream.
+//
+// Both the writer and readers of the aggregate can commit the event at the
+// same time. The metadata is created by one of them, before the event is
+// moved, and the others leave it alone unless its publish time is too old for
+// the event to be made visible with it - see stamp.
+func (s *Stream) commitAggregateEvent(dir string, v int64, id string) error {
+	path := s.Dir() + "/" + id
+	staged := stagedPath(dir, id)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	m, err := readMetadata(stagedMetadataPath(dir, id))
+	if err != nil {
+		return err
+	}
+	m.Version = v
+	if err := s.stamp(func(t time.Time) ([]string, error) {
+		m.Time = t
+		ok, err := s.createMetadata(id, m)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// The metadata was written by another committer, or an earlier
+			// attempt. It is only stamped again if it was stamped too long
+			// ago - by a committer that crashed, for example.
+			existing, err := s.ReadMetadata(id)
+			if err != nil {
+				return nil, err
+			}
+			if time.Since(existing.Time) > maxStampAge {
+				if err := s.writeMetadata(id, m); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return []string{s.metadataPath(id)}, nil
+	}); err != nil {
+		return fmt.Errorf("error writing event to file %s: %s", path, err)
+	}
+	if err := os.Rename(staged, path); err != nil {
+		// Someone else moved the event first.
+		if _, serr := os.Stat(path); serr == nil {
+			return nil
+		}
+		return fmt.Errorf("error writing event to file %s: %s", path, err)
+	}
+	os.Remove(stagedMetadataPath(dir, id))
+	if err := s.syncDirs(s.metadataPath(id), path); err != nil {
+		return fmt.Errorf("error writing event to file %s: %s", path, err)
+	}
+	return nil
+}
+
+// claimVersion creates the version file at path, holding the event ID id.
+// false is returned if the version has already been claimed. The file is
+// written in full, and synced as the durability level of the stream
+// requires, before it is put in place, so a claimed version always holds its
+// event ID.
+func (s *Stream) claimVersion(path, id string) (bool, error) {
+	name, err := writeTempFile(filepath.Dir(path), path, []byte(id))
+	if err != nil {
+		return false, fmt.Errorf("error claiming aggregate version at %s: %s", path, err)
+	}
+	if err := s.syncData(name); err != nil {
+		os.Remove(name)
+		return false, fmt.Errorf("error claiming aggregate version at %s: %s", path, err)
+	}
+	ok, err := linkTempFile(name, path)
+	if err != nil {
+		return false, fmt.Errorf("error claiming aggregate version at %s: %s", path, err)
+	}
+	return ok, nil
+}
+
+// RecoverAggregates commits any aggregate events whose versions were claimed,
+// but which were left staged - for example, because the writer crashed before
+// moving them into the stream. Events staged without a version claimed are
+// left alone, as they may still be being written.
+func (s *Stream) RecoverAggregates() error {
+	dir := s.Dir() + "/" + aggregatesDir
+	fs, err := ioutil.ReadDir(dir)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("error reading aggregates directory %s: %s", dir, err)
+	}
+	for _, f := range fs {
+		if !f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		if err := s.recoverAggregate(dir + "/" + f.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverAggregate commits the events staged in the aggregate directory dir
+// whose versions have been claimed, in version order.
+func (s *Stream) recoverAggregate(dir string) error {
+	fs, err := ioutil.ReadDir(dir + "/" + stagingDir)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("error reading staging directory %s: %s", dir+"/"+stagingDir, err)
+	}
+	staged := make(map[string]bool)
+	for _, f := range fs {
+		if f.Mode().IsRegular() && !strings.HasPrefix(f.Name(), ".") {
+			staged[f.Name()] = true
+		}
+	}
+	if len(staged) == 0 {
+		return nil
+	}
+	vs, err := aggregateVersions(dir)
+	if err != nil {
+		return err
+	}
+	for _, v := range vs {
+		path := dir + "/" + versionName(v)
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading aggregate version at %s: %s", path, err)
+		}
+		if id := string(b); staged[id] {
+			if err := s.commitAggregateEvent(dir, v, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadAggregate returns the events of the aggregate agg that created versions
+// after the supplied version, in version order. Pass zero to read the whole
+// aggregate.
+//
+// Versions that have been claimed, but whose event is still staged, are
+// committed to the stream first, so no version is ever left out. Versions
+// whose event is missing from the stream altogether are skipped.
+func (s *Stream) ReadAggregate(agg string, after int64) ([]AggregateEvent, error) {
+	dir, err := s.aggregateDir(agg)
+	if err != nil {
+		return nil, err
+	}
+	vs, err := aggregateVersions(dir)
+	if err != nil {
+		return nil, err
+	}
+	var es []AggregateEvent
+	for _, v := range vs {
+		if v <= after {
+			continue
+		}
+		path := dir + "/" + versionName(v)
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading aggregate version at %s: %s", path, err)
+		}
+		id := string(b)
+		if err := ValidName("event", id); err != nil {
+			return nil, fmt.Errorf("error reading aggregate version at %s: %s", path, err)
+		}
+		if _, err := os.Stat(stagedPath(dir, id)); err == nil {
+			if err := s.commitAggregateEvent(dir, v, id); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := os.Stat(s.Dir() + "/" + id); err != nil && os.IsNotExist(err) {
+			continue
+		}
+		e, err := DecodeEvent(s.Dir()+"/"+id, s.EventType())
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, AggregateEvent{Event: e, Version: v})
+	}
+	return es, nil
+}
+
+// DumpAggregate returns the events of the aggregate agg, in the stream
+// described by dir and event, in version order.
+func DumpAggregate(dir string, event interface{}, agg string) ([]AggregateEvent, error) {
+	stream, err := NewStream(dir, event)
+	if err != nil {
+		return nil, err
+	}
+	return stream.ReadAggregate(agg, 0)
+}
@@ -0,0 +1,324 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteAggregateEvent(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Aggregate string
+		Expected  int64
+		Version   int64
+		Err       string
+	}{
+		{
+			Name:      "basic success case",
+			Aggregate: "order-1",
+			Expected:  2,
+			Version:   3,
+		},
+		{
+			Name:      "any version",
+			Aggregate: "order-1",
+			Expected:  AnyVersion,
+			Version:   3,
+		},
+		{
+			Name:      "new aggregate",
+			Aggregate: "order-2",
+			Expected:  0,
+			Version:   1,
+		},
+		{
+			Name:      "stale version",
+			Aggregate: "order-1",
+			Expected:  1,
+			Err:       "aggregate order-1 is at version 2, expected 1",
+		},
+		{
+			Name:      "existing aggregate expected new",
+			Aggregate: "order-1",
+			Expected:  0,
+			Err:       "aggregate order-1 is at version 2, expected 0",
+		},
+		{
+			Name:      "bad aggregate ID",
+			Aggregate: "orders/1",
+			Err:       "cannot contain a path separator",
+		},
+		{
+			Name:      "bad expected version",
+			Aggregate: "order-1",
+			Expected:  -2,
+			Err:       "invalid expected version -2",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "storetest")
+			defer os.RemoveAll(dir)
+			s, err := NewStream(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			for i, id := range []string{"a", "b"} {
+				v, err := s.WriteAggregateEvent("order-1", int64(i), id, TestEvent{Text: id}, nil)
+				if err != nil {
+					t.Fatalf("bad: %s", err)
+				}
+				if v != int64(i+1) {
+					t.Fatalf("expected version %d, got %d", i+1, v)
+				}
+			}
+
+			v, err := s.WriteAggregateEvent(tc.Aggregate, tc.Expected, "c", TestEvent{Text: "c"}, nil)
+			switch {
+			case err != nil && tc.Err == "":
+				t.Fatalf("bad: %s", err)
+			case err == nil && tc.Err != "":
+				t.Fatal("expected error, got none")
+			case err != nil && tc.Err != "":
+				if !strings.Contains(err.Error(), tc.Err) {
+					t.Fatalf("expected error to match %q, got %q", tc.Err, err)
+				}
+				if _, ok := err.(ConcurrencyError); ok {
+					if _, err := os.Stat(s.Dir() + "/c"); err == nil {
+						t.Fatal("expected event not to be written")
+					}
+				}
+				return
+			}
+			if v != tc.Version {
+				t.Fatalf("expected version %d, got %d", tc.Version, v)
+			}
+			m, err := s.ReadMetadata("c")
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if m.Aggregate != tc.Aggregate || m.Version != tc.Version {
+				t.Fatalf("expected aggregate %s at %d in metadata, got %#v", tc.Aggregate, tc.Version, m)
+			}
+			if current, err := s.AggregateVersion(tc.Aggregate); err != nil || current != tc.Version {
+				t.Fatalf("expected current version %d, got %d, %v", tc.Version, current, err)
+			}
+		})
+	}
+}
+
+func TestWriteAggregateEventConcurrent(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// Only one of the writers expecting a new aggregate wins.
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			_, err := s.WriteAggregateEvent("order-1", 0, id, TestEvent{Text: id}, nil)
+			errs <- err
+		}(string(rune('a' + i)))
+	}
+	wg.Wait()
+	close(errs)
+	var won int
+	for err := range errs {
+		switch err.(type) {
+		case nil:
+			won++
+		case ConcurrencyError:
+		default:
+			t.Fatalf("bad: %s", err)
+		}
+	}
+	if won != 1 {
+		t.Fatalf("expected exactly one writer to win, got %d", won)
+	}
+}
+
+func TestDumpAggregate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	for _, id := range []string{"z", "y", "x"} {
+		if _, err := s.WriteAggregateEvent("order-1", AnyVersion, id, TestEvent{Text: id}, nil); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+	if _, err := s.WriteAggregateEvent("order-2", AnyVersion, "w", TestEvent{Text: "w"}, nil); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// A version whose event is missing from the stream is skipped.
+	if ok, err := s.claimVersion(s.Dir()+"/"+aggregatesDir+"/order-1/"+versionName(4), "missing"); !ok || err != nil {
+		t.Fatalf("bad: %t, %v", ok, err)
+	}
+
+	es, err := DumpAggregate(dir, TestEvent{}, "order-1")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	var actual []string
+	for i, e := range es {
+		if e.Version != int64(i+1) {
+			t.Fatalf("expected version %d, got %d", i+1, e.Version)
+		}
+		actual = append(actual, e.ID)
+	}
+	if expected := []string{"z", "y", "x"}; !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+
+	es, err = s.ReadAggregate("order-1", 2)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if len(es) != 1 || es[0].ID != "x" || es[0].Version != 3 {
+		t.Fatalf("expected only version 3, got %#v", es)
+	}
+	if es, err := DumpAggregate(dir, TestEvent{}, "order-3"); err != nil || len(es) != 0 {
+		t.Fatalf("expected empty aggregate, got %#v, %v", es, err)
+	}
+}
+
+func TestReadAggregateStaged(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if _, err := s.WriteAggregateEvent("order-1", 0, "a", TestEvent{Text: "a"}, nil); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// A writer that stops after claiming its version leaves its event staged.
+	agg, err := s.aggregateDir("order-1")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	m := Metadata{Headers: map[string]string{"foo": "bar"}, Aggregate: "order-1"}
+	if err := stageAggregateEvent(agg, "b", []byte(`{"Text":"b"}`), m); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if ok, err := s.claimVersion(agg+"/"+versionName(2), "b"); !ok || err != nil {
+		t.Fatalf("bad: %t, %v", ok, err)
+	}
+	if _, err := s.WriteAggregateEvent("order-1", 2, "c", TestEvent{Text: "c"}, nil); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	es, err := s.ReadAggregate("order-1", 0)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	var actual []string
+	for _, e := range es {
+		actual = append(actual, e.ID)
+	}
+	if expected := []string{"a", "b", "c"}; !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+	if es[1].Headers["foo"] != "bar" {
+		t.Fatalf("expected staged headers, got %#v", es[1].Headers)
+	}
+	m, err = s.ReadMetadata("b")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if m.Version != 2 || m.Time.IsZero() {
+		t.Fatalf("expected version 2 with a publish time, got %#v", m)
+	}
+	if _, err := os.Stat(stagedPath(agg, "b")); !os.IsNotExist(err) {
+		t.Fatalf("expected staged event to be removed, got %v", err)
+	}
+}
+
+func TestRecoverAggregates(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if _, err := s.WriteAggregateEvent("order-1", 0, "a", TestEvent{Text: "a"}, nil); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	agg, err := s.aggregateDir("order-1")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// One writer crashed after claiming its version, and another is still
+	// writing its event, and has not claimed a version yet.
+	for _, id := range []string{"b", "c"} {
+		m := Metadata{Aggregate: "order-1"}
+		if err := stageAggregateEvent(agg, id, []byte(`{"Text":"`+id+`"}`), m); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+	if ok, err := s.claimVersion(agg+"/"+versionName(2), "b"); !ok || err != nil {
+		t.Fatalf("bad: %t, %v", ok, err)
+	}
+	if ids, _, err := s.EventIDsAfter(Checkpoint{}); err != nil || !reflect.DeepEqual([]string{"a"}, ids) {
+		t.Fatalf("expected staged events to be hidden, got %q, %v", ids, err)
+	}
+
+	if err := s.RecoverAggregates(); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	ids, _, err := s.EventIDsAfter(Checkpoint{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if expected := []string{"a", "b"}; !reflect.DeepEqual(expected, ids) {
+		t.Fatalf("expected %q, got %q", expected, ids)
+	}
+	if m, err := s.ReadMetadata("b"); err != nil || m.Version != 2 {
+		t.Fatalf("expected b at version 2, got %#v, %v", m, err)
+	}
+	if _, err := os.Stat(stagedPath(agg, "c")); err != nil {
+		t.Fatalf("expected unclaimed event to be left staged: %s", err)
+	}
+}
+
+func TestWriteAggregateEventRecovers(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	agg, err := s.aggregateDir("order-1")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := stageAggregateEvent(agg, "a", []byte(`{"Text":"a"}`), Metadata{Aggregate: "order-1"}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if ok, err := s.claimVersion(agg+"/"+versionName(1), "a"); !ok || err != nil {
+		t.Fatalf("bad: %t, %v", ok, err)
+	}
+	// The next write to the aggregate commits the event left behind first.
+	if _, err := s.WriteAggregateEvent("order-1", 1, "b", TestEvent{Text: "b"}, nil); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	ids, _, err := s.EventIDsAfter(Checkpoint{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if expected := []string{"a", "b"}; !reflect.DeepEqual(expected, ids) {
+		t.Fatalf("expected %q, got %q", expected, ids)
+	}
+}
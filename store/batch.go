@@ -0,0 +1,278 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// batchesDir is the name of the directory, relative to the stream directory,
+// that batch manifests are kept in.
+//
+// A batch is written in three steps. The events are first staged in a
+// directory for the batch under the temporary directory, where nothing reading
+// the stream sees them. The manifest for the batch, listing its events in
+// order, is then written to the batches directory - this is the point the
+// batch is committed. Finally, the staged events are moved into the stream.
+// Events that belong to a batch whose staged events have not all been moved
+// are not visible, so readers never see part of a batch.
+const batchesDir = ".batches"
+
+// batchManifest is the manifest for a committed batch.
+type batchManifest struct {
+	// The IDs of the events in the batch, in order.
+	IDs []string
+}
+
+// stagingDir returns the directory the events for batch are staged in.
+func (s *Stream) stagingDir(batch string) string {
+	return s.Dir() + "/" + tmpDir + "/" + batch
+}
+
+// WriteBatch writes the events in events as a single batch with the ID batch,
+// with the IDs in ids and any headers in headers, which can be nil. Either all
+// of the events become visible in the stream, or none of them do. The events
+// are ordered one after the other, in the order supplied.
+//
+// If the batch is committed but not all of its events could be moved into the
+// stream, the batch is completed by the next call to RecoverBatches.
+func (s *Stream) WriteBatch(batch string, ids []string, events []interface{}, headers []map[string]string) error {
+	if err := ValidName("batch", batch); err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return errors.New("batch has no events")
+	}
+	if len(ids) != len(events) {
+		return fmt.Errorf("batch has %d IDs for %d events", len(ids), len(events))
+	}
+	if headers != nil && len(headers) != len(events) {
+		return fmt.Errorf("batch has %d sets of headers for %d events", len(headers), len(events))
+	}
+	data := make([][]byte, len(events))
+	for i, event := range events {
+		var err error
+		if data[i], err = s.marshalEvent(event); err != nil {
+			return err
+		}
+	}
+	for _, id := range ids {
+		if _, err := os.Stat(s.Dir() + "/" + id); err == nil {
+			return IDCollisionError{s: fmt.Sprintf("id collision: %s", id)}
+		}
+	}
+
+	if err := s.stageBatch(batch, ids, data, headers); err != nil {
+		os.RemoveAll(s.stagingDir(batch))
+		for _, id := range ids {
+			os.Remove(s.metadataPath(id))
+		}
+		return fmt.Errorf("error writing batch %s: %s", batch, err)
+	}
+	if err := s.commitBatch(batch, ids); err != nil {
+		return fmt.Errorf("batch %s was committed, but could not be completed: %s", batch, err)
+	}
+	return nil
+}
+
+// stageBatch writes the metadata and staged data for the events in a batch,
+// then commits the batch by writing its manifest.
+func (s *Stream) stageBatch(batch string, ids []string, data [][]byte, headers []map[string]string) error {
+	staging := s.stagingDir(batch)
+	if err := os.MkdirAll(staging, 0777); err != nil {
+		return fmt.Errorf("cannot create directory %s: %s", staging, err)
+	}
+	// Each event is given its own publish time, a nanosecond after the last,
+	// so that the events in the batch are ordered one after the other.
+	now := time.Now()
+	var paths []string
+	for i, id := range ids {
+		m := Metadata{Time: now.Add(time.Duration(i)), Batch: batch}
+		if headers != nil {
+			m.Headers = headers[i]
+		}
+		if err := s.writeMetadata(id, m); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(staging, staging+"/"+id, data[i]); err != nil {
+			return err
+		}
+		paths = append(paths, s.metadataPath(id), staging+"/"+id)
+	}
+
+	// The staged events and the manifest are synced before the manifest is
+	// put in place, as the batch is completed from them from then on.
+	dir := s.Dir() + "/" + batchesDir
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("cannot create directory %s: %s", dir, err)
+	}
+	b, err := json.Marshal(batchManifest{IDs: ids})
+	if err != nil {
+		return fmt.Errorf("could not marshal manifest for batch %s: %s", batch, err)
+	}
+	name, err := writeTempFile(dir, dir+"/"+batch, b)
+	if err != nil {
+		return err
+	}
+	if err := s.syncData(append(paths, name)...); err != nil {
+		os.Remove(name)
+		return err
+	}
+	if err := renameTempFile(name, dir+"/"+batch); err != nil {
+		return err
+	}
+	return s.syncDirs(append(paths, dir+"/"+batch)...)
+}
+
+// commitBatch moves the staged events for a committed batch into the stream,
+// in order. Events that have already been moved are skipped, so this can be
+// run again to complete a batch that was interrupted.
+func (s *Stream) commitBatch(batch string, ids []string) error {
+	// The events are given their publish times again, as staging the batch
+	// can take longer than VisibilityWindow. None of them are visible until
+	// they have all been moved, so this is safe to do.
+	ms := make([]Metadata, len(ids))
+	var paths []string
+	for i, id := range ids {
+		var err error
+		if ms[i], err = s.ReadMetadata(id); err != nil {
+			return err
+		}
+		paths = append(paths, s.metadataPath(id), s.Dir()+"/"+id)
+	}
+	if err := s.stamp(func(t time.Time) ([]string, error) {
+		var metas []string
+		for i, id := range ids {
+			ms[i].Time = t.Add(time.Duration(i))
+			if err := s.writeMetadata(id, ms[i]); err != nil {
+				return nil, err
+			}
+			metas = append(metas, s.metadataPath(id))
+		}
+		return metas, nil
+	}); err != nil {
+		return err
+	}
+	staging := s.stagingDir(batch)
+	for _, id := range ids {
+		err := os.Rename(staging+"/"+id, s.Dir()+"/"+id)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error moving event %s into stream: %s", id, err)
+		}
+	}
+	if err := s.syncDirs(paths...); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(staging); err != nil {
+		return fmt.Errorf("error removing staging directory %s: %s", staging, err)
+	}
+	return nil
+}
+
+// readBatchManifest reads the manifest for batch. nil is returned if the
+// batch has not been committed.
+func (s *Stream) readBatchManifest(batch string) (*batchManifest, error) {
+	path := s.Dir() + "/" + batchesDir + "/" + batch
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("error reading batch manifest at %s: %s", path, err)
+	}
+	var m batchManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("error unmarshaling batch manifest from %s: %s", path, err)
+	}
+	return &m, nil
+}
+
+// batchComplete returns the manifest for batch, and true if the batch has
+// been committed and all of its events moved into the stream.
+func (s *Stream) batchComplete(batch string) (*batchManifest, bool, error) {
+	m, err := s.readBatchManifest(batch)
+	if err != nil || m == nil {
+		return nil, false, err
+	}
+	staging := s.stagingDir(batch)
+	for _, id := range m.IDs {
+		if _, err := os.Stat(staging + "/" + id); err == nil {
+			return m, false, nil
+		}
+	}
+	return m, true, nil
+}
+
+// visible returns true if an event with the metadata m can be seen by readers
+// of the stream - that is, it is not part of an incomplete batch. The
+// completeness of batches is cached in batches, which can be shared between
+// calls while scanning the stream.
+func (s *Stream) visible(m Metadata, batches map[string]bool) (bool, error) {
+	if m.Batch == "" {
+		return true, nil
+	}
+	if ok, seen := batches[m.Batch]; seen {
+		return ok, nil
+	}
+	_, ok, err := s.batchComplete(m.Batch)
+	if err != nil {
+		return false, err
+	}
+	batches[m.Batch] = ok
+	return ok, nil
+}
+
+// BatchIDs returns the IDs of the events that become visible along with the
+// event with the supplied ID, in order. For an event that was published on
+// its own, this is just the event itself. For an event published in a batch,
+// this is every event in the batch, or nothing if the batch is not complete
+// yet.
+func (s *Stream) BatchIDs(id string) ([]string, error) {
+	md, err := s.ReadMetadata(id)
+	if err != nil {
+		return nil, err
+	}
+	if md.Batch == "" {
+		return []string{id}, nil
+	}
+	m, ok, err := s.batchComplete(md.Batch)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return m.IDs, nil
+}
+
+// RecoverBatches completes any batches that were committed, but whose events
+// were not all moved into the stream - for example, because the publisher
+// crashed part way through. Batches that were never committed are left
+// staged, as they may still be being written.
+func (s *Stream) RecoverBatches() error {
+	dir := s.Dir() + "/" + batchesDir
+	fs, err := ioutil.ReadDir(dir)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("error reading batch directory %s: %s", dir, err)
+	}
+	for _, f := range fs {
+		if !f.Mode().IsRegular() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		m, ok, err := s.batchComplete(f.Name())
+		if err != nil {
+			return err
+		}
+		if ok || m == nil {
+			continue
+		}
+		if err := s.commitBatch(f.Name(), m.IDs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Batch  string
+		IDs    []string
+		Events []interface{}
+		Err    string
+	}{
+		{
+			Name:   "basic success case",
+			Batch:  "batch",
+			IDs:    []string{"c", "a", "b"},
+			Events: []interface{}{TestEvent{Text: "c"}, TestEvent{Text: "a"}, TestEvent{Text: "b"}},
+		},
+		{
+			Name:  "empty batch",
+			Batch: "batch",
+			Err:   "batch has no events",
+		},
+		{
+			Name:   "mismatched IDs",
+			Batch:  "batch",
+			IDs:    []string{"a"},
+			Events: []interface{}{TestEvent{Text: "a"}, TestEvent{Text: "b"}},
+			Err:    "batch has 1 IDs for 2 events",
+		},
+		{
+			Name:   "mismatched event type",
+			Batch:  "batch",
+			IDs:    []string{"a", "b"},
+			Events: []interface{}{TestEvent{Text: "a"}, BadEvent{Text: "b"}},
+			Err:    "does not match stream type",
+		},
+		{
+			Name:   "bad batch ID",
+			Batch:  ".batch",
+			IDs:    []string{"a"},
+			Events: []interface{}{TestEvent{Text: "a"}},
+			Err:    "cannot start with a dot",
+		},
+		{
+			Name:   "id collision",
+			Batch:  "batch",
+			IDs:    []string{"a", "existing"},
+			Events: []interface{}{TestEvent{Text: "a"}, TestEvent{Text: "b"}},
+			Err:    "id collision",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "storetest")
+			defer os.RemoveAll(dir)
+			s, err := NewStream(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if err := s.WriteEvent("existing", TestEvent{Text: "existing"}); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			err = s.WriteBatch(tc.Batch, tc.IDs, tc.Events, nil)
+			switch {
+			case err != nil && tc.Err == "":
+				t.Fatalf("bad: %s", err)
+			case err == nil && tc.Err != "":
+				t.Fatal("expected error, got none")
+			case err != nil && tc.Err != "":
+				if !strings.Contains(err.Error(), tc.Err) {
+					t.Fatalf("expected error to match %q, got %q", tc.Err, err)
+				}
+				// Nothing from a failed batch is visible.
+				if es, err := Dump(dir, TestEvent{}); err != nil || len(es) != 1 {
+					t.Fatalf("expected only the existing event, got %#v, %v", es, err)
+				}
+				return
+			}
+
+			ids, _, err := s.EventIDsAfter(Checkpoint{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if expected := append([]string{"existing"}, tc.IDs...); !reflect.DeepEqual(expected, ids) {
+				t.Fatalf("expected %q, got %q", expected, ids)
+			}
+			for _, id := range tc.IDs {
+				actual, err := s.BatchIDs(id)
+				if err != nil {
+					t.Fatalf("bad: %s", err)
+				}
+				if !reflect.DeepEqual(tc.IDs, actual) {
+					t.Fatalf("expected %q, got %q", tc.IDs, actual)
+				}
+			}
+			if actual, err := s.BatchIDs("existing"); err != nil || !reflect.DeepEqual([]string{"existing"}, actual) {
+				t.Fatalf("expected existing event on its own, got %q, %v", actual, err)
+			}
+		})
+	}
+}
+
+func TestRecoverBatches(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	var data [][]byte
+	for _, text := range []string{"a", "b", "c"} {
+		b, _ := json.Marshal(TestEvent{Text: text})
+		data = append(data, b)
+	}
+	// One batch is committed, but only its first event made it into the
+	// stream. The other is staged, but never committed.
+	if err := s.stageBatch("committed", []string{"a", "b"}, data[:2], nil); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := os.Rename(s.stagingDir("committed")+"/a", s.Dir()+"/a"); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	staged := s.Dir() + "/" + batchesDir + "/staged"
+	if err := s.stageBatch("staged", []string{"c"}, data[2:], nil); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := os.Remove(staged); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	es, err := Dump(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if len(es) != 0 {
+		t.Fatalf("expected partial batch to be hidden, got %#v", es)
+	}
+	if ids, err := s.BatchIDs("a"); err != nil || ids != nil {
+		t.Fatalf("expected no IDs for partial batch, got %q, %v", ids, err)
+	}
+
+	if err := s.RecoverBatches(); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	ids, _, err := s.EventIDsAfter(Checkpoint{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if expected := []string{"a", "b"}; !reflect.DeepEqual(expected, ids) {
+		t.Fatalf("expected %q, got %q", expected, ids)
+	}
+	if _, err := os.Stat(s.stagingDir("staged") + "/c"); err != nil {
+		t.Fatalf("expected uncommitted batch to be left staged: %s", err)
+	}
+}
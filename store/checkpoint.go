@@ -0,0 +1,315 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// consumersDir is the name of the directory, relative to the stream
+// directory, that durable consumer checkpoints are kept in. Directories are
+// skipped when reading events, so this does not interfere with the stream
+// itself.
+const consumersDir = ".consumers"
+
+// VisibilityWindow is the longest an event can take to become visible in the
+// stream after it has been given its publish time. Events are not necessarily
+// visible in the order of their publish times - one publisher can stamp an
+// event, and then be overtaken by another - so checkpoints track the
+// acknowledged events published within this window individually.
+const VisibilityWindow = time.Second
+
+// Checkpoint describes the position of the last event acknowledged by a
+// durable consumer.
+//
+// Events are ordered by the time they were published, with ties broken by ID.
+// Events without a recorded publish time are ordered by the modification time
+// of their files instead. As file times are coarse-grained on most
+// filesystems, the IDs of all acknowledged events sharing Time are recorded,
+// so that events written within the same tick are not skipped on replay.
+//
+// Checkpoints made with Advance also record the acknowledged events published
+// within Window before Time, and only cover those events in that window.
+// Events that became visible after a later event was acknowledged are then
+// not skipped. Any event older than the window, or than Time for checkpoints
+// with no window, is considered acknowledged.
+type Checkpoint struct {
+	// The time of the last acknowledged event.
+	Time time.Time
+
+	// The IDs of the acknowledged events with a time of Time.
+	IDs []string
+
+	// The window before Time in which only the events in Recent are covered.
+	Window time.Duration `json:",omitempty"`
+
+	// The acknowledged events published within the window, keyed by ID.
+	Recent map[string]time.Time `json:",omitempty"`
+
+	// Events published before Floor are covered, even when they are within
+	// the window. This keeps the events covered by a checkpoint with a
+	// smaller window covered once it is advanced.
+	Floor time.Time `json:",omitempty"`
+}
+
+// floor returns the time before which every event is covered.
+func (c Checkpoint) floor() time.Time {
+	f := c.Time.Add(-c.Window)
+	if c.Floor.After(f) {
+		return c.Floor
+	}
+	return f
+}
+
+// Covers returns true if the event with the supplied ID and time is at or
+// before the checkpoint.
+func (c Checkpoint) Covers(id string, t time.Time) bool {
+	switch {
+	case t.After(c.Time):
+		return false
+	case t.Before(c.floor()):
+		return true
+	case t.Equal(c.Time):
+		for _, v := range c.IDs {
+			if v == id {
+				return true
+			}
+		}
+		return false
+	}
+	_, ok := c.Recent[id]
+	return ok
+}
+
+// Advance returns a checkpoint moved forward to include the event with the
+// supplied ID and time, with a window of VisibilityWindow. The checkpoint is
+// returned unchanged if it already covers the event.
+func (c Checkpoint) Advance(id string, t time.Time) Checkpoint {
+	if c.Covers(id, t) {
+		return c
+	}
+	n := Checkpoint{
+		Time:   c.Time,
+		IDs:    append([]string(nil), c.IDs...),
+		Window: VisibilityWindow,
+		Recent: make(map[string]time.Time),
+		Floor:  c.floor(),
+	}
+	for k, v := range c.Recent {
+		n.Recent[k] = v
+	}
+	switch {
+	case t.After(n.Time):
+		if !n.Time.IsZero() {
+			for _, v := range n.IDs {
+				n.Recent[v] = n.Time
+			}
+		}
+		n.Time, n.IDs = t, []string{id}
+	case t.Equal(n.Time):
+		n.IDs = append(n.IDs, id)
+	default:
+		n.Recent[id] = t
+	}
+
+	// Drop what has fallen out of the window.
+	if !n.Floor.After(n.Time.Add(-n.Window)) {
+		n.Floor = time.Time{}
+	}
+	f := n.floor()
+	for k, v := range n.Recent {
+		if v.Before(f) {
+			delete(n.Recent, k)
+		}
+	}
+	if len(n.Recent) == 0 {
+		n.Recent = nil
+	}
+	return n
+}
+
+// ValidName checks a name used for a file or directory, such as an event ID
+// or a durable consumer name. Names cannot be empty, start with a dot, or
+// contain a path separator. kind is used in the error message.
+func ValidName(kind, name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("%s name cannot be empty", kind)
+	case strings.HasPrefix(name, "."):
+		return fmt.Errorf("%s name %q cannot start with a dot", kind, name)
+	case strings.ContainsRune(name, os.PathSeparator):
+		return fmt.Errorf("%s name %q cannot contain a path separator", kind, name)
+	}
+	return nil
+}
+
+// ReadCheckpoint reads the checkpoint for the durable consumer name. A zero
+// Checkpoint is returned if the consumer has not acknowledged any events yet.
+func (s *Stream) ReadCheckpoint(name string) (Checkpoint, error) {
+	if err := ValidName("consumer", name); err != nil {
+		return Checkpoint{}, err
+	}
+	path := s.Dir() + "/" + consumersDir + "/" + name
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return Checkpoint{}, nil
+	case err != nil:
+		return Checkpoint{}, fmt.Errorf("error reading checkpoint at %s: %s", path, err)
+	}
+	var c Checkpoint
+	if err := json.Unmarshal(b, &c); err != nil {
+		return Checkpoint{}, fmt.Errorf("error unmarshaling checkpoint from %s: %s", path, err)
+	}
+	return c, nil
+}
+
+// WriteCheckpoint persists the checkpoint for the durable consumer name. The
+// checkpoint is written to a temporary file first and then renamed into
+// place, so a crash will never leave a partially written checkpoint behind.
+func (s *Stream) WriteCheckpoint(name string, c Checkpoint) error {
+	if err := ValidName("consumer", name); err != nil {
+		return err
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("could not marshal checkpoint: %s", err)
+	}
+	dir := s.Dir() + "/" + consumersDir
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("cannot create directory %s: %s", dir, err)
+	}
+	return writeFileAtomic(dir, dir+"/"+name, data)
+}
+
+// writeFileAtomic writes data to a temporary file in the directory tmp, and
+// then renames it to path. tmp must be on the same filesystem as path.
+func writeFileAtomic(tmp, path string, data []byte) error {
+	name, err := writeTempFile(tmp, path, data)
+	if err != nil {
+		return err
+	}
+	return renameTempFile(name, path)
+}
+
+// writeTempFile writes data to a new temporary file in the directory tmp, to
+// be renamed to path with renameTempFile, and returns its name.
+func writeTempFile(tmp, path string, data []byte) (string, error) {
+	f, err := ioutil.TempFile(tmp, ".tmp-")
+	if err != nil {
+		return "", fmt.Errorf("error creating temporary file for %s: %s", path, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("error writing to file %s: %s", f.Name(), err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("error closing file %s: %s", f.Name(), err)
+	}
+	return f.Name(), nil
+}
+
+// renameTempFile renames the temporary file name to path, removing it if the
+// rename fails.
+func renameTempFile(name, path string) error {
+	if err := os.Rename(name, path); err != nil {
+		os.Remove(name)
+		return fmt.Errorf("error renaming %s to %s: %s", name, path, err)
+	}
+	return nil
+}
+
+// linkTempFile links the temporary file name to path, unless path already
+// exists, and removes name. Unlike a rename, this never replaces an existing
+// file, so only one of any concurrent writers gets to create path. false is
+// returned if path already exists.
+func linkTempFile(name, path string) (bool, error) {
+	defer os.Remove(name)
+	if err := os.Link(name, path); err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error linking %s to %s: %s", name, path, err)
+	}
+	return true, nil
+}
+
+// EventTime returns the time used to order the event with the supplied ID
+// in the stream. This is the time the event was published, or the
+// modification time of the event file if the publish time was not recorded.
+func (s *Stream) EventTime(id string) (time.Time, error) {
+	path := s.Dir() + "/" + id
+	stat, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not stat event %s: %s", path, err)
+	}
+	return s.entryTime(stat)
+}
+
+// EventIDsAfter returns the IDs of the events in the stream that are not
+// covered by the checkpoint c, in stream order. A checkpoint that covers all
+// of the returned events is also returned, so that the caller can pick up
+// where it left off.
+func (s *Stream) EventIDsAfter(c Checkpoint) ([]string, Checkpoint, error) {
+	entries, err := ioutil.ReadDir(s.Dir())
+	if err != nil {
+		return nil, c, fmt.Errorf("error reading event directory %s: %s", s.Dir(), err)
+	}
+	es, err := s.entries(entries)
+	if err != nil {
+		return nil, c, err
+	}
+	var ids []string
+	next := c
+	for _, e := range es {
+		if c.Covers(e.id, e.time) {
+			continue
+		}
+		ids = append(ids, e.id)
+		next = next.Advance(e.id, e.time)
+	}
+	return ids, next, nil
+}
+
+// CheckpointAt returns a checkpoint that covers the event with the supplied ID
+// and every event before it in stream order.
+func (s *Stream) CheckpointAt(id string) (Checkpoint, error) {
+	t, err := s.EventTime(id)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	ids, _, err := s.EventIDsAfter(Checkpoint{Time: t})
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	// The events returned are at or after t, in order, so the ones sharing t
+	// with the event come first.
+	c := Checkpoint{Time: t}
+	for _, v := range ids {
+		c.IDs = append(c.IDs, v)
+		if v == id {
+			break
+		}
+	}
+	return c, nil
+}
+
+// EventsAfter works as per EventIDsAfter, but returns the decoded events.
+func (s *Stream) EventsAfter(c Checkpoint) ([]Event, Checkpoint, error) {
+	ids, next, err := s.EventIDsAfter(c)
+	if err != nil {
+		return nil, c, err
+	}
+	es := make([]Event, len(ids))
+	for i, id := range ids {
+		if es[i], err = DecodeEvent(s.Dir()+"/"+id, s.EventType()); err != nil {
+			return nil, c, err
+		}
+	}
+	return es, next, nil
+}
@@ -0,0 +1,299 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/google/uuid"
+)
+
+func TestCheckpointCovers(t *testing.T) {
+	now := time.Now()
+	c := Checkpoint{Time: now, IDs: []string{"a", "b"}}
+	cases := []struct {
+		Name     string
+		ID       string
+		Time     time.Time
+		Expected bool
+	}{
+		{
+			Name:     "before",
+			ID:       "z",
+			Time:     now.Add(-time.Second),
+			Expected: true,
+		},
+		{
+			Name:     "after",
+			ID:       "a",
+			Time:     now.Add(time.Second),
+			Expected: false,
+		},
+		{
+			Name:     "same time, acknowledged",
+			ID:       "b",
+			Time:     now,
+			Expected: true,
+		},
+		{
+			Name:     "same time, not acknowledged",
+			ID:       "c",
+			Time:     now,
+			Expected: false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			if actual := c.Covers(tc.ID, tc.Time); tc.Expected != actual {
+				t.Fatalf("expected %t, got %t", tc.Expected, actual)
+			}
+		})
+	}
+}
+
+func TestCheckpointAdvance(t *testing.T) {
+	now := time.Now()
+	c := Checkpoint{Time: now, IDs: []string{"a"}}
+	cases := []struct {
+		Name     string
+		ID       string
+		Time     time.Time
+		Expected Checkpoint
+	}{
+		{
+			Name:     "covered",
+			ID:       "z",
+			Time:     now.Add(-time.Second),
+			Expected: c,
+		},
+		{
+			Name: "later",
+			ID:   "b",
+			Time: now.Add(time.Second),
+			Expected: Checkpoint{
+				Time:   now.Add(time.Second),
+				IDs:    []string{"b"},
+				Window: VisibilityWindow,
+				Recent: map[string]time.Time{"a": now},
+			},
+		},
+		{
+			Name:     "same time",
+			ID:       "b",
+			Time:     now,
+			Expected: Checkpoint{Time: now, IDs: []string{"a", "b"}, Window: VisibilityWindow, Floor: now},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			actual := c.Advance(tc.ID, tc.Time)
+			if !reflect.DeepEqual(tc.Expected, actual) {
+				t.Fatalf("expected %#v, got %#v", tc.Expected, actual)
+			}
+		})
+	}
+	if !reflect.DeepEqual(Checkpoint{Time: now, IDs: []string{"a"}}, c) {
+		t.Fatalf("original checkpoint was modified: %#v", c)
+	}
+}
+
+func TestCheckpointWindow(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	for _, id := range []string{"old", "b"} {
+		if err := s.WriteEvent(id, TestEvent{Text: id}); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+	// Move old out of the window.
+	m, err := s.ReadMetadata("old")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	m.Time = m.Time.Add(-2 * VisibilityWindow)
+	if err := s.writeMetadata("old", m); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	_, c, err := s.EventIDsAfter(Checkpoint{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// An event published just before b, but only visible after b was
+	// acknowledged, is not covered.
+	tb, err := s.EventTime("b")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := s.WriteEvent("a", TestEvent{Text: "a"}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := s.writeMetadata("a", Metadata{Time: tb.Add(-time.Millisecond)}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	ids, c, err := s.EventIDsAfter(c)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if expected := []string{"a"}; !reflect.DeepEqual(expected, ids) {
+		t.Fatalf("expected %q, got %q", expected, ids)
+	}
+	for _, id := range []string{"old", "a", "b"} {
+		tt, err := s.EventTime(id)
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		if !c.Covers(id, tt) {
+			t.Fatalf("expected %s to be covered by %s", id, spew.Sdump(c))
+		}
+	}
+	if c.Covers("unknown", tb.Add(-time.Millisecond)) {
+		t.Fatal("expected unacknowledged event within the window not to be covered")
+	}
+	if !c.Covers("unknown", tb.Add(-2*VisibilityWindow)) {
+		t.Fatal("expected event before the window to be covered")
+	}
+}
+
+func TestReadWriteCheckpoint(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Consumer string
+		Prewrite func(string)
+		Write    bool
+		Err      string
+	}{
+		{
+			Name:     "basic success case",
+			Consumer: "foo",
+			Write:    true,
+		},
+		{
+			Name:     "no checkpoint",
+			Consumer: "foo",
+		},
+		{
+			Name:     "empty name",
+			Consumer: "",
+			Err:      "consumer name cannot be empty",
+		},
+		{
+			Name:     "dot name",
+			Consumer: ".foo",
+			Err:      "cannot start with a dot",
+		},
+		{
+			Name:     "path name",
+			Consumer: "foo/bar",
+			Err:      "cannot contain a path separator",
+		},
+		{
+			Name:     "bad checkpoint data",
+			Consumer: "foo",
+			Prewrite: func(d string) {
+				os.MkdirAll(d+"/TestEvent/.consumers", 0777)
+				ioutil.WriteFile(d+"/TestEvent/.consumers/foo", []byte("{\"Time\": 42}"), 0666)
+			},
+			Err: "error unmarshaling checkpoint from",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "storetest")
+			defer os.RemoveAll(dir)
+			s, err := NewStream(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if tc.Prewrite != nil {
+				tc.Prewrite(dir)
+			}
+			var expected Checkpoint
+			if tc.Write {
+				expected = Checkpoint{Time: time.Unix(1234, 5678).UTC(), IDs: []string{"a", "b"}}
+				if err := s.WriteCheckpoint(tc.Consumer, expected); err != nil {
+					t.Fatalf("bad: %s", err)
+				}
+			}
+			actual, err := s.ReadCheckpoint(tc.Consumer)
+			switch {
+			case err != nil && tc.Err == "":
+				t.Fatalf("bad: %s", err)
+			case err == nil && tc.Err != "":
+				t.Fatal("expected error, got none")
+			case err != nil && tc.Err != "":
+				if !strings.Contains(err.Error(), tc.Err) {
+					t.Fatalf("expected error to match %q, got %q", tc.Err, err)
+				}
+				return
+			}
+
+			if !reflect.DeepEqual(expected, actual) {
+				t.Fatalf("expected %#v, got %#v", expected, actual)
+			}
+		})
+	}
+}
+
+func TestEventsAfter(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	var ids []string
+	for i, text := range []string{"foo", "bar", "baz"} {
+		id := uuid.New().String()
+		if err := s.WriteEvent(id, TestEvent{Text: text}); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		// Space the events out so that the order is deterministic.
+		ts := time.Unix(int64(1000+i), 0)
+		if err := s.writeMetadata(id, Metadata{Time: ts}); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := os.Mkdir(s.Dir()+"/"+consumersDir, 0777); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	first, err := s.EventTime(ids[0])
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	actual, c, err := s.EventsAfter(Checkpoint{Time: first, IDs: []string{ids[0]}})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	expected := []Event{
+		{ID: ids[1], Data: TestEvent{Text: "bar"}},
+		{ID: ids[2], Data: TestEvent{Text: "baz"}},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected:\n\n%s\ngot:\n\n%s\n", spew.Sdump(expected), spew.Sdump(actual))
+	}
+	if !c.Covers(ids[2], time.Unix(1002, 0)) {
+		t.Fatalf("expected returned checkpoint to cover last event, got %#v", c)
+	}
+
+	actual, _, err = s.EventsAfter(c)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if len(actual) != 0 {
+		t.Fatalf("expected no events, got:\n\n%s\n", spew.Sdump(actual))
+	}
+}
@@ -0,0 +1,315 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// groupsDir is the name of the directory, relative to the stream directory,
+// that consumer group state is kept in.
+//
+// Each group gets its own directory, holding a claimed directory with a lock
+// file for every event currently claimed by a consumer, and a done directory
+// with a marker for every event that has been completed. A claim is moved to
+// the done directory on completion, so an event is only ever in one of the two
+// states.
+const groupsDir = ".groups"
+
+// claimedDir and doneDir are the names of the claim and completion
+// directories within a group directory.
+const (
+	claimedDir = "claimed"
+	doneDir    = "done"
+)
+
+// groupDir returns the directory for the consumer group, creating the claim
+// and completion directories if they do not exist.
+func (s *Stream) groupDir(group string) (string, error) {
+	if err := ValidName("group", group); err != nil {
+		return "", err
+	}
+	dir := s.Dir() + "/" + groupsDir + "/" + group
+	for _, d := range []string{dir + "/" + claimedDir, dir + "/" + doneDir} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			return "", fmt.Errorf("cannot create directory %s: %s", d, err)
+		}
+	}
+	return dir, nil
+}
+
+// Claim attempts to claim the event with the supplied ID for consumer within
+// the consumer group. The claim is made by exclusively creating a lock file,
+// so only one consumer across all processes can hold the claim at any one
+// time.
+//
+// true is returned if the claim was successful. false is returned if the
+// event is already claimed by another consumer or has been completed.
+func (s *Stream) Claim(group, consumer, id string) (bool, error) {
+	dir, err := s.groupDir(group)
+	if err != nil {
+		return false, err
+	}
+	path := dir + "/" + claimedDir + "/" + id
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	switch {
+	case err != nil && os.IsExist(err):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("error creating claim %s: %s", path, err)
+	}
+	_, err = f.WriteString(consumer)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return false, fmt.Errorf("error writing claim %s: %s", path, err)
+	}
+
+	// The event may have been completed in between us listing it and claiming
+	// it. Back off if that's the case.
+	if _, err := os.Stat(dir + "/" + doneDir + "/" + id); err == nil {
+		os.Remove(path)
+		return false, nil
+	}
+	return true, nil
+}
+
+// ClaimLostError is returned when a consumer completes or releases a claim it
+// no longer holds - usually because the claim was not refreshed in time, and
+// was taken over by another consumer.
+type ClaimLostError struct {
+	// The consumer group the claim is in.
+	Group string
+
+	// The consumer that tried to complete or release the claim.
+	Consumer string
+
+	// The ID of the claimed event.
+	ID string
+}
+
+// Error implements error for ClaimLostError.
+func (e ClaimLostError) Error() string {
+	return fmt.Sprintf("claim on event %s in group %s is no longer held by consumer %s", e.ID, e.Group, e.Consumer)
+}
+
+// claimOwner returns the consumer holding the claim at path.
+func claimOwner(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// RefreshClaim refreshes the claim held by consumer on the event with the
+// supplied ID, preventing it from being released as stale.
+//
+// false is returned if the claim is no longer held by the consumer.
+func (s *Stream) RefreshClaim(group, consumer, id string) (bool, error) {
+	dir, err := s.groupDir(group)
+	if err != nil {
+		return false, err
+	}
+	path := dir + "/" + claimedDir + "/" + id
+	owner, err := claimOwner(path)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("error reading claim %s: %s", path, err)
+	case owner != consumer:
+		return false, nil
+	}
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		return false, fmt.Errorf("error refreshing claim %s: %s", path, err)
+	}
+	return true, nil
+}
+
+// CompleteClaim marks the event with the supplied ID, claimed by consumer, as
+// completed for the consumer group. Completed events are never claimed again.
+//
+// A ClaimLostError is returned if the claim is held by another consumer, or
+// has been released, and the event has not been completed.
+func (s *Stream) CompleteClaim(group, consumer, id string) error {
+	dir, err := s.groupDir(group)
+	if err != nil {
+		return err
+	}
+	from := dir + "/" + claimedDir + "/" + id
+	to := dir + "/" + doneDir + "/" + id
+	owner, err := claimOwner(from)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		if _, serr := os.Stat(to); serr == nil {
+			// Completed already.
+			return nil
+		}
+		return ClaimLostError{Group: group, Consumer: consumer, ID: id}
+	case err != nil:
+		return fmt.Errorf("error reading claim %s: %s", from, err)
+	case owner != consumer:
+		return ClaimLostError{Group: group, Consumer: consumer, ID: id}
+	}
+	if err := os.Rename(from, to); err != nil {
+		if _, serr := os.Stat(to); serr == nil {
+			// Completed by someone else already.
+			return nil
+		}
+		return fmt.Errorf("error completing claim %s: %s", from, err)
+	}
+	return nil
+}
+
+// ReleaseClaim releases the claim held by consumer on the event with the
+// supplied ID, making it available to be claimed again. Releasing a claim
+// that does not exist is not an error.
+//
+// A ClaimLostError is returned if the claim is held by another consumer.
+func (s *Stream) ReleaseClaim(group, consumer, id string) error {
+	dir, err := s.groupDir(group)
+	if err != nil {
+		return err
+	}
+	path := dir + "/" + claimedDir + "/" + id
+	owner, err := claimOwner(path)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("error reading claim %s: %s", path, err)
+	case owner != consumer:
+		return ClaimLostError{Group: group, Consumer: consumer, ID: id}
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error releasing claim %s: %s", path, err)
+	}
+	return nil
+}
+
+// StealClaim attempts to take over a claim on the event with the supplied ID
+// that has not been refreshed within timeout, which generally means that the
+// consumer holding it has crashed.
+//
+// The stale claim is first renamed out of the way, which can only succeed for
+// one consumer. If the claim turns out to have been refreshed in the meantime,
+// it is put back and the steal is abandoned.
+//
+// true is returned if consumer now holds the claim.
+func (s *Stream) StealClaim(group, consumer, id string, timeout time.Duration) (bool, error) {
+	dir, err := s.groupDir(group)
+	if err != nil {
+		return false, err
+	}
+	path := dir + "/" + claimedDir + "/" + id
+	stat, err := os.Stat(path)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("could not stat claim %s: %s", path, err)
+	case time.Since(stat.ModTime()) < timeout:
+		return false, nil
+	}
+
+	stale := dir + "/" + claimedDir + "/.stale-" + consumer + "-" + id
+	if err := os.Rename(path, stale); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error releasing claim %s: %s", path, err)
+	}
+	stat, err = os.Stat(stale)
+	if err != nil {
+		return false, fmt.Errorf("could not stat claim %s: %s", stale, err)
+	}
+	if time.Since(stat.ModTime()) < timeout {
+		// Refreshed or re-claimed between our check and the rename. Link fails
+		// if someone has claimed the event since, in which case the claim is
+		// lost anyway.
+		os.Link(stale, path)
+		os.Remove(stale)
+		return false, nil
+	}
+	os.Remove(stale)
+	return s.Claim(group, consumer, id)
+}
+
+// StaleClaims returns the IDs of the events with claims in the consumer
+// group that have not been refreshed within timeout.
+func (s *Stream) StaleClaims(group string, timeout time.Duration) ([]string, error) {
+	dir, err := s.groupDir(group)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir + "/" + claimedDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading claim directory %s: %s", dir+"/"+claimedDir, err)
+	}
+	var ids []string
+	for _, f := range entries {
+		if !f.Mode().IsRegular() || f.Name()[0] == '.' || time.Since(f.ModTime()) < timeout {
+			continue
+		}
+		ids = append(ids, f.Name())
+	}
+	return ids, nil
+}
+
+// Unclaimed returns the IDs of the events in the stream that have neither
+// been claimed nor completed within the consumer group, in stream order.
+func (s *Stream) Unclaimed(group string) ([]string, error) {
+	dir, err := s.groupDir(group)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(s.Dir())
+	if err != nil {
+		return nil, fmt.Errorf("error reading event directory %s: %s", s.Dir(), err)
+	}
+	skip := make(map[string]struct{})
+	for _, d := range []string{dir + "/" + claimedDir, dir + "/" + doneDir} {
+		names, err := readDirNames(d)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			skip[n] = struct{}{}
+		}
+	}
+	var fs []os.FileInfo
+	for _, f := range entries {
+		if _, ok := skip[f.Name()]; ok {
+			continue
+		}
+		fs = append(fs, f)
+	}
+	es, err := s.entries(fs)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(es))
+	for i, e := range es {
+		ids[i] = e.id
+	}
+	return ids, nil
+}
+
+// readDirNames returns the names of the entries in the directory dir.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory %s: %s", dir, err)
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory %s: %s", dir, err)
+	}
+	return names, nil
+}
@@ -0,0 +1,180 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClaim(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := s.WriteEvent("foo", TestEvent{Text: "foo"}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	steps := []struct {
+		Name     string
+		Consumer string
+		Expected bool
+	}{
+		{Name: "first claim", Consumer: "a", Expected: true},
+		{Name: "second claim, same consumer", Consumer: "a", Expected: false},
+		{Name: "second claim, other consumer", Consumer: "b", Expected: false},
+	}
+	for _, step := range steps {
+		ok, err := s.Claim("group", step.Consumer, "foo")
+		if err != nil {
+			t.Fatalf("%s: bad: %s", step.Name, err)
+		}
+		if ok != step.Expected {
+			t.Fatalf("%s: expected %t, got %t", step.Name, step.Expected, ok)
+		}
+	}
+
+	if ok, err := s.RefreshClaim("group", "b", "foo"); err != nil || ok {
+		t.Fatalf("expected refresh by non-owner to fail, got %t, %v", ok, err)
+	}
+	if ok, err := s.RefreshClaim("group", "a", "foo"); err != nil || !ok {
+		t.Fatalf("expected refresh by owner to succeed, got %t, %v", ok, err)
+	}
+
+	if err := s.ReleaseClaim("group", "b", "foo"); err == nil {
+		t.Fatal("expected release by non-owner to fail")
+	} else if _, ok := err.(ClaimLostError); !ok {
+		t.Fatalf("expected ClaimLostError, got %v", err)
+	}
+	if err := s.CompleteClaim("group", "b", "foo"); err == nil {
+		t.Fatal("expected completion by non-owner to fail")
+	} else if _, ok := err.(ClaimLostError); !ok {
+		t.Fatalf("expected ClaimLostError, got %v", err)
+	}
+	if err := s.CompleteClaim("group", "a", "foo"); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := s.CompleteClaim("group", "a", "foo"); err != nil {
+		t.Fatalf("second completion: bad: %s", err)
+	}
+	if ok, err := s.Claim("group", "b", "foo"); err != nil || ok {
+		t.Fatalf("expected claim of completed event to fail, got %t, %v", ok, err)
+	}
+
+	// Other groups are independent.
+	if ok, err := s.Claim("other", "b", "foo"); err != nil || !ok {
+		t.Fatalf("expected claim in other group to succeed, got %t, %v", ok, err)
+	}
+
+	_, err = s.Claim("", "b", "foo")
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if !strings.Contains(err.Error(), "group name cannot be empty") {
+		t.Fatalf("expected error to match %q, got %q", "group name cannot be empty", err)
+	}
+}
+
+func TestStealClaim(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if ok, err := s.Claim("group", "a", "foo"); err != nil || !ok {
+		t.Fatalf("expected claim to succeed, got %t, %v", ok, err)
+	}
+
+	if ok, err := s.StealClaim("group", "b", "foo", time.Minute); err != nil || ok {
+		t.Fatalf("expected steal of fresh claim to fail, got %t, %v", ok, err)
+	}
+	stale, err := s.StaleClaims("group", time.Minute)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if len(stale) != 0 {
+		t.Fatalf("expected no stale claims, got %q", stale)
+	}
+
+	past := time.Now().Add(time.Minute * -2)
+	if err := os.Chtimes(s.Dir()+"/"+groupsDir+"/group/"+claimedDir+"/foo", past, past); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	stale, err = s.StaleClaims("group", time.Minute)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if expected := []string{"foo"}; !reflect.DeepEqual(expected, stale) {
+		t.Fatalf("expected %q, got %q", expected, stale)
+	}
+	if ok, err := s.StealClaim("group", "b", "foo", time.Minute); err != nil || !ok {
+		t.Fatalf("expected steal of stale claim to succeed, got %t, %v", ok, err)
+	}
+	if ok, err := s.RefreshClaim("group", "a", "foo"); err != nil || ok {
+		t.Fatalf("expected refresh by old owner to fail, got %t, %v", ok, err)
+	}
+	if ok, err := s.RefreshClaim("group", "b", "foo"); err != nil || !ok {
+		t.Fatalf("expected refresh by new owner to succeed, got %t, %v", ok, err)
+	}
+	// The old owner can neither complete nor release the event while the new
+	// owner is working on it.
+	for name, f := range map[string]func() error{
+		"complete": func() error { return s.CompleteClaim("group", "a", "foo") },
+		"release":  func() error { return s.ReleaseClaim("group", "a", "foo") },
+	} {
+		if _, ok := f().(ClaimLostError); !ok {
+			t.Fatalf("expected %s by old owner to fail with ClaimLostError", name)
+		}
+	}
+	if ok, err := s.RefreshClaim("group", "b", "foo"); err != nil || !ok {
+		t.Fatalf("expected claim to still be held by new owner, got %t, %v", ok, err)
+	}
+	if err := s.ReleaseClaim("group", "b", "foo"); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// The claim was released, not completed.
+	if err := s.CompleteClaim("group", "b", "foo"); err == nil {
+		t.Fatal("expected completion of released claim to fail")
+	}
+}
+
+func TestUnclaimed(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	for i, id := range []string{"c", "a", "b", "d"} {
+		if err := s.WriteEvent(id, TestEvent{Text: id}); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		ts := time.Unix(int64(1000+i), 0)
+		if err := os.Chtimes(s.Dir()+"/"+id, ts, ts); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+	if ok, err := s.Claim("group", "a", "a"); err != nil || !ok {
+		t.Fatalf("expected claim to succeed, got %t, %v", ok, err)
+	}
+	if ok, err := s.Claim("group", "a", "b"); err != nil || !ok {
+		t.Fatalf("expected claim to succeed, got %t, %v", ok, err)
+	}
+	if err := s.CompleteClaim("group", "a", "b"); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	actual, err := s.Unclaimed("group")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if expected := []string{"c", "d"}; !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+}
@@ -0,0 +1,170 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// deadLetterDir is the name of the directory, relative to the stream
+// directory, that dead-lettered events are kept in.
+//
+// The raw event files are moved to the data directory within it, and the
+// reason each event was dead-lettered is written to the errors directory,
+// under the same name.
+const deadLetterDir = ".deadletter"
+
+// deadLetterDataDir and deadLetterErrorsDir are the names of the raw event
+// and error directories within the dead-letter directory.
+const (
+	deadLetterDataDir   = "data"
+	deadLetterErrorsDir = "errors"
+)
+
+// DeadLetter is an event that has been moved out of the stream, normally
+// because it could not be decoded.
+type DeadLetter struct {
+	// The ID of the event.
+	ID string
+
+	// The raw event data, exactly as it was found in the stream.
+	Data []byte
+
+	// The reason the event was dead-lettered.
+	Error string
+
+	// The time the event was dead-lettered.
+	Time time.Time
+}
+
+// deadLetterRecord is the on-disk format of the error file for a dead-lettered
+// event.
+type deadLetterRecord struct {
+	Error string
+	Time  time.Time
+}
+
+// deadLetterDirs returns the data and errors directories for dead-lettered
+// events, creating them if they do not exist.
+func (s *Stream) deadLetterDirs() (string, string, error) {
+	data := s.Dir() + "/" + deadLetterDir + "/" + deadLetterDataDir
+	errs := s.Dir() + "/" + deadLetterDir + "/" + deadLetterErrorsDir
+	for _, d := range []string{data, errs} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			return "", "", fmt.Errorf("cannot create directory %s: %s", d, err)
+		}
+	}
+	return data, errs, nil
+}
+
+// DeadLetter moves the event with the supplied ID out of the stream and into
+// the stream's dead-letter directory, recording reason alongside it. Once
+// dead-lettered, an event no longer shows up in Dump or to subscribers until
+// it is replayed with ReplayDeadLetter.
+//
+// Dead-lettering an event that has already been moved is not an error.
+func (s *Stream) DeadLetter(id string, reason error) error {
+	data, errs, err := s.deadLetterDirs()
+	if err != nil {
+		return err
+	}
+	rec, err := json.Marshal(deadLetterRecord{Error: reason.Error(), Time: time.Now()})
+	if err != nil {
+		return fmt.Errorf("could not marshal dead letter record: %s", err)
+	}
+	if err := writeFileAtomic(errs, errs+"/"+id, rec); err != nil {
+		return err
+	}
+	from := s.Dir() + "/" + id
+	to := data + "/" + id
+	if err := os.Rename(from, to); err != nil {
+		if _, serr := os.Stat(to); serr == nil {
+			// Dead-lettered by someone else already.
+			return nil
+		}
+		return fmt.Errorf("error moving event %s to dead letters: %s", from, err)
+	}
+	return nil
+}
+
+// DumpDeadLetters returns all of the dead-lettered events for the stream
+// described by dir and event.
+//
+// The order of the returned events is not deterministic.
+func DumpDeadLetters(dir string, event interface{}) ([]DeadLetter, error) {
+	stream, err := NewStream(dir, event)
+	if err != nil {
+		return nil, err
+	}
+	data, errs, err := stream.deadLetterDirs()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(data)
+	if err != nil {
+		return nil, fmt.Errorf("error reading dead letter directory %s: %s", data, err)
+	}
+	var ds []DeadLetter
+	for _, f := range entries {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		d := DeadLetter{ID: f.Name()}
+		if d.Data, err = ioutil.ReadFile(data + "/" + f.Name()); err != nil {
+			return nil, fmt.Errorf("error reading dead letter data at %s: %s", data+"/"+f.Name(), err)
+		}
+		b, err := ioutil.ReadFile(errs + "/" + f.Name())
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error reading dead letter error at %s: %s", errs+"/"+f.Name(), err)
+		}
+		if err == nil {
+			var rec deadLetterRecord
+			if err := json.Unmarshal(b, &rec); err != nil {
+				return nil, fmt.Errorf("error unmarshaling dead letter error from %s: %s", errs+"/"+f.Name(), err)
+			}
+			d.Error = rec.Error
+			d.Time = rec.Time
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// ReplayDeadLetter moves the dead-lettered event with the supplied ID back
+// into the stream described by dir and event, where it is picked up by
+// subscribers like a newly published event. If data is not nil, it replaces
+// the event's original data, allowing a broken event to be corrected.
+func ReplayDeadLetter(dir string, event interface{}, id string, data []byte) error {
+	stream, err := NewStream(dir, event)
+	if err != nil {
+		return err
+	}
+	dataDir, errs, err := stream.deadLetterDirs()
+	if err != nil {
+		return err
+	}
+	path := dataDir + "/" + id
+	if data == nil {
+		if data, err = ioutil.ReadFile(path); err != nil {
+			return fmt.Errorf("error reading dead letter data at %s: %s", path, err)
+		}
+	}
+	// Keep the metadata the event was originally published with, other than
+	// the publish time. The event is no longer part of its batch, if it was in
+	// one.
+	m, err := stream.ReadMetadata(id)
+	if err != nil {
+		return err
+	}
+	m.Batch = ""
+	if err := stream.writeEventData(id, data, m); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("error removing dead letter %s: %s", path, err)
+	}
+	os.Remove(errs + "/" + id)
+	return nil
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestDeadLetter(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := s.WriteEvent("good", TestEvent{Text: "good"}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	raw := []byte("{\"Text\": 42}")
+	if err := ioutil.WriteFile(s.Dir()+"/bad", raw, 0666); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if _, err := Dump(dir, TestEvent{}); err == nil {
+		t.Fatal("expected error dumping stream with bad event, got none")
+	}
+
+	if err := s.DeadLetter("bad", errors.New("bad data")); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := s.DeadLetter("bad", errors.New("bad data")); err != nil {
+		t.Fatalf("second dead letter: bad: %s", err)
+	}
+
+	es, err := Dump(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if expected := []Event{{ID: "good", Data: TestEvent{Text: "good"}}}; !reflect.DeepEqual(expected, es) {
+		t.Fatalf("expected:\n\n%s\ngot:\n\n%s\n", spew.Sdump(expected), spew.Sdump(es))
+	}
+
+	ds, err := DumpDeadLetters(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if len(ds) != 1 {
+		t.Fatalf("expected one dead letter, got:\n\n%s\n", spew.Sdump(ds))
+	}
+	if ds[0].ID != "bad" || !reflect.DeepEqual(raw, ds[0].Data) || ds[0].Error != "bad data" || ds[0].Time.IsZero() {
+		t.Fatalf("unexpected dead letter:\n\n%s\n", spew.Sdump(ds[0]))
+	}
+
+	if err := ReplayDeadLetter(dir, TestEvent{}, "bad", []byte("{\"Text\": \"fixed\"}")); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	e, err := Fetch(dir, TestEvent{}, "bad")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if expected := (Event{ID: "bad", Data: TestEvent{Text: "fixed"}}); !reflect.DeepEqual(expected, e) {
+		t.Fatalf("expected:\n\n%s\ngot:\n\n%s\n", spew.Sdump(expected), spew.Sdump(e))
+	}
+	ds, err = DumpDeadLetters(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if len(ds) != 0 {
+		t.Fatalf("expected no dead letters, got:\n\n%s\n", spew.Sdump(ds))
+	}
+}
@@ -0,0 +1,266 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Durability describes how far a write to a stream must get before it is
+// reported as complete.
+//
+// Whatever the durability level, an event is given its publish time only once
+// its data has been synced, so that the sync of its metadata is all that comes
+// between the publish time and the event becoming visible. If that sync takes
+// longer than half of VisibilityWindow, the event is given a new publish time
+// and its metadata is synced again. A write fails if the sync keeps taking
+// that long, rather than making the event visible too late for checkpoints
+// and resyncs to see it.
+type Durability int
+
+const (
+	// DurabilityNone leaves it to the operating system to flush writes to
+	// disk. Written events can be lost on power loss. This is the default.
+	DurabilityNone Durability = iota
+
+	// DurabilitySyncFile syncs the files for each event to disk before the
+	// event is moved into the stream, so that a crash never leaves a partly
+	// written event visible. The event can still be lost on power loss, as the
+	// directory entry for it may not have been written.
+	DurabilitySyncFile
+
+	// DurabilitySyncDir works as per DurabilitySyncFile, and also syncs the
+	// directories the event was moved into to disk before the write
+	// completes.
+	DurabilitySyncDir
+
+	// DurabilityGroupCommit works as per DurabilitySyncDir, but batches the
+	// syncs for writes made at the same time, by concurrent publishers
+	// sharing the stream, into one round of syncs. This keeps the cost of
+	// each write down under load, at the expense of some latency.
+	DurabilityGroupCommit
+)
+
+// SetDurability sets the durability level for writes to the stream. It should
+// be set before the stream is used.
+func (s *Stream) SetDurability(d Durability) {
+	s.durability = d
+	if d == DurabilityGroupCommit && s.committer == nil {
+		s.committer = &groupCommitter{}
+	}
+}
+
+// Durability returns the durability level for writes to the stream.
+func (s *Stream) Durability() Durability {
+	return s.durability
+}
+
+// syncData syncs the contents of the files in paths to disk according to the
+// durability level of the stream. This is done before the files are moved
+// into place, so that they are never seen partly written after a crash.
+func (s *Stream) syncData(paths ...string) error {
+	switch s.durability {
+	case DurabilitySyncFile, DurabilitySyncDir:
+		return syncPaths(paths)
+	case DurabilityGroupCommit:
+		return s.committer.sync(paths)
+	}
+	return nil
+}
+
+// maxStampAge is the longest the metadata of an event can take to be synced
+// after the event is given its publish time. The event is given a new publish
+// time if the sync takes longer, so that it becomes visible well within
+// VisibilityWindow of its publish time.
+const maxStampAge = VisibilityWindow / 2
+
+// maxStampAttempts is the number of times events are given a publish time
+// before the write is given up on.
+const maxStampAttempts = 3
+
+// stamp gives events that are about to be moved into the stream their publish
+// time, by calling write with the time to write their metadata with, and
+// syncs the metadata files write returns. It must be called once everything
+// else about the events has been synced. If the sync takes longer than
+// maxStampAge, write is called again with a new time.
+//
+// write can return no files if it did not stamp the events, in which case
+// there is nothing to sync.
+func (s *Stream) stamp(write func(t time.Time) ([]string, error)) error {
+	for attempt := 1; ; attempt++ {
+		t := time.Now()
+		paths, err := write(t)
+		if err != nil || len(paths) == 0 {
+			return err
+		}
+		if err := s.syncData(paths...); err != nil {
+			return err
+		}
+		if time.Since(t) <= maxStampAge {
+			return nil
+		}
+		if attempt == maxStampAttempts {
+			return fmt.Errorf("metadata took longer than %s to sync %d times", maxStampAge, attempt)
+		}
+	}
+}
+
+// syncDirs syncs the directories holding the files in paths to disk according
+// to the durability level of the stream, once the files have been moved into
+// place.
+func (s *Stream) syncDirs(paths ...string) error {
+	switch s.durability {
+	case DurabilitySyncDir:
+		return syncPaths(parentDirs(paths))
+	case DurabilityGroupCommit:
+		return s.committer.sync(parentDirs(paths))
+	}
+	return nil
+}
+
+// WriteFileAtomic writes data to a temporary file in the directory tmp, and
+// then renames it to path, so that path either holds all of data or does not
+// exist. The file, and then the directory it is in, are synced to disk as
+// required by d - DurabilityGroupCommit is treated as DurabilitySyncDir. tmp
+// must be on the same filesystem as path.
+func WriteFileAtomic(tmp, path string, data []byte, d Durability) error {
+	name, err := writeTempFile(tmp, path, data)
+	if err != nil {
+		return err
+	}
+	// The data is synced before the rename, so that path never holds data
+	// that is not on disk yet.
+	if d != DurabilityNone {
+		if err := syncPath(name); err != nil {
+			os.Remove(name)
+			return err
+		}
+	}
+	if err := renameTempFile(name, path); err != nil {
+		return err
+	}
+	if d == DurabilitySyncDir || d == DurabilityGroupCommit {
+		return syncPath(filepath.Dir(path))
+	}
+	return nil
+}
+
+// syncPaths syncs the files and directories in paths to disk, syncing each
+// one once.
+func syncPaths(paths []string) error {
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		if err := syncPath(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parentDirs returns the directories holding the files in paths.
+func parentDirs(paths []string) []string {
+	var ds []string
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if d := filepath.Dir(path); !seen[d] {
+			seen[d] = true
+			ds = append(ds, d)
+		}
+	}
+	return ds
+}
+
+// syncHook, if set, is called before every sync, with the path being synced.
+// It is used by tests to simulate slow disks.
+var syncHook func(path string)
+
+// syncPath syncs the file or directory at path to disk.
+func syncPath(path string) error {
+	if syncHook != nil {
+		syncHook(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening %s for sync: %s", path, err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("error syncing %s: %s", path, err)
+	}
+	return nil
+}
+
+// groupCommitter batches syncs requested at the same time. The first writer
+// to ask for a sync becomes the leader and syncs everything requested up to
+// that point, while writers arriving in the meantime queue up for the next
+// round. Each leader runs a single round, and then hands over to the first
+// writer queued for the next one, so no writer is kept syncing for others
+// indefinitely.
+type groupCommitter struct {
+	// Protects the fields below.
+	mu sync.Mutex
+
+	// The files and directories waiting to be synced in the next round.
+	pending []string
+
+	// The writers waiting for the next round.
+	waiters []chan commitResult
+
+	// True while a round is in progress, or about to be.
+	running bool
+}
+
+// commitResult is sent to a writer waiting on a group commit, either with the
+// result of its round, or to make it the leader of its round.
+type commitResult struct {
+	err  error
+	lead bool
+}
+
+// sync queues the files and directories in paths for syncing, and waits for
+// them to be synced.
+func (g *groupCommitter) sync(paths []string) error {
+	c := make(chan commitResult, 1)
+	g.mu.Lock()
+	g.pending = append(g.pending, paths...)
+	g.waiters = append(g.waiters, c)
+	lead := !g.running
+	g.running = true
+	g.mu.Unlock()
+	if lead {
+		g.round()
+	}
+	r := <-c
+	if r.lead {
+		g.round()
+		r = <-c
+	}
+	return r.err
+}
+
+// round syncs everything queued so far, and then hands over to the first
+// writer queued for the next round, if any.
+func (g *groupCommitter) round() {
+	g.mu.Lock()
+	paths, waiters := g.pending, g.waiters
+	g.pending, g.waiters = nil, nil
+	g.mu.Unlock()
+	err := syncPaths(paths)
+	for _, c := range waiters {
+		c <- commitResult{err: err}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.waiters) == 0 {
+		g.running = false
+		return
+	}
+	g.waiters[0] <- commitResult{lead: true}
+}
@@ -0,0 +1,222 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSetDurability(t *testing.T) {
+	cases := []struct {
+		Name       string
+		Durability Durability
+	}{
+		{
+			Name:       "none",
+			Durability: DurabilityNone,
+		},
+		{
+			Name:       "sync file",
+			Durability: DurabilitySyncFile,
+		},
+		{
+			Name:       "sync dir",
+			Durability: DurabilitySyncDir,
+		},
+		{
+			Name:       "group commit",
+			Durability: DurabilityGroupCommit,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "storetest")
+			defer os.RemoveAll(dir)
+			s, err := NewStream(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			s.SetDurability(tc.Durability)
+			if s.Durability() != tc.Durability {
+				t.Fatalf("expected durability %d, got %d", tc.Durability, s.Durability())
+			}
+
+			// Concurrent writers all complete, whether or not their syncs are
+			// batched.
+			n := 20
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if err := s.WriteEvent(fmt.Sprint(i), TestEvent{Text: fmt.Sprint(i)}); err != nil {
+						t.Errorf("bad: %s", err)
+					}
+				}(i)
+			}
+			wg.Wait()
+			if err := s.WriteBatch("batch", []string{"a", "b"}, []interface{}{TestEvent{Text: "a"}, TestEvent{Text: "b"}}, nil); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			es, err := Dump(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if len(es) != n+2 {
+				t.Fatalf("expected %d events, got %d", n+2, len(es))
+			}
+
+			err = s.syncData(s.Dir() + "/missing")
+			switch {
+			case tc.Durability == DurabilityNone && err != nil:
+				t.Fatalf("bad: %s", err)
+			case tc.Durability != DurabilityNone && err == nil:
+				t.Fatal("expected error syncing missing file, got none")
+			case err != nil && !strings.Contains(err.Error(), "error opening"):
+				t.Fatalf("expected error to match %q, got %q", "error opening", err)
+			}
+		})
+	}
+}
+
+func TestPublishTempFileSyncsBeforeRename(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	s.SetDurability(DurabilitySyncFile)
+	// The temporary file is missing, so the sync fails, and the event must
+	// not have been moved into the stream by then.
+	err = s.publishTempFile(s.Dir()+"/"+tmpDir+"/missing", "foo", Metadata{})
+	if err == nil || !strings.Contains(err.Error(), "for sync") {
+		t.Fatalf("expected sync error, got %v", err)
+	}
+	if _, err := os.Stat(s.metadataPath("foo")); !os.IsNotExist(err) {
+		t.Fatalf("expected metadata to be removed, got %v", err)
+	}
+}
+
+func TestStampSlowSync(t *testing.T) {
+	slow := maxStampAge + 100*time.Millisecond
+	cases := []struct {
+		Name string
+
+		// Delays the sync of the event data.
+		SlowData bool
+
+		// Delays the syncs of the event metadata, after the first Skip of
+		// them. -1 delays none of them.
+		SlowMetadata int
+		Skip         int
+
+		// Writes the event foo.
+		Write func(s *Stream) error
+
+		Err bool
+	}{
+		{
+			Name:         "slow data sync",
+			SlowData:     true,
+			SlowMetadata: -1,
+			Write: func(s *Stream) error {
+				return s.WriteEvent("foo", TestEvent{Text: "foo"})
+			},
+		},
+		{
+			Name:         "slow metadata sync",
+			SlowMetadata: 1,
+			Write: func(s *Stream) error {
+				return s.WriteEvent("foo", TestEvent{Text: "foo"})
+			},
+		},
+		{
+			Name:         "metadata sync always slow",
+			SlowMetadata: maxStampAttempts,
+			Write: func(s *Stream) error {
+				return s.WriteEvent("foo", TestEvent{Text: "foo"})
+			},
+			Err: true,
+		},
+		{
+			Name:         "events",
+			SlowMetadata: 1,
+			Write: func(s *Stream) error {
+				return s.WriteEvents([]string{"foo"}, []interface{}{TestEvent{Text: "foo"}}, nil)[0]
+			},
+		},
+		{
+			Name:         "batch",
+			SlowMetadata: 1,
+			Skip:         1,
+			Write: func(s *Stream) error {
+				return s.WriteBatch("batch", []string{"foo"}, []interface{}{TestEvent{Text: "foo"}}, nil)
+			},
+		},
+		{
+			Name:         "aggregate",
+			SlowMetadata: 1,
+			Write: func(s *Stream) error {
+				_, err := s.WriteAggregateEvent("agg", 0, "foo", TestEvent{Text: "foo"}, nil)
+				return err
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "storetest")
+			defer os.RemoveAll(dir)
+			s, err := NewStream(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			s.SetDurability(DurabilitySyncFile)
+			var syncs int
+			syncHook = func(path string) {
+				switch {
+				case tc.SlowData && strings.HasPrefix(path, s.Dir()+"/"+tmpDir+"/"):
+					time.Sleep(slow)
+				case path == s.metadataPath("foo"):
+					if syncs++; syncs > tc.Skip && syncs <= tc.Skip+tc.SlowMetadata {
+						time.Sleep(slow)
+					}
+				}
+			}
+			defer func() { syncHook = nil }()
+
+			start := time.Now()
+			err = tc.Write(s)
+			if tc.Err {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				if _, err := os.Stat(s.Dir() + "/foo"); !os.IsNotExist(err) {
+					t.Fatalf("expected event not to be written, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			// The event is stamped after the slow sync, and becomes visible
+			// well within VisibilityWindow of its publish time.
+			m, err := s.ReadMetadata("foo")
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if m.Time.Before(start.Add(slow)) {
+				t.Fatalf("expected event to be stamped after the slow sync, stamped %s after start", m.Time.Sub(start))
+			}
+			if d := time.Since(m.Time); d > maxStampAge {
+				t.Fatalf("expected event to be visible within %s of its publish time, took %s", maxStampAge, d)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ConflictError is the error returned when an event is written idempotently
+// with an ID that is already taken by an event with different data.
+type ConflictError struct {
+	// The ID of the event.
+	ID string
+}
+
+// Error implements error for ConflictError.
+func (e ConflictError) Error() string {
+	return fmt.Sprintf("event %s already exists with different data", e.ID)
+}
+
+// abandonedWriteAge is the age after which a claim on an event ID by
+// WriteEventOnce is taken to belong to a writer that died, on systems where
+// claims cannot be locked by their writers. See lockClaim.
+const abandonedWriteAge = time.Minute
+
+// WriteEventOnce writes an event with the ID id, along with the supplied
+// headers, unless the event has already been written. Writing the same data
+// under the same ID again succeeds without doing anything, so that writes can
+// be retried safely. A ConflictError is returned if an event with the ID
+// already exists with different data.
+//
+// Concurrent writers race to claim the ID by linking their data to it in the
+// temporary directory of the stream. The winner holds a lock on its claim
+// until it is done, and only the winner writes the metadata and renames the
+// claim into the stream, so the headers and publish time are always the
+// winner's. The other writers wait for the winner to finish. If it gives up
+// or dies without writing the event, one of them takes the claim over, so
+// that a write is never reported as done unless the event is in the stream.
+//
+// true is returned if the event was written by this call.
+func (s *Stream) WriteEventOnce(id string, event interface{}, headers map[string]string) (bool, error) {
+	if err := ValidName("event", id); err != nil {
+		return false, err
+	}
+	data, err := s.marshalEvent(event)
+	if err != nil {
+		return false, err
+	}
+	path := s.Dir() + "/" + id
+	if ok, err := sameEvent(id, path, data); ok || err != nil {
+		return false, err
+	}
+
+	tmp := s.Dir() + "/" + tmpDir
+	if err := os.MkdirAll(tmp, 0777); err != nil {
+		return false, fmt.Errorf("error writing event to file %s: %s", path, err)
+	}
+	claim := tmp + "/" + id
+	f, err := claimEvent(tmp, claim, id, data)
+	if f == nil || err != nil {
+		return false, err
+	}
+	defer f.Close()
+	// The event may have been written in between us checking for it and
+	// claiming it.
+	if _, err := os.Stat(path); err == nil {
+		os.Remove(claim)
+		_, err := sameEvent(id, path, data)
+		return false, err
+	}
+	if err := s.publishTempFile(claim, id, Metadata{Headers: headers}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// claimEvent claims the event ID id for writing, by linking a locked
+// temporary file holding data to claim in the directory tmp. The claim is
+// returned open, and stays locked until it is closed.
+//
+// If another writer holds the claim, claimEvent waits for it to let go. nil
+// is returned if the event has been written with the same data by then - a
+// ConflictError is returned instead if it was written with different data.
+// Otherwise, the claim is taken over, as its writer gave up or died.
+func claimEvent(tmp, claim, id string, data []byte) (*os.File, error) {
+	path := filepath.Dir(tmp) + "/" + id
+	for {
+		if ok, err := sameEvent(id, path, data); ok || err != nil {
+			return nil, err
+		}
+		f, err := createClaim(tmp, path, data)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := linkTempFile(f.Name(), claim)
+		if ok || err != nil {
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			return f, nil
+		}
+		f.Close()
+		if err := waitClaim(claim); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// createClaim writes data to a new temporary file in the directory tmp, for
+// the event file at path, and locks it. The file is returned open.
+func createClaim(tmp, path string, data []byte) (*os.File, error) {
+	f, err := ioutil.TempFile(tmp, ".tmp-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file for %s: %s", path, err)
+	}
+	if err := lockClaim(f, false); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("error locking file %s: %s", f.Name(), err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("error writing to file %s: %s", f.Name(), err)
+	}
+	return f, nil
+}
+
+// waitClaim waits for the writer holding the claim to let go of it. If the
+// claim is still in place once it has, the writer died without removing it,
+// and it is removed so that it can be taken over.
+func waitClaim(claim string) error {
+	f, err := os.Open(claim)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("error opening claim %s: %s", claim, err)
+	}
+	defer f.Close()
+	if err := lockClaim(f, true); err != nil {
+		return fmt.Errorf("error locking claim %s: %s", claim, err)
+	}
+	held, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading claim %s: %s", claim, err)
+	}
+	cur, err := os.Stat(claim)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("error reading claim %s: %s", claim, err)
+	}
+	if !os.SameFile(held, cur) {
+		// Claimed again in the meantime.
+		return nil
+	}
+	if err := os.Remove(claim); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing abandoned claim %s: %s", claim, err)
+	}
+	return nil
+}
+
+// sameEvent returns true if the event file for the event with the ID id
+// exists at path with the data in data. A ConflictError is returned if it
+// exists with different data.
+func sameEvent(id, path string, data []byte) (bool, error) {
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("error reading event data at %s: %s", path, err)
+	}
+	if !bytes.Equal(b, data) {
+		return false, ConflictError{ID: id}
+	}
+	return true, nil
+}
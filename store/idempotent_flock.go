@@ -0,0 +1,26 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package store
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockClaim takes an exclusive lock on the claim open in f. The lock is held
+// until f is closed, or the process holding it dies, so a claim left behind
+// by a writer that died can be taken over straight away.
+//
+// A new claim is locked before it is linked into place, so that it is never
+// seen unlocked while its writer is still working on it. wait is true when
+// locking someone else's claim, in which case lockClaim blocks until it is
+// let go of.
+func lockClaim(f *os.File, wait bool) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
@@ -0,0 +1,124 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWriteEventOnceClaimed(t *testing.T) {
+	cases := []struct {
+		Name string
+
+		// The data the claim holds.
+		Data string
+
+		// True if the claim is locked by a writer that lets go of it without
+		// writing the event, and false if it was left by one that died.
+		Held bool
+	}{
+		{Name: "left by dead writer", Data: `{"Text":"foo"}`},
+		{Name: "left by dead writer with different data", Data: `{"Text":"bar"}`},
+		{Name: "given up by live writer", Data: `{"Text":"foo"}`, Held: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "storetest")
+			defer os.RemoveAll(dir)
+			s, err := NewStream(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			// The claim is fresh, so it would not be taken to be abandoned by
+			// its age.
+			tmp := s.Dir() + "/" + tmpDir
+			if err := os.MkdirAll(tmp, 0777); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			f, err := createClaim(tmp, s.Dir()+"/foo", []byte(tc.Data))
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if ok, err := linkTempFile(f.Name(), tmp+"/foo"); !ok || err != nil {
+				t.Fatalf("bad: %t, %v", ok, err)
+			}
+			if tc.Held {
+				go func() {
+					time.Sleep(time.Millisecond * 100)
+					os.Remove(tmp + "/foo")
+					f.Close()
+				}()
+			} else {
+				f.Close()
+			}
+
+			written, err := s.WriteEventOnce("foo", TestEvent{Text: "foo"}, nil)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if !written {
+				t.Fatal("expected event to be written")
+			}
+			es, err := Dump(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if len(es) != 1 || es[0].Data.(TestEvent).Text != "foo" {
+				t.Fatalf("expected the event in the stream, got %#v", es)
+			}
+		})
+	}
+}
+
+func TestWriteEventOnceWaitsForClaim(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	tmp := s.Dir() + "/" + tmpDir
+	if err := os.MkdirAll(tmp, 0777); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	f, err := createClaim(tmp, s.Dir()+"/foo", []byte(`{"Text":"foo"}`))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if ok, err := linkTempFile(f.Name(), tmp+"/foo"); !ok || err != nil {
+		t.Fatalf("bad: %t, %v", ok, err)
+	}
+
+	type result struct {
+		written bool
+		err     error
+	}
+	c := make(chan result)
+	go func() {
+		written, err := s.WriteEventOnce("foo", TestEvent{Text: "foo"}, nil)
+		c <- result{written, err}
+	}()
+	select {
+	case r := <-c:
+		t.Fatalf("expected write to wait for the claim, got %#v", r)
+	case <-time.After(time.Millisecond * 100):
+	}
+	// The holder of the claim writes the event.
+	if err := s.publishTempFile(tmp+"/foo", "foo", Metadata{}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	f.Close()
+	select {
+	case r := <-c:
+		if r.written || r.err != nil {
+			t.Fatalf("expected event to be written by the holder, got %#v", r)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("timed out waiting for write")
+	}
+}
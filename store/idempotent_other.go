@@ -0,0 +1,37 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package store
+
+import (
+	"os"
+	"time"
+)
+
+// claimPollInterval is the interval a claim held by another writer is checked
+// on.
+const claimPollInterval = time.Millisecond * 100
+
+// lockClaim waits for the claim open in f to be let go of, if wait is true.
+//
+// File locks are not used on this system. Instead, a claim is taken to be
+// held until it has been removed or replaced, or is abandonedWriteAge old.
+func lockClaim(f *os.File, wait bool) error {
+	if !wait {
+		return nil
+	}
+	for {
+		held, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if time.Since(held.ModTime()) >= abandonedWriteAge {
+			return nil
+		}
+		cur, err := os.Stat(f.Name())
+		if err != nil || !os.SameFile(held, cur) {
+			return nil
+		}
+		time.Sleep(claimPollInterval)
+	}
+}
@@ -0,0 +1,187 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteEventOnce(t *testing.T) {
+	cases := []struct {
+		Name    string
+		ID      string
+		Event   interface{}
+		Written bool
+		Err     string
+	}{
+		{
+			Name:    "new event",
+			ID:      "new",
+			Event:   TestEvent{Text: "foo"},
+			Written: true,
+		},
+		{
+			Name:  "identical event",
+			ID:    "existing",
+			Event: TestEvent{Text: "foo"},
+		},
+		{
+			Name:  "conflicting event",
+			ID:    "existing",
+			Event: TestEvent{Text: "bar"},
+			Err:   "event existing already exists with different data",
+		},
+		{
+			Name:  "mismatched event type",
+			ID:    "new",
+			Event: BadEvent{Text: "foo"},
+			Err:   "does not match stream type",
+		},
+		{
+			Name:  "bad ID",
+			ID:    ".new",
+			Event: TestEvent{Text: "foo"},
+			Err:   "cannot start with a dot",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "storetest")
+			defer os.RemoveAll(dir)
+			s, err := NewStream(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if err := s.WriteEvent("existing", TestEvent{Text: "foo"}); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			before, err := s.ReadMetadata("existing")
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+
+			written, err := s.WriteEventOnce(tc.ID, tc.Event, nil)
+			switch {
+			case err != nil && tc.Err == "":
+				t.Fatalf("bad: %s", err)
+			case err == nil && tc.Err != "":
+				t.Fatal("expected error, got none")
+			case err != nil && tc.Err != "":
+				if !strings.Contains(err.Error(), tc.Err) {
+					t.Fatalf("expected error to match %q, got %q", tc.Err, err)
+				}
+			}
+			if written != tc.Written {
+				t.Fatalf("expected written %t, got %t", tc.Written, written)
+			}
+			// The existing event is left as it was.
+			after, err := s.ReadMetadata("existing")
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if !after.Time.Equal(before.Time) {
+				t.Fatalf("expected metadata to be unchanged, got %#v", after)
+			}
+			es, err := Dump(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			expected := 1
+			if tc.Written {
+				expected++
+			}
+			if len(es) != expected {
+				t.Fatalf("expected %d events, got %d", expected, len(es))
+			}
+		})
+	}
+}
+
+func TestWriteEventOnceConcurrent(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var written []string
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(writer string) {
+			defer wg.Done()
+			ok, err := s.WriteEventOnce("foo", TestEvent{Text: "foo"}, map[string]string{"writer": writer})
+			if err != nil {
+				t.Errorf("bad: %s", err)
+			}
+			if ok {
+				mu.Lock()
+				written = append(written, writer)
+				mu.Unlock()
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+	if len(written) != 1 {
+		t.Fatalf("expected exactly one write, got %d", len(written))
+	}
+	// The losers leave the winner's metadata alone.
+	m, err := s.ReadMetadata("foo")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if m.Headers["writer"] != written[0] {
+		t.Fatalf("expected headers from writer %s, got %#v", written[0], m.Headers)
+	}
+}
+
+func TestWriteEventOnceAbandoned(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Age     time.Duration
+		Written bool
+	}{
+		{Name: "abandoned", Age: abandonedWriteAge * 2, Written: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "storetest")
+			defer os.RemoveAll(dir)
+			s, err := NewStream(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			// A writer that stops after claiming the ID leaves its claim behind.
+			claim := s.Dir() + "/" + tmpDir + "/foo"
+			if err := os.MkdirAll(filepath.Dir(claim), 0777); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if err := ioutil.WriteFile(claim, []byte(`{"Text":"foo"}`), 0666); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			then := time.Now().Add(-tc.Age)
+			if err := os.Chtimes(claim, then, then); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+
+			written, err := s.WriteEventOnce("foo", TestEvent{Text: "foo"}, nil)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if written != tc.Written {
+				t.Fatalf("expected written %t, got %t", tc.Written, written)
+			}
+			if _, err := s.WriteEventOnce("foo", TestEvent{Text: "bar"}, nil); err == nil {
+				t.Fatal("expected conflict, got none")
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// metaDir is the name of the directory, relative to the stream directory,
+// that event metadata is kept in. The metadata for each event is kept in a
+// file with the same name as the event.
+const metaDir = ".meta"
+
+// Metadata is the information recorded alongside an event when it is
+// published.
+type Metadata struct {
+	// The time the event was published.
+	Time time.Time
+
+	// The headers the event was published with, if any.
+	Headers map[string]string `json:",omitempty"`
+
+	// The ID of the batch the event was published in, if any.
+	Batch string `json:",omitempty"`
+
+	// The ID of the aggregate the event was published to, if any, and the
+	// version of the aggregate the event created.
+	Aggregate string `json:",omitempty"`
+	Version   int64  `json:",omitempty"`
+}
+
+// metadataPath returns the path to the metadata file for the event with the
+// supplied ID.
+func (s *Stream) metadataPath(id string) string {
+	return s.Dir() + "/" + metaDir + "/" + id
+}
+
+// writeMetadata writes the metadata for the event with the supplied ID.
+func (s *Stream) writeMetadata(id string, m Metadata) error {
+	dir := s.Dir() + "/" + metaDir
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("cannot create directory %s: %s", dir, err)
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("could not marshal metadata for event %s: %s", id, err)
+	}
+	return writeFileAtomic(dir, s.metadataPath(id), data)
+}
+
+// createMetadata writes the metadata for the event with the supplied ID,
+// unless it has already been written. false is returned if it has.
+func (s *Stream) createMetadata(id string, m Metadata) (bool, error) {
+	dir := s.Dir() + "/" + metaDir
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return false, fmt.Errorf("cannot create directory %s: %s", dir, err)
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return false, fmt.Errorf("could not marshal metadata for event %s: %s", id, err)
+	}
+	name, err := writeTempFile(dir, s.metadataPath(id), data)
+	if err != nil {
+		return false, err
+	}
+	return linkTempFile(name, s.metadataPath(id))
+}
+
+// ReadMetadata reads the metadata for the event with the supplied ID. Zero
+// Metadata is returned for events that were not published with any, such as
+// events written to the stream by hand.
+func (s *Stream) ReadMetadata(id string) (Metadata, error) {
+	return readMetadata(s.metadataPath(id))
+}
+
+// readMetadata reads the metadata file at path, returning zero Metadata if it
+// does not exist.
+func readMetadata(path string) (Metadata, error) {
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return Metadata{}, nil
+	case err != nil:
+		return Metadata{}, fmt.Errorf("error reading metadata at %s: %s", path, err)
+	}
+	var m Metadata
+	if err := json.Unmarshal(b, &m); err != nil {
+		return Metadata{}, fmt.Errorf("error unmarshaling metadata from %s: %s", path, err)
+	}
+	return m, nil
+}
+
+// streamEntry is an event in the stream, along with the time used to order
+// it.
+type streamEntry struct {
+	id   string
+	time time.Time
+}
+
+// entryTime returns the time used to order the event file f. This is the
+// publish time recorded in the event's metadata, or the modification time of
+// the file if there is none.
+func (s *Stream) entryTime(f os.FileInfo) (time.Time, error) {
+	m, err := s.ReadMetadata(f.Name())
+	if err != nil {
+		return time.Time{}, err
+	}
+	return metadataTime(f, m), nil
+}
+
+// metadataTime returns the time used to order the event file f with the
+// metadata m.
+func metadataTime(f os.FileInfo, m Metadata) time.Time {
+	if m.Time.IsZero() {
+		return f.ModTime()
+	}
+	return m.Time
+}
+
+// entries returns the stream entries for the event files in fs, in stream
+// order - by time, and then by ID. Files that are not regular files, and
+// events in batches that are not complete yet, are skipped.
+func (s *Stream) entries(fs []os.FileInfo) ([]streamEntry, error) {
+	var es []streamEntry
+	batches := make(map[string]bool)
+	for _, f := range fs {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		m, err := s.ReadMetadata(f.Name())
+		if err != nil {
+			return nil, err
+		}
+		ok, err := s.visible(m, batches)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		es = append(es, streamEntry{id: f.Name(), time: metadataTime(f, m)})
+	}
+	sort.Slice(es, func(i, j int) bool {
+		if !es[i].time.Equal(es[j].time) {
+			return es[i].time.Before(es[j].time)
+		}
+		return es[i].id < es[j].id
+	})
+	return es, nil
+}
+
+// DumpSince returns the events in the stream described by dir and event that
+// were published at or after t, in the order they were published.
+func DumpSince(dir string, event interface{}, t time.Time) ([]Event, error) {
+	stream, err := NewStream(dir, event)
+	if err != nil {
+		return nil, err
+	}
+	es, _, err := stream.EventsAfter(Checkpoint{Time: t})
+	return es, err
+}
+
+// DumpAfter returns the events in the stream described by dir and event that
+// were published after the event with the supplied ID, in the order they were
+// published.
+func DumpAfter(dir string, event interface{}, id string) ([]Event, error) {
+	stream, err := NewStream(dir, event)
+	if err != nil {
+		return nil, err
+	}
+	c, err := stream.CheckpointAt(id)
+	if err != nil {
+		return nil, err
+	}
+	es, _, err := stream.EventsAfter(c)
+	return es, err
+}
@@ -0,0 +1,119 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestReadMetadata(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	before := time.Now()
+	if err := s.WriteEvent("published", TestEvent{Text: "foo"}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	m, err := s.ReadMetadata("published")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if m.Time.Before(before) || m.Time.After(time.Now()) {
+		t.Fatalf("expected publish time to be recorded, got %s", m.Time)
+	}
+
+	// Events without metadata fall back to the modification time.
+	if err := ioutil.WriteFile(s.Dir()+"/written", []byte("{\"Text\": \"bar\"}"), 0666); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	ts := time.Unix(1000, 0)
+	if err := os.Chtimes(s.Dir()+"/written", ts, ts); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if m, err = s.ReadMetadata("written"); err != nil || !m.Time.IsZero() {
+		t.Fatalf("expected no metadata, got %#v, %v", m, err)
+	}
+	if actual, err := s.EventTime("written"); err != nil || !actual.Equal(ts) {
+		t.Fatalf("expected time %s, got %s, %v", ts, actual, err)
+	}
+}
+
+func TestDumpSinceAfter(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// b and c share a publish time, so they are ordered by ID.
+	for i, id := range []string{"a", "c", "b", "d"} {
+		if err := s.WriteEvent(id, TestEvent{Text: id}); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		ts := time.Unix(int64(1000+i), 0)
+		if id == "b" {
+			ts = time.Unix(1001, 0)
+		}
+		if err := s.writeMetadata(id, Metadata{Time: ts}); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+
+	cases := []struct {
+		Name     string
+		Dump     func() ([]Event, error)
+		Expected []string
+	}{
+		{
+			Name:     "since, exact",
+			Dump:     func() ([]Event, error) { return DumpSince(dir, TestEvent{}, time.Unix(1001, 0)) },
+			Expected: []string{"b", "c", "d"},
+		},
+		{
+			Name:     "since, between",
+			Dump:     func() ([]Event, error) { return DumpSince(dir, TestEvent{}, time.Unix(1002, 500)) },
+			Expected: []string{"d"},
+		},
+		{
+			Name:     "after, first at shared time",
+			Dump:     func() ([]Event, error) { return DumpAfter(dir, TestEvent{}, "b") },
+			Expected: []string{"c", "d"},
+		},
+		{
+			Name:     "after, last at shared time",
+			Dump:     func() ([]Event, error) { return DumpAfter(dir, TestEvent{}, "c") },
+			Expected: []string{"d"},
+		},
+		{
+			Name:     "after, last event",
+			Dump:     func() ([]Event, error) { return DumpAfter(dir, TestEvent{}, "d") },
+			Expected: nil,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			es, err := tc.Dump()
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			var actual []string
+			for _, e := range es {
+				actual = append(actual, e.ID)
+			}
+			if !reflect.DeepEqual(tc.Expected, actual) {
+				t.Fatalf("expected %q, got:\n\n%s\n", tc.Expected, spew.Sdump(es))
+			}
+		})
+	}
+
+	if _, err := DumpAfter(dir, TestEvent{}, "nope"); err == nil {
+		t.Fatal("expected error for missing event, got none")
+	}
+}
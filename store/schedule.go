@@ -0,0 +1,256 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scheduledDir is the name of the directory, relative to the stream
+// directory, that events scheduled for a later time are kept in until they
+// are due.
+//
+// Each scheduled event is a file named after the time it is due, as a
+// zero-padded count of nanoseconds since the Unix epoch, and its ID, so that
+// the due events can be found from the names alone. Its metadata is kept with
+// the metadata of the rest of the stream.
+//
+// An event is released in two steps. It is first moved into the release
+// directory - only one of several schedulers releasing the same event can do
+// this, so it is released once. Its publish time is then set, and it is moved
+// into the stream.
+const scheduledDir = ".scheduled"
+
+// releaseDir is the name of the directory, relative to the scheduled
+// directory, that events are moved to while they are released. Files in the
+// release directory are named the same way as scheduled events, but with the
+// time the release started in place of the time the event is due.
+const releaseDir = ".release"
+
+// abandonedReleaseAge is the age after which the release of an event is taken
+// to have been abandoned by a releaser that died, and is completed by
+// RecoverScheduled.
+const abandonedReleaseAge = time.Minute
+
+// ScheduledEvent is an event that has been scheduled, but is not due yet.
+type ScheduledEvent struct {
+	// The ID of the event.
+	ID string
+
+	// The time the event is due.
+	Due time.Time
+}
+
+// TimedName returns a file name for id at the time t - t as a zero-padded
+// count of nanoseconds since the Unix epoch, followed by id. Files with these
+// names sort in time order. Times before the epoch are clamped to it.
+func TimedName(id string, t time.Time) string {
+	n := t.UnixNano()
+	if n < 0 {
+		n = 0
+	}
+	return fmt.Sprintf("%020d-%s", n, id)
+}
+
+// ParseTimedName parses a file name returned by TimedName. ok is false if the
+// name is not one.
+func ParseTimedName(name string) (id string, t time.Time, ok bool) {
+	i := strings.IndexByte(name, '-')
+	if i < 1 || i == len(name)-1 {
+		return "", time.Time{}, false
+	}
+	n, err := strconv.ParseInt(name[:i], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return name[i+1:], time.Unix(0, n), true
+}
+
+// WriteScheduledEvent writes the event to the stream with the ID id and any
+// headers in headers, which can be nil, to be released at t. The event is not
+// visible in the stream until it is released by ReleaseDue.
+func (s *Stream) WriteScheduledEvent(id string, event interface{}, headers map[string]string, t time.Time) error {
+	if err := ValidName("event", id); err != nil {
+		return err
+	}
+	data, err := s.marshalEvent(event)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(s.Dir() + "/" + id); err == nil {
+		return IDCollisionError{s: fmt.Sprintf("id collision: %s", id)}
+	}
+
+	dir := s.Dir() + "/" + scheduledDir
+	path := dir + "/" + TimedName(id, t)
+	tmp := s.Dir() + "/" + tmpDir
+	for _, d := range []string{dir, tmp} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			return fmt.Errorf("cannot create directory %s: %s", d, err)
+		}
+	}
+	if err := s.writeMetadata(id, Metadata{Time: time.Now(), Headers: headers}); err != nil {
+		return fmt.Errorf("error scheduling event %s: %s", id, err)
+	}
+	name, err := writeTempFile(tmp, path, data)
+	if err != nil {
+		os.Remove(s.metadataPath(id))
+		return fmt.Errorf("error scheduling event %s: %s", id, err)
+	}
+	// The event is synced now, as it is moved into the stream as it is when
+	// it is released.
+	if err := s.syncData(s.metadataPath(id), name); err != nil {
+		os.Remove(name)
+		os.Remove(s.metadataPath(id))
+		return fmt.Errorf("error scheduling event %s: %s", id, err)
+	}
+	if err := renameTempFile(name, path); err != nil {
+		os.Remove(s.metadataPath(id))
+		return fmt.Errorf("error scheduling event %s: %s", id, err)
+	}
+	if err := s.syncDirs(s.metadataPath(id), path); err != nil {
+		return fmt.Errorf("error scheduling event %s: %s", id, err)
+	}
+	return nil
+}
+
+// Scheduled returns the events in the stream that are scheduled but have not
+// been released yet, in the order they are due.
+func (s *Stream) Scheduled() ([]ScheduledEvent, error) {
+	dir := s.Dir() + "/" + scheduledDir
+	fs, err := ioutil.ReadDir(dir)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("error reading scheduled directory %s: %s", dir, err)
+	}
+	var es []ScheduledEvent
+	for _, f := range fs {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		if id, t, ok := ParseTimedName(f.Name()); ok {
+			es = append(es, ScheduledEvent{ID: id, Due: t})
+		}
+	}
+	sort.Slice(es, func(i, j int) bool {
+		if es[i].Due.Equal(es[j].Due) {
+			return es[i].ID < es[j].ID
+		}
+		return es[i].Due.Before(es[j].Due)
+	})
+	return es, nil
+}
+
+// ReleaseDue releases the scheduled events that are due at t, making them
+// visible in the stream in the order they are due. Each event is published at
+// the time it is released, not the time it was due. The IDs of the events
+// released are returned.
+//
+// Any number of callers can release the events of a stream at once - each
+// event is released by only one of them.
+func (s *Stream) ReleaseDue(t time.Time) ([]string, error) {
+	es, err := s.Scheduled()
+	if err != nil {
+		return nil, err
+	}
+	dir := s.Dir() + "/" + scheduledDir
+	release := dir + "/" + releaseDir
+	var ids []string
+	for _, e := range es {
+		if e.Due.After(t) {
+			break
+		}
+		if err := os.MkdirAll(release, 0777); err != nil {
+			return ids, fmt.Errorf("cannot create directory %s: %s", release, err)
+		}
+		name := TimedName(e.ID, time.Now())
+		err := os.Rename(dir+"/"+TimedName(e.ID, e.Due), release+"/"+name)
+		switch {
+		case err != nil && os.IsNotExist(err):
+			// Released by someone else.
+			continue
+		case err != nil:
+			return ids, fmt.Errorf("error releasing event %s: %s", e.ID, err)
+		}
+		if err := s.release(name, e.ID); err != nil {
+			return ids, err
+		}
+		ids = append(ids, e.ID)
+	}
+	return ids, nil
+}
+
+// release sets the publish time of the event with the ID id, which has been
+// moved into the release directory under name, and moves it into the stream.
+func (s *Stream) release(name, id string) error {
+	m, err := s.ReadMetadata(id)
+	if err != nil {
+		return fmt.Errorf("error releasing event %s: %s", id, err)
+	}
+	if err := s.stamp(func(t time.Time) ([]string, error) {
+		m.Time = t
+		return []string{s.metadataPath(id)}, s.writeMetadata(id, m)
+	}); err != nil {
+		return fmt.Errorf("error releasing event %s: %s", id, err)
+	}
+	path := s.Dir() + "/" + id
+	if err := os.Rename(s.Dir()+"/"+scheduledDir+"/"+releaseDir+"/"+name, path); err != nil {
+		// The release was taken over by RecoverScheduled.
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error releasing event %s: %s", id, err)
+	}
+	if err := s.syncDirs(s.metadataPath(id), path); err != nil {
+		return fmt.Errorf("error releasing event %s: %s", id, err)
+	}
+	return nil
+}
+
+// RecoverScheduled completes the release of any events whose release was
+// abandoned - for example, because the scheduler releasing them crashed part
+// way through. Releases are only taken to be abandoned once they have been
+// running for a minute, so that releases still in progress elsewhere are left
+// alone.
+//
+// Any number of callers can recover the events of a stream at once - each
+// event is recovered by only one of them.
+func (s *Stream) RecoverScheduled() error {
+	dir := s.Dir() + "/" + scheduledDir + "/" + releaseDir
+	fs, err := ioutil.ReadDir(dir)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("error reading release directory %s: %s", dir, err)
+	}
+	for _, f := range fs {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		id, started, ok := ParseTimedName(f.Name())
+		if !ok || time.Since(started) < abandonedReleaseAge {
+			continue
+		}
+		// Take the release over by restarting it, so that only one caller
+		// completes it.
+		name := TimedName(id, time.Now())
+		err := os.Rename(dir+"/"+f.Name(), dir+"/"+name)
+		switch {
+		case err != nil && os.IsNotExist(err):
+			continue
+		case err != nil:
+			return fmt.Errorf("error recovering event %s: %s", id, err)
+		}
+		if err := s.release(name, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
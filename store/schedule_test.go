@@ -0,0 +1,243 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteScheduledEvent(t *testing.T) {
+	cases := []struct {
+		Name  string
+		ID    string
+		Event interface{}
+		Err   string
+	}{
+		{
+			Name:  "basic success case",
+			ID:    "foo",
+			Event: TestEvent{Text: "foo"},
+		},
+		{
+			Name:  "mismatched event type",
+			ID:    "foo",
+			Event: BadEvent{Text: "foo"},
+			Err:   "does not match stream type",
+		},
+		{
+			Name:  "bad ID",
+			ID:    ".foo",
+			Event: TestEvent{Text: "foo"},
+			Err:   "cannot start with a dot",
+		},
+		{
+			Name:  "id collision",
+			ID:    "existing",
+			Event: TestEvent{Text: "foo"},
+			Err:   "id collision",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "storetest")
+			defer os.RemoveAll(dir)
+			s, err := NewStream(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if err := s.WriteEvent("existing", TestEvent{Text: "existing"}); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			due := time.Now().Add(time.Hour)
+			err = s.WriteScheduledEvent(tc.ID, tc.Event, map[string]string{"foo": "bar"}, due)
+			switch {
+			case err != nil && tc.Err == "":
+				t.Fatalf("bad: %s", err)
+			case err == nil && tc.Err != "":
+				t.Fatal("expected error, got none")
+			case err != nil && tc.Err != "":
+				if !strings.Contains(err.Error(), tc.Err) {
+					t.Fatalf("expected error to match %q, got %q", tc.Err, err)
+				}
+				return
+			}
+
+			// Not visible until released.
+			es, err := Dump(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if len(es) != 1 {
+				t.Fatalf("expected only the existing event, got %#v", es)
+			}
+			scheduled, err := s.Scheduled()
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if len(scheduled) != 1 || scheduled[0].ID != tc.ID || !scheduled[0].Due.Equal(due) {
+				t.Fatalf("expected %s scheduled at %s, got %#v", tc.ID, due, scheduled)
+			}
+			ids, err := s.ReleaseDue(time.Now())
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if len(ids) != 0 {
+				t.Fatalf("expected nothing released, got %q", ids)
+			}
+
+			before := time.Now()
+			ids, err = s.ReleaseDue(due)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if !reflect.DeepEqual([]string{tc.ID}, ids) {
+				t.Fatalf("expected %q released, got %q", tc.ID, ids)
+			}
+			e, err := Fetch(dir, TestEvent{}, tc.ID)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if !reflect.DeepEqual(tc.Event, e.Data) || e.Headers["foo"] != "bar" {
+				t.Fatalf("unexpected event %#v", e)
+			}
+			m, err := s.ReadMetadata(tc.ID)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if m.Time.Before(before) {
+				t.Fatalf("expected publish time after %s, got %s", before, m.Time)
+			}
+			if scheduled, err := s.Scheduled(); err != nil || len(scheduled) != 0 {
+				t.Fatalf("expected nothing scheduled, got %#v, %v", scheduled, err)
+			}
+		})
+	}
+}
+
+func TestReleaseDueOrder(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	now := time.Now()
+	for i, id := range []string{"c", "a", "d", "b"} {
+		if err := s.WriteScheduledEvent(id, TestEvent{Text: id}, nil, now.Add(time.Duration(i%2)*time.Minute-time.Duration(i))); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+	ids, err := s.ReleaseDue(now)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if expected := []string{"d", "c"}; !reflect.DeepEqual(expected, ids) {
+		t.Fatalf("expected %q, got %q", expected, ids)
+	}
+	ids, err = s.ReleaseDue(now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if expected := []string{"b", "a"}; !reflect.DeepEqual(expected, ids) {
+		t.Fatalf("expected %q, got %q", expected, ids)
+	}
+	actual, _, err := s.EventIDsAfter(Checkpoint{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if expected := []string{"d", "c", "b", "a"}; !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected stream order %q, got %q", expected, actual)
+	}
+}
+
+func TestReleaseDueConcurrent(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	var expected []string
+	for _, id := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		if err := s.WriteScheduledEvent(id, TestEvent{Text: id}, nil, time.Now()); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		expected = append(expected, id)
+	}
+
+	var mu sync.Mutex
+	var actual []string
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids, err := s.ReleaseDue(time.Now())
+			if err != nil {
+				t.Errorf("bad: %s", err)
+			}
+			mu.Lock()
+			actual = append(actual, ids...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	sort.Strings(actual)
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected each event released once, got %q", actual)
+	}
+}
+
+func TestRecoverScheduled(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Started   time.Duration
+		Recovered bool
+	}{
+		{Name: "in progress", Started: 0},
+		{Name: "abandoned", Started: abandonedReleaseAge * 2, Recovered: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "storetest")
+			defer os.RemoveAll(dir)
+			s, err := NewStream(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			due := time.Now()
+			if err := s.WriteScheduledEvent("foo", TestEvent{Text: "foo"}, nil, due); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			// Simulate a scheduler that stopped after claiming the event.
+			release := s.Dir() + "/" + scheduledDir + "/" + releaseDir
+			if err := os.MkdirAll(release, 0777); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			name := TimedName("foo", time.Now().Add(-tc.Started))
+			if err := os.Rename(s.Dir()+"/"+scheduledDir+"/"+TimedName("foo", due), release+"/"+name); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if ids, err := s.ReleaseDue(due); err != nil || len(ids) != 0 {
+				t.Fatalf("expected nothing released, got %q, %v", ids, err)
+			}
+			if err := s.RecoverScheduled(); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			_, err = Fetch(dir, TestEvent{}, "foo")
+			switch {
+			case tc.Recovered && err != nil:
+				t.Fatalf("bad: %s", err)
+			case !tc.Recovered && err == nil:
+				t.Fatal("expected release in progress to be left alone")
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@
 package store
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,8 +13,13 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"time"
 )
 
+// tmpDir is the name of the directory, relative to the stream directory, that
+// events are staged in before being moved into the stream.
+const tmpDir = ".tmp"
+
 // IDCollisionError is an error type that is returned on a UUID collision.
 // This is a retryable error.
 //
@@ -41,6 +47,18 @@ type Event struct {
 
 	// The event data.
 	Data interface{}
+
+	// The headers the event was published with, if any. Headers are kept in
+	// the event's metadata, separate from the event data.
+	Headers map[string]string
+
+	// The name of the stream the event was read from. This is only set for
+	// events delivered by a subscriber that watches more than one stream.
+	Stream string
+
+	// The delivery attempt for this event, starting at 1, for subscribers that
+	// redeliver unacknowledged events. This is zero otherwise.
+	Attempt int
 }
 
 // eventSlice represents multiple events and implements sort.Interface so that
@@ -101,6 +119,16 @@ type Stream struct {
 	// The type for the event that this stream processes. Events passed to the
 	// stream should match this type.
 	eventType reflect.Type
+
+	// The name of the stream, if it is different from the name of the event
+	// type. This is the topic for topic streams.
+	name string
+
+	// The durability level for writes to the stream.
+	durability Durability
+
+	// Batches syncs under DurabilityGroupCommit.
+	committer *groupCommitter
 }
 
 // NewStream creates a stream for the specific type. The events are read or
@@ -140,6 +168,15 @@ func (s *Stream) Dir() string {
 	return s.dir
 }
 
+// Name returns the name of the stream. This is the topic for topic streams,
+// and the name of the event type otherwise.
+func (s *Stream) Name() string {
+	if s.name != "" {
+		return s.name
+	}
+	return s.eventType.Name()
+}
+
 // EventType returns the event type for the stream.
 func (s *Stream) EventType() reflect.Type {
 	return s.eventType
@@ -149,14 +186,37 @@ func (s *Stream) EventType() reflect.Type {
 // id. This is generally designed to be used by publishers in the pub package,
 // but is separated to help with testing.
 func (s *Stream) WriteEvent(id string, event interface{}) error {
+	return s.WriteEventWithHeaders(id, event, nil)
+}
+
+// WriteEventWithHeaders works as per WriteEvent, but also records the supplied
+// headers in the event's metadata. Headers are returned in the Headers field
+// of the event when it is read back.
+func (s *Stream) WriteEventWithHeaders(id string, event interface{}, headers map[string]string) error {
+	data, err := s.marshalEvent(event)
+	if err != nil {
+		return err
+	}
+
+	return s.writeEventData(id, data, Metadata{Headers: headers})
+}
+
+// marshalEvent checks that event matches the stream type, and marshals it.
+func (s *Stream) marshalEvent(event interface{}) ([]byte, error) {
 	if reflect.TypeOf(event) != s.EventType() {
-		return fmt.Errorf("event of type %s does not match stream type %s", reflect.TypeOf(event), s.EventType())
+		return nil, fmt.Errorf("event of type %s does not match stream type %s", reflect.TypeOf(event), s.EventType())
 	}
 	data, err := json.Marshal(event)
 	if err != nil {
-		return fmt.Errorf("could not marshal event data: %s", err)
+		return nil, fmt.Errorf("could not marshal event data: %s", err)
 	}
+	return data, nil
+}
 
+// writeEventData writes the raw data for an event with the ID id to the
+// stream, along with its metadata. The publish time in m is set as per
+// publishTempFile.
+func (s *Stream) writeEventData(id string, data []byte, m Metadata) error {
 	path := s.Dir() + "/" + id
 	// If this path responds to stat, then the path exists in some way, shape, or
 	// form, and is not valid for use. This is almost always due to a UUID
@@ -167,16 +227,165 @@ func (s *Stream) WriteEvent(id string, event interface{}) error {
 		return IDCollisionError{s: fmt.Sprintf("id collision: %s", id)}
 	}
 
-	if err := ioutil.WriteFile(path, data, 0666); err != nil {
+	// The event is written to a temporary file outside of the stream first and
+	// then renamed into place, so that anything scanning the stream never sees
+	// a partially written event.
+	tmp := s.Dir() + "/" + tmpDir
+	if err := os.MkdirAll(tmp, 0777); err != nil {
+		return fmt.Errorf("error writing event to file %s: %s", path, err)
+	}
+	name, err := writeTempFile(tmp, path, data)
+	if err != nil {
+		return fmt.Errorf("error writing event to file %s: %s", path, err)
+	}
+	return s.publishTempFile(name, id, m)
+}
+
+// publishTempFile moves the event data in the temporary file name into the
+// stream as the event with the ID id, writing its metadata first. The publish
+// time in m is set just before the event is moved - see stamp.
+func (s *Stream) publishTempFile(name, id string, m Metadata) error {
+	path := s.Dir() + "/" + id
+	if err := s.syncData(name); err != nil {
+		os.Remove(name)
+		return fmt.Errorf("error writing event to file %s: %s", path, err)
+	}
+	// The metadata goes in next, so that it is there by the time anything
+	// sees the event. The publish time is taken after the data is synced, so
+	// that the event becomes visible well within VisibilityWindow of it.
+	if err := s.stamp(func(t time.Time) ([]string, error) {
+		m.Time = t
+		return []string{s.metadataPath(id)}, s.writeMetadata(id, m)
+	}); err != nil {
+		os.Remove(name)
+		os.Remove(s.metadataPath(id))
+		return fmt.Errorf("error writing event to file %s: %s", path, err)
+	}
+	if err := renameTempFile(name, path); err != nil {
+		return fmt.Errorf("error writing event to file %s: %s", path, err)
+	}
+	if err := s.syncDirs(s.metadataPath(id), path); err != nil {
 		return fmt.Errorf("error writing event to file %s: %s", path, err)
 	}
 
 	return nil
 }
 
+// WriteEvents writes the events in events to the stream in order, with the
+// IDs in ids and the headers in headers, which can be nil. Unlike WriteBatch,
+// each event is written on its own, and a failure to write one of them does
+// not stop the others from being written. The syncs required by the
+// durability level of the stream are shared by all of the events, so writing
+// several events at once costs about as much as writing one.
+//
+// An error is returned for each event, in the same order as events, which is
+// nil if the event was written.
+func (s *Stream) WriteEvents(ids []string, events []interface{}, headers []map[string]string) []error {
+	errs := make([]error, len(events))
+	if len(ids) != len(events) || (headers != nil && len(headers) != len(events)) {
+		for i := range errs {
+			errs[i] = errors.New("events, IDs and headers must all be the same length")
+		}
+		return errs
+	}
+	tmp := s.Dir() + "/" + tmpDir
+	if err := os.MkdirAll(tmp, 0777); err != nil {
+		for i := range errs {
+			errs[i] = fmt.Errorf("error writing event to file %s: %s", s.Dir()+"/"+ids[i], err)
+		}
+		return errs
+	}
+
+	// The event data is staged and synced first, so that the publish times can
+	// be taken as late as possible, as per publishTempFile.
+	names := make([]string, len(events))
+	var paths []string
+	for i, event := range events {
+		path := s.Dir() + "/" + ids[i]
+		data, err := s.marshalEvent(event)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			errs[i] = IDCollisionError{s: fmt.Sprintf("id collision: %s", ids[i])}
+			continue
+		}
+		if names[i], err = writeTempFile(tmp, path, data); err != nil {
+			errs[i] = fmt.Errorf("error writing event to file %s: %s", path, err)
+			continue
+		}
+		paths = append(paths, names[i])
+	}
+	// fail fails the events still being written with err.
+	fail := func(err error) []error {
+		for i, name := range names {
+			if name != "" {
+				os.Remove(name)
+				os.Remove(s.metadataPath(ids[i]))
+				names[i] = ""
+				errs[i] = fmt.Errorf("error writing event to file %s: %s", s.Dir()+"/"+ids[i], err)
+			}
+		}
+		return errs
+	}
+	if err := s.syncData(paths...); err != nil {
+		return fail(err)
+	}
+	// Each event is given its own publish time, a nanosecond after the last,
+	// so that the events are ordered one after the other.
+	if err := s.stamp(func(t time.Time) ([]string, error) {
+		var metas []string
+		for i, name := range names {
+			if name == "" {
+				continue
+			}
+			m := Metadata{Time: t.Add(time.Duration(i))}
+			if headers != nil {
+				m.Headers = headers[i]
+			}
+			if err := s.writeMetadata(ids[i], m); err != nil {
+				os.Remove(name)
+				os.Remove(s.metadataPath(ids[i]))
+				names[i] = ""
+				errs[i] = fmt.Errorf("error writing event to file %s: %s", s.Dir()+"/"+ids[i], err)
+				continue
+			}
+			metas = append(metas, s.metadataPath(ids[i]))
+		}
+		return metas, nil
+	}); err != nil {
+		return fail(err)
+	}
+
+	paths = nil
+	for i, name := range names {
+		if name == "" {
+			continue
+		}
+		path := s.Dir() + "/" + ids[i]
+		if err := renameTempFile(name, path); err != nil {
+			os.Remove(s.metadataPath(ids[i]))
+			names[i] = ""
+			errs[i] = fmt.Errorf("error writing event to file %s: %s", path, err)
+			continue
+		}
+		paths = append(paths, s.metadataPath(ids[i]), path)
+	}
+	if err := s.syncDirs(paths...); err != nil {
+		for i, name := range names {
+			if name != "" {
+				errs[i] = fmt.Errorf("error writing event to file %s: %s", s.Dir()+"/"+ids[i], err)
+			}
+		}
+	}
+	return errs
+}
+
 // Dump dumps all of the events in the store for stream described by dir and
 // event. Technically, it's just dumping all of the events in the directory.
-// The events are returned as an Event slice.
+// The events are returned as an Event slice. Events in batches that have not
+// been completely written yet are left out.
 //
 // The order of the returned events is not deterministic. If it is up to the
 // consumer to structure the data or the handling of the data in a way that
@@ -196,10 +405,23 @@ func dump(s *Stream) ([]Event, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error reading event directory %s: %s", s.Dir(), err)
 	}
+	batches := make(map[string]bool)
 	for _, f := range entries {
 		if !f.Mode().IsRegular() {
 			continue
 		}
+		m, err := s.ReadMetadata(f.Name())
+		if err != nil {
+			return nil, err
+		}
+		// Events in batches that are not complete yet are not visible.
+		ok, err := s.visible(m, batches)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
 		e, err := DecodeEvent(s.Dir()+"/"+f.Name(), s.EventType())
 		if err != nil {
 			return nil, err
@@ -212,18 +434,34 @@ func dump(s *Stream) ([]Event, error) {
 // DecodeEvent is an internal helper that decodes a file at path and returns an
 // Event.
 func DecodeEvent(path string, eventType reflect.Type) (Event, error) {
+	e, _, err := DecodeEventSum(path, eventType)
+	return e, err
+}
+
+// DecodeEventSum works as per DecodeEvent, but also returns the SHA-256 sum of
+// the raw event data, which can be used to tell if an event has been changed.
+// The sum is returned as long as the data could be read, even if it could not
+// be decoded.
+func DecodeEventSum(path string, eventType reflect.Type) (Event, [sha256.Size]byte, error) {
 	d := reflect.New(eventType)
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		return Event{}, fmt.Errorf("error reading event data at %s: %s", path, err)
+		return Event{}, [sha256.Size]byte{}, fmt.Errorf("error reading event data at %s: %s", path, err)
 	}
+	sum := sha256.Sum256(b)
 	if err := json.Unmarshal(b, d.Interface()); err != nil {
-		return Event{}, fmt.Errorf("error unmarshaling event data from %s: %s", path, err)
+		return Event{}, sum, fmt.Errorf("error unmarshaling event data from %s: %s", path, err)
+	}
+	id := filepath.Base(path)
+	m, err := readMetadata(filepath.Dir(path) + "/" + metaDir + "/" + id)
+	if err != nil {
+		return Event{}, sum, err
 	}
 	return Event{
-		ID:   filepath.Base(path),
-		Data: d.Elem().Interface(),
-	}, nil
+		ID:      id,
+		Data:    d.Elem().Interface(),
+		Headers: m.Headers,
+	}, sum, nil
 }
 
 // DumpSorted works as per Dump, but sorts the returned events according to the
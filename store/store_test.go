@@ -1,7 +1,9 @@
 package store
 
 import (
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -146,6 +148,17 @@ func TestDir(t *testing.T) {
 	}
 }
 
+func TestName(t *testing.T) {
+	expected := "TestEvent"
+	stream := &Stream{
+		dir:       "foo/bar",
+		eventType: reflect.TypeOf(TestEvent{}),
+	}
+	if expected != stream.Name() {
+		t.Fatalf("Expected %s, got %s", expected, stream.Name())
+	}
+}
+
 func TestEventType(t *testing.T) {
 	expected := reflect.TypeOf(TestEvent{})
 	stream := &Stream{
@@ -617,3 +630,141 @@ func TestFetch(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeEventSum(t *testing.T) {
+	cases := []struct {
+		Name string
+		Data string
+		Err  string
+	}{
+		{
+			Name: "basic success case",
+			Data: `{"Text":"foobar"}`,
+		},
+		{
+			Name: "undecodable data still summed",
+			Data: `{"Text":42}`,
+			Err:  "error unmarshaling event data",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "storetest")
+			defer os.RemoveAll(dir)
+			path := dir + "/event"
+			if err := ioutil.WriteFile(path, []byte(tc.Data), 0666); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			e, sum, err := DecodeEventSum(path, reflect.TypeOf(TestEvent{}))
+			switch {
+			case err != nil && tc.Err == "":
+				t.Fatalf("bad: %s", err)
+			case err == nil && tc.Err != "":
+				t.Fatal("expected error, got none")
+			case err != nil && !strings.Contains(err.Error(), tc.Err):
+				t.Fatalf("expected error to match %q, got %q", tc.Err, err)
+			}
+			if expected := sha256.Sum256([]byte(tc.Data)); sum != expected {
+				t.Fatalf("expected sum %x, got %x", expected, sum)
+			}
+			if tc.Err == "" && e.Data != (TestEvent{Text: "foobar"}) {
+				t.Fatalf("bad: %#v", e)
+			}
+		})
+	}
+}
+
+func TestWriteEventWithHeaders(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	s, err := NewStream(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	headers := map[string]string{"foo": "bar"}
+	if err := s.WriteEventWithHeaders("headers", TestEvent{Text: "foo"}, headers); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := s.WriteEvent("plain", TestEvent{Text: "bar"}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := s.WriteEventWithHeaders("bad", BadEvent{}, headers); err == nil {
+		t.Fatal("expected error, got none")
+	}
+
+	expected := []Event{
+		{ID: "headers", Data: TestEvent{Text: "foo"}, Headers: headers},
+		{ID: "plain", Data: TestEvent{Text: "bar"}},
+	}
+	for _, e := range expected {
+		actual, err := Fetch(dir, TestEvent{}, e.ID)
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		if !reflect.DeepEqual(e, actual) {
+			t.Fatalf("expected %s, got %s", spew.Sdump(e), spew.Sdump(actual))
+		}
+	}
+}
+
+func TestWriteEvents(t *testing.T) {
+	for _, d := range []Durability{DurabilityNone, DurabilitySyncDir, DurabilityGroupCommit} {
+		t.Run(fmt.Sprint(d), func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "storetest")
+			defer os.RemoveAll(dir)
+			s, err := NewStream(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			s.SetDurability(d)
+			if err := s.WriteEvent("taken", TestEvent{Text: "taken"}); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+
+			ids := []string{"c", "bad", "taken", "a", "b"}
+			events := []interface{}{TestEvent{Text: "c"}, BadEvent{Text: "bad"}, TestEvent{Text: "taken"}, TestEvent{Text: "a"}, TestEvent{Text: "b"}}
+			headers := []map[string]string{{"n": "0"}, nil, nil, {"n": "3"}, {"n": "4"}}
+			errs := s.WriteEvents(ids, events, headers)
+			if len(errs) != len(ids) {
+				t.Fatalf("expected %d errors, got %d", len(ids), len(errs))
+			}
+			for i, err := range errs {
+				switch ids[i] {
+				case "bad":
+					if err == nil || !strings.Contains(err.Error(), "does not match stream type") {
+						t.Fatalf("expected type mismatch for %s, got %v", ids[i], err)
+					}
+				case "taken":
+					if _, ok := err.(IDCollisionError); !ok {
+						t.Fatalf("expected IDCollisionError for %s, got %v", ids[i], err)
+					}
+				default:
+					if err != nil {
+						t.Fatalf("bad: %s: %s", ids[i], err)
+					}
+				}
+			}
+
+			// The events written are ordered as they were passed in, after the
+			// event that was already there.
+			got, _, err := s.EventIDsAfter(Checkpoint{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if expected := []string{"taken", "c", "a", "b"}; !reflect.DeepEqual(expected, got) {
+				t.Fatalf("expected %q, got %q", expected, got)
+			}
+			m, err := s.ReadMetadata("a")
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if m.Headers["n"] != "3" {
+				t.Fatalf("expected headers for a, got %#v", m.Headers)
+			}
+			if _, err := os.Stat(s.metadataPath("bad")); !os.IsNotExist(err) {
+				t.Fatalf("expected no metadata for bad event, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Topic wildcards. A single-level wildcard matches exactly one segment of a
+// topic, and a multi-level wildcard matches one or more segments at the end of
+// a topic.
+const (
+	SingleLevelWildcard = "*"
+	MultiLevelWildcard  = ">"
+)
+
+// topicSeparator separates the segments of a topic.
+const topicSeparator = "."
+
+// topicsDir is the name of the directory, relative to the base directory,
+// that topic streams are kept in. Keeping them apart from the streams named
+// after event types stops those streams from being taken for topics.
+const topicsDir = ".topics"
+
+// validTopic checks a topic, or a topic pattern if pattern is true.
+//
+// Topics are made up of one or more segments separated by dots, such as
+// "orders.eu.created". Each segment maps to a directory, so segments cannot be
+// empty or contain a path separator. Wildcards are only
+// allowed in patterns, as whole segments, with a multi-level wildcard only
+// allowed as the last segment.
+func validTopic(topic string, pattern bool) error {
+	if topic == "" {
+		return errors.New("topic cannot be empty")
+	}
+	segs := strings.Split(topic, topicSeparator)
+	for i, seg := range segs {
+		switch {
+		case seg == "":
+			return fmt.Errorf("topic %q cannot have an empty segment", topic)
+		case strings.ContainsRune(seg, os.PathSeparator):
+			return fmt.Errorf("topic %q cannot contain a path separator", topic)
+		case pattern && seg == SingleLevelWildcard:
+		case pattern && seg == MultiLevelWildcard:
+			if i != len(segs)-1 {
+				return fmt.Errorf("topic pattern %q can only have %s as the last segment", topic, MultiLevelWildcard)
+			}
+		case strings.ContainsAny(seg, SingleLevelWildcard+MultiLevelWildcard):
+			if !pattern {
+				return fmt.Errorf("topic %q cannot contain wildcards", topic)
+			}
+			return fmt.Errorf("topic pattern %q can only use wildcards as whole segments", topic)
+		}
+	}
+	return nil
+}
+
+// ValidTopicPattern returns an error if pattern is not a valid topic pattern.
+func ValidTopicPattern(pattern string) error {
+	return validTopic(pattern, true)
+}
+
+// TopicsDir returns the directory topic streams are kept in, in the base
+// directory dir.
+func TopicsDir(dir string) string {
+	return filepath.Clean(dir) + "/" + topicsDir
+}
+
+// TopicDir returns the directory for topic in the base directory dir. Each
+// segment of the topic is a level of directory under TopicsDir - the
+// directory for "orders.eu.created" is dir/.topics/orders/eu/created.
+func TopicDir(dir, topic string) string {
+	return TopicsDir(dir) + "/" + strings.Replace(topic, topicSeparator, "/", -1)
+}
+
+// NewTopicStream creates a stream for the topic in the base directory dir,
+// carrying events of the specific type. The stream's directory, and any parent
+// directories, are created if they do not exist.
+//
+// Topic streams are kept in nested directories, rather than a directory named
+// for the event type, so the events for a topic must all be of the same type.
+// Topic directories can hold both events and the directories of the topics
+// below them.
+func NewTopicStream(dir, topic string, event interface{}) (*Stream, error) {
+	if event == nil {
+		return nil, errors.New("event cannot be nil")
+	}
+	if err := validTopic(topic, false); err != nil {
+		return nil, err
+	}
+	s := &Stream{
+		dir:       TopicDir(dir, topic),
+		eventType: reflect.TypeOf(event),
+		name:      topic,
+	}
+	if err := os.MkdirAll(s.dir, 0777); err != nil {
+		return nil, fmt.Errorf("cannot create directory %s: %s", s.dir, err)
+	}
+	return s, nil
+}
+
+// MatchTopic returns true if topic matches pattern.
+func MatchTopic(pattern, topic string) bool {
+	p := strings.Split(pattern, topicSeparator)
+	t := strings.Split(topic, topicSeparator)
+	if len(t) < len(p) {
+		return false
+	}
+	return matchSegments(p, t) && (len(p) == len(t) || p[len(p)-1] == MultiLevelWildcard)
+}
+
+// matchSegments returns true if the segments in t match the start of the
+// pattern p, meaning that t or a topic below it can match p.
+func matchSegments(p, t []string) bool {
+	for i := range t {
+		if i >= len(p) {
+			return false
+		}
+		switch p[i] {
+		case MultiLevelWildcard:
+			return true
+		case SingleLevelWildcard:
+		default:
+			if p[i] != t[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Topics returns the topics in the base directory dir that match pattern, in
+// sorted order. A topic exists once its directory has been created, whether or
+// not any events have been published to it.
+func Topics(dir, pattern string) ([]string, error) {
+	topics, _, err := walkTopics(dir, pattern)
+	return topics, err
+}
+
+// TopicParents returns the directories in the base directory dir that new
+// topics matching pattern can be created in - TopicsDir, and the directories
+// of existing topics with room below them for a match. Watching these
+// directories for new subdirectories is enough to find new matching topics.
+func TopicParents(dir, pattern string) ([]string, error) {
+	_, parents, err := walkTopics(dir, pattern)
+	return parents, err
+}
+
+// walkTopics walks the topics in the base directory dir, returning the
+// topics that match pattern and the directories matching topics can be
+// created in, in sorted order.
+func walkTopics(dir, pattern string) ([]string, []string, error) {
+	if err := validTopic(pattern, true); err != nil {
+		return nil, nil, err
+	}
+	w := topicWalker{pattern: strings.Split(pattern, topicSeparator)}
+	root := TopicsDir(dir)
+	if _, err := os.Stat(root); err == nil {
+		w.parents = append(w.parents, root)
+	}
+	if err := w.walk(root, nil); err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(w.topics)
+	sort.Strings(w.parents)
+	return w.topics, w.parents, nil
+}
+
+// topicWalker collects the topics matching a pattern, and the directories
+// matching topics can be created in.
+type topicWalker struct {
+	// The segments of the pattern.
+	pattern []string
+
+	// The topics and directories found.
+	topics  []string
+	parents []string
+}
+
+// walk walks the topics below the directory path. t holds the segments of the
+// topic for path.
+func (w *topicWalker) walk(path string, t []string) error {
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error reading directory %s: %s", path, err)
+	}
+	p := w.pattern
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		child := append(append([]string{}, t...), e.Name())
+		if !matchSegments(p, child) {
+			continue
+		}
+		topic := strings.Join(child, topicSeparator)
+		if MatchTopic(strings.Join(p, topicSeparator), topic) {
+			w.topics = append(w.topics, topic)
+		}
+		if len(child) < len(p) || p[len(p)-1] == MultiLevelWildcard {
+			w.parents = append(w.parents, path+"/"+e.Name())
+		}
+		if err := w.walk(path+"/"+e.Name(), child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
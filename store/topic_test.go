@@ -0,0 +1,161 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestNewTopicStream(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Topic string
+		Err   bool
+	}{
+		{Name: "single segment", Topic: "orders"},
+		{Name: "nested", Topic: "orders.eu.created"},
+		{Name: "empty", Topic: "", Err: true},
+		{Name: "empty segment", Topic: "orders..created", Err: true},
+		{Name: "path separator", Topic: "orders/eu", Err: true},
+		{Name: "wildcard", Topic: "orders.*.created", Err: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "storetest")
+			defer os.RemoveAll(dir)
+			s, err := NewTopicStream(dir, tc.Topic, TestEvent{})
+			if tc.Err {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if expected := TopicDir(dir, tc.Topic); s.Dir() != expected {
+				t.Fatalf("expected dir %s, got %s", expected, s.Dir())
+			}
+			if s.Name() != tc.Topic {
+				t.Fatalf("expected name %s, got %s", tc.Topic, s.Name())
+			}
+			if fi, err := os.Stat(s.Dir()); err != nil || !fi.IsDir() {
+				t.Fatalf("expected directory %s to exist, got %v", s.Dir(), err)
+			}
+		})
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		Pattern  string
+		Topic    string
+		Expected bool
+	}{
+		{Pattern: "orders.eu.created", Topic: "orders.eu.created", Expected: true},
+		{Pattern: "orders.eu.created", Topic: "orders.us.created", Expected: false},
+		{Pattern: "orders.*.created", Topic: "orders.eu.created", Expected: true},
+		{Pattern: "orders.*.created", Topic: "orders.eu.shipped", Expected: false},
+		{Pattern: "orders.*", Topic: "orders.eu.created", Expected: false},
+		{Pattern: "orders.*", Topic: "orders", Expected: false},
+		{Pattern: "orders.>", Topic: "orders.eu", Expected: true},
+		{Pattern: "orders.>", Topic: "orders.eu.created", Expected: true},
+		{Pattern: "orders.>", Topic: "orders", Expected: false},
+		{Pattern: ">", Topic: "payments.received", Expected: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Pattern+" "+tc.Topic, func(t *testing.T) {
+			if actual := MatchTopic(tc.Pattern, tc.Topic); actual != tc.Expected {
+				t.Fatalf("expected %t, got %t", tc.Expected, actual)
+			}
+		})
+	}
+}
+
+func TestTopics(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	for _, topic := range []string{"orders.eu.created", "orders.us.created", "orders.us.shipped", "payments"} {
+		s, err := NewTopicStream(dir, topic, TestEvent{})
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		// Metadata directories are not topics.
+		if err := os.MkdirAll(s.Dir()+"/"+tmpDir, 0777); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+	// Streams named after event types are not topics.
+	if _, err := NewStream(dir, TestEvent{}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	cases := []struct {
+		Pattern  string
+		Expected []string
+	}{
+		{Pattern: ">", Expected: []string{"orders", "orders.eu", "orders.eu.created", "orders.us", "orders.us.created", "orders.us.shipped", "payments"}},
+		{Pattern: "orders.*.created", Expected: []string{"orders.eu.created", "orders.us.created"}},
+		{Pattern: "orders.us.*", Expected: []string{"orders.us.created", "orders.us.shipped"}},
+		{Pattern: "orders.>", Expected: []string{"orders.eu", "orders.eu.created", "orders.us", "orders.us.created", "orders.us.shipped"}},
+		{Pattern: "payments", Expected: []string{"payments"}},
+		{Pattern: "refunds.*", Expected: nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Pattern, func(t *testing.T) {
+			actual, err := Topics(dir, tc.Pattern)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if !reflect.DeepEqual(tc.Expected, actual) {
+				t.Fatalf("expected %q, got %q", tc.Expected, actual)
+			}
+		})
+	}
+
+	if _, err := Topics(dir, "orders.>.created"); err == nil {
+		t.Fatal("expected error for bad pattern, got none")
+	}
+}
+
+func TestTopicParents(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storetest")
+	defer os.RemoveAll(dir)
+	for _, topic := range []string{"orders.eu.created", "orders.us", "payments"} {
+		if _, err := NewTopicStream(dir, topic, TestEvent{}); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+
+	cases := []struct {
+		Pattern  string
+		Expected []string
+	}{
+		{Pattern: "orders.*.created", Expected: []string{"", "orders", "orders.eu", "orders.us"}},
+		{Pattern: "orders.*", Expected: []string{"", "orders"}},
+		{Pattern: "orders.>", Expected: []string{"", "orders", "orders.eu", "orders.eu.created", "orders.us"}},
+		{Pattern: "payments", Expected: []string{""}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Pattern, func(t *testing.T) {
+			actual, err := TopicParents(dir, tc.Pattern)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			var expected []string
+			for _, topic := range tc.Expected {
+				if topic == "" {
+					expected = append(expected, TopicsDir(dir))
+					continue
+				}
+				expected = append(expected, TopicDir(dir, topic))
+			}
+			if !reflect.DeepEqual(expected, actual) {
+				t.Fatalf("expected %q, got %q", expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Validator is implemented by event types that can check their own data.
+type Validator interface {
+	Validate() error
+}
+
+// ValidationError is the error returned when an event fails its own
+// validation.
+type ValidationError struct {
+	// The error returned by the event's Validate method.
+	Err error
+}
+
+// Error implements error for ValidationError.
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("invalid event: %s", e.Err)
+}
+
+// Validate calls the Validate method of event, if it implements Validator,
+// with either a value or a pointer receiver. A ValidationError is returned if
+// the event is invalid. Events that do not implement Validator are always
+// valid.
+func Validate(event interface{}) error {
+	v, ok := event.(Validator)
+	if !ok && event != nil {
+		p := reflect.New(reflect.TypeOf(event))
+		p.Elem().Set(reflect.ValueOf(event))
+		v, ok = p.Interface().(Validator)
+	}
+	if !ok {
+		return nil
+	}
+	if err := v.Validate(); err != nil {
+		return ValidationError{Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type valueValidatedEvent struct {
+	Text string
+}
+
+func (e valueValidatedEvent) Validate() error {
+	if e.Text == "" {
+		return errors.New("text cannot be empty")
+	}
+	return nil
+}
+
+type pointerValidatedEvent struct {
+	Text string
+}
+
+func (e *pointerValidatedEvent) Validate() error {
+	if e.Text == "" {
+		return errors.New("text cannot be empty")
+	}
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Event interface{}
+		Err   string
+	}{
+		{
+			Name:  "not a validator",
+			Event: TestEvent{},
+		},
+		{
+			Name:  "valid value receiver",
+			Event: valueValidatedEvent{Text: "foo"},
+		},
+		{
+			Name:  "invalid value receiver",
+			Event: valueValidatedEvent{},
+			Err:   "invalid event: text cannot be empty",
+		},
+		{
+			Name:  "invalid pointer receiver",
+			Event: pointerValidatedEvent{},
+			Err:   "invalid event: text cannot be empty",
+		},
+		{
+			Name:  "invalid pointer",
+			Event: &pointerValidatedEvent{},
+			Err:   "invalid event: text cannot be empty",
+		},
+		{
+			Name: "nil event",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := Validate(tc.Event)
+			switch {
+			case err != nil && tc.Err == "":
+				t.Fatalf("bad: %s", err)
+			case err == nil && tc.Err != "":
+				t.Fatal("expected error, got none")
+			case err != nil && tc.Err != "":
+				if !strings.Contains(err.Error(), tc.Err) {
+					t.Fatalf("expected error to match %q, got %q", tc.Err, err)
+				}
+				if _, ok := err.(ValidationError); !ok {
+					t.Fatalf("expected ValidationError, got %T", err)
+				}
+			}
+		})
+	}
+}
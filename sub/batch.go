@@ -0,0 +1,187 @@
+package sub
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+// Batcher groups the events from a source into batches. A batch is emitted
+// once it holds the maximum number of events, or once the maximum linger time
+// has passed since its first event arrived, whichever comes first. Events
+// keep the order they were received in within a batch.
+type Batcher struct {
+	// The source of the events.
+	src Source
+
+	// The maximum number of events in a batch.
+	size int
+
+	// The maximum amount of time a batch is held for before being emitted.
+	linger time.Duration
+
+	// The internal batch channel. Call Batches to get a valid one-way batch
+	// channel.
+	batches chan []store.Event
+
+	// The internal completion channel. Call Done to get a valid one-way
+	// completion channel.
+	done chan struct{}
+
+	// Closed when the batcher is closed, so that emitting a batch no one is
+	// reading does not block forever.
+	stop chan struct{}
+
+	// Makes sure stop and the source are only closed once.
+	once sync.Once
+}
+
+// NewBatcher starts batching the events from src, into batches of up to size
+// events, held for no longer than linger.
+//
+// The batcher owns src from this point on - it closes src when the batcher is
+// closed, and shuts down when src terminates. Use the batcher's Done and Error
+// functions in place of the source's.
+func NewBatcher(src Source, size int, linger time.Duration) (*Batcher, error) {
+	if size < 1 {
+		return nil, errors.New("batch size must be at least 1")
+	}
+	if linger <= 0 {
+		return nil, errors.New("linger time must be greater than zero")
+	}
+	b := &Batcher{
+		src:     src,
+		size:    size,
+		linger:  linger,
+		batches: make(chan []store.Event),
+		done:    make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+	go b.run()
+	return b, nil
+}
+
+// run collects events into batches until the source terminates, then flushes
+// the final batch. Once a batch has been dropped, the batcher shuts down
+// without emitting any more.
+func (b *Batcher) run() {
+	defer close(b.done)
+	defer close(b.batches)
+	var batch []store.Event
+	var timer *time.Timer
+	var linger <-chan time.Time
+	dropped := false
+	flush := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, linger = nil, nil
+		}
+		if len(batch) > 0 && !dropped {
+			dropped = !b.emit(batch)
+		}
+		batch = nil
+	}
+	add := func(e store.Event) {
+		batch = append(batch, e)
+		if len(batch) == 1 {
+			timer = time.NewTimer(b.linger)
+			linger = timer.C
+		}
+		if len(batch) >= b.size {
+			flush()
+		}
+	}
+
+	for {
+		select {
+		case e := <-b.src.Queue():
+			add(e)
+		case <-linger:
+			flush()
+		case <-b.src.Done():
+			// Pick up anything the source left in its queue.
+			for {
+				select {
+				case e := <-b.src.Queue():
+					add(e)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// emit sends batch on the batch channel. Once the batcher has been closed, the
+// batch is only waited on for up to the linger time, and false is returned if
+// it was not read by then.
+func (b *Batcher) emit(batch []store.Event) bool {
+	select {
+	case b.batches <- batch:
+		return true
+	case <-b.stop:
+	}
+	t := time.NewTimer(b.linger)
+	defer t.Stop()
+	select {
+	case b.batches <- batch:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// Batches returns the batch channel. The channel is closed once the batcher
+// has shut down and the final batch has been emitted, so keep reading until
+// then to receive every batch.
+func (b *Batcher) Batches() <-chan []store.Event {
+	return b.batches
+}
+
+// Done returns a channel that closes once the batcher has shut down and the
+// final batch has been read, or dropped as described in Close.
+func (b *Batcher) Done() <-chan struct{} {
+	return b.done
+}
+
+// Error returns the reason the source terminated, if it was for any reason
+// other than the batcher being closed. Make sure to block on done before
+// checking this value.
+func (b *Batcher) Error() error {
+	return b.src.Error()
+}
+
+// Ack acknowledges each of the events in batch with the source, in order. See
+// Subscriber.Ack for details.
+func (b *Batcher) Ack(batch []store.Event) error {
+	a, ok := b.src.(acker)
+	if !ok {
+		return errors.New("source does not support acknowledgements")
+	}
+	for _, e := range batch {
+		if err := a.Ack(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the source. Any events that have not been emitted yet are
+// flushed as a final, possibly partial, batch on the channel returned by
+// Batches, which is closed afterwards. Close does not wait for the final batch
+// to be read.
+//
+// Once the batcher is closed, each batch is only held for up to the linger
+// time waiting to be read. If it is not read by then, it is dropped along with
+// any events still to come, and the batcher shuts down. Dropped events are not
+// acknowledged, so sources that redeliver unacknowledged events, such as
+// durable subscribers, deliver them again when they are next started.
+func (b *Batcher) Close() {
+	b.once.Do(func() {
+		close(b.stop)
+		b.src.Close()
+	})
+}
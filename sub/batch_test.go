@@ -0,0 +1,140 @@
+package sub
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+// readBatches reads batches until the channel is closed, returning the event
+// IDs in each.
+func readBatches(t *testing.T, b *Batcher) [][]string {
+	var batches [][]string
+	timeout := time.After(time.Second * 2)
+	for {
+		select {
+		case batch, ok := <-b.Batches():
+			if !ok {
+				return batches
+			}
+			var ids []string
+			for _, e := range batch {
+				ids = append(ids, e.ID)
+			}
+			batches = append(batches, ids)
+		case <-timeout:
+			t.Errorf("timed out waiting for batches, got %q", batches)
+			return batches
+		}
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Size     int
+		Linger   time.Duration
+		Pause    time.Duration
+		Expected [][]string
+	}{
+		{
+			Name:     "size",
+			Size:     2,
+			Linger:   time.Minute,
+			Expected: [][]string{{"1", "2"}, {"3", "4"}, {"5"}},
+		},
+		{
+			Name:     "linger",
+			Size:     10,
+			Linger:   time.Millisecond * 50,
+			Pause:    time.Millisecond * 150,
+			Expected: [][]string{{"1", "2", "3"}, {"4", "5"}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			src := newTestSource()
+			b, err := NewBatcher(src, tc.Size, tc.Linger)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			done := make(chan [][]string)
+			go func() { done <- readBatches(t, b) }()
+			src.send(t, "1", "2", "3")
+			time.Sleep(tc.Pause)
+			src.send(t, "4", "5")
+			// The final batch is flushed on Close.
+			b.Close()
+			if actual := <-done; !reflect.DeepEqual(tc.Expected, actual) {
+				t.Fatalf("expected %q, got %q", tc.Expected, actual)
+			}
+			<-b.Done()
+		})
+	}
+}
+
+func TestBatcherAck(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	s, err := NewSubscriber(dir, TestEvent{}, Durable("consumer"))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	b, err := NewBatcher(s, 3, time.Minute)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer b.Close()
+	publishTexts(t, dir, "1", "2", "3")
+	var batch []store.Event
+	select {
+	case batch = <-b.Batches():
+	case <-time.After(time.Second * 2):
+		t.Fatal("timed out waiting for batch")
+	}
+	if len(batch) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(batch))
+	}
+	if err := b.Ack(batch); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	c, err := s.ReadCheckpoint("consumer")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	events, _, err := s.EventsAfter(c)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("expected all events to be acknowledged, got %d left", len(events))
+	}
+
+	if err := (&Batcher{src: newTestSource()}).Ack(batch); err == nil {
+		t.Fatal("expected error acknowledging with a source that does not support it, got none")
+	}
+}
+
+func TestBatcherCloseUnread(t *testing.T) {
+	src := newTestSource()
+	b, err := NewBatcher(src, 10, time.Millisecond*50)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	src.send(t, "1", "2", "3")
+	// Nothing reads the final batch, so it is dropped after the linger time.
+	b.Close()
+	select {
+	case <-b.Done():
+	case <-time.After(time.Second * 2):
+		t.Fatal("timed out waiting for the batcher to shut down")
+	}
+	if batch, ok := <-b.Batches(); ok {
+		t.Fatalf("expected batch channel to be closed, got %v", batch)
+	}
+}
@@ -0,0 +1,76 @@
+package sub
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+// DedupWindow sets the amount of time the subscriber remembers delivered
+// events for. Repeated notifications for an event within this window, such as
+// those raised when an event file is opened for writing and closed again, are
+// suppressed. The default is one minute.
+//
+// Notifications for events published within store.VisibilityWindow of the
+// newest event the subscriber has handled are always suppressed, even outside
+// this window, so that an event recovered by a resync is not delivered again
+// when its original notification arrives late.
+func DedupWindow(d time.Duration) Option {
+	return func(s *Subscriber) error {
+		if d <= 0 {
+			return errors.New("dedup window must be greater than zero")
+		}
+		s.tracker = newTracker(d)
+		return nil
+	}
+}
+
+// OnModified sets a handler for events that are rewritten in place after being
+// delivered. The handler is passed the event as it now reads, and the event is
+// not sent to the queue again. The handler is called from the subscription
+// goroutine, so it should not block.
+//
+// Modifications are only detected within the dedup window, and are ignored if
+// no handler is set.
+func OnModified(f func(store.Event)) Option {
+	return func(s *Subscriber) error {
+		s.onModified = f
+		return nil
+	}
+}
+
+// duplicate handles a repeated notification for the already delivered event
+// with the supplied ID. If a modification handler is set, the event is read
+// again, and passed to the handler if its data has changed since it was
+// delivered. Events skipped by a header filter are not read again.
+//
+// false is returned if the subscription was terminated, along with the
+// reason.
+func (s *Subscriber) duplicate(id string) (bool, error) {
+	if s.onModified == nil {
+		atomic.AddUint64(&s.stats.Duplicates, 1)
+		return true, nil
+	}
+	t, _ := s.tracker.get(id)
+	if t.skipped {
+		atomic.AddUint64(&s.stats.Duplicates, 1)
+		return true, nil
+	}
+	e, sum, err := store.DecodeEventSum(s.Stream.Dir()+"/"+id, s.Stream.EventType())
+	if sum == t.sum {
+		atomic.AddUint64(&s.stats.Duplicates, 1)
+		return true, nil
+	}
+	s.tracker.record(id, sum)
+	if err != nil {
+		// Events that are removed, or rewritten into something that cannot be
+		// decoded, are not passed to the handler.
+		s.report(err)
+		return true, nil
+	}
+	atomic.AddUint64(&s.stats.Modified, 1)
+	s.onModified(e)
+	return true, nil
+}
@@ -0,0 +1,155 @@
+package sub
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/pub"
+	"github.com/vancluever/fspubsub/store"
+)
+
+func TestDedup(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Window    time.Duration
+		Rewrite   bool
+		Handler   bool
+		Queued    bool
+		Modified  bool
+		Duplicate bool
+	}{
+		{
+			Name:      "touched",
+			Duplicate: true,
+		},
+		{
+			Name:      "touched with handler",
+			Handler:   true,
+			Duplicate: true,
+		},
+		{
+			Name:      "rewritten without handler",
+			Rewrite:   true,
+			Duplicate: true,
+		},
+		{
+			Name:     "rewritten with handler",
+			Rewrite:  true,
+			Handler:  true,
+			Modified: true,
+		},
+		{
+			Name:   "outside window",
+			Window: time.Millisecond * 50,
+			Queued: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "subtest")
+			defer os.RemoveAll(dir)
+			var mu sync.Mutex
+			var modified []store.Event
+			opts := []Option{OnError(func(err error) { t.Errorf("unexpected error: %s", err) })}
+			if tc.Window > 0 {
+				opts = append(opts, DedupWindow(tc.Window))
+			}
+			if tc.Handler {
+				opts = append(opts, OnModified(func(e store.Event) {
+					mu.Lock()
+					defer mu.Unlock()
+					modified = append(modified, e)
+				}))
+			}
+			s, err := NewSubscriber(dir, TestEvent{}, opts...)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			defer s.Close()
+			p, err := pub.NewPublisher(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			id, err := p.Publish(TestEvent{Text: "original"})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if _, err := receive(s, 1); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if tc.Window > 0 {
+				// Events near the newest handled are remembered past the dedup
+				// window, so a newer event is needed to move the window on.
+				time.Sleep(tc.Window*2 + store.VisibilityWindow)
+				if _, err := p.Publish(TestEvent{Text: "newer"}); err != nil {
+					t.Fatalf("bad: %s", err)
+				}
+				if _, err := receive(s, 1); err != nil {
+					t.Fatalf("bad: %s", err)
+				}
+			}
+
+			path := dir + "/TestEvent/" + id
+			if tc.Rewrite {
+				if err := ioutil.WriteFile(path, []byte(`{"Text":"rewritten"}`), 0666); err != nil {
+					t.Fatalf("bad: %s", err)
+				}
+			} else {
+				f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+				if err != nil {
+					t.Fatalf("bad: %s", err)
+				}
+				f.Close()
+			}
+
+			timeout := time.After(time.Second * 2)
+		wait:
+			for {
+				stats := s.Stats()
+				switch {
+				case stats.Duplicates > 0, stats.Modified > 0, len(s.Queue()) > 0:
+					break wait
+				}
+				select {
+				case <-timeout:
+					t.Fatalf("timed out waiting for the notification to be handled")
+				case <-time.After(time.Millisecond * 10):
+				}
+			}
+
+			stats := s.Stats()
+			if (stats.Duplicates > 0) != tc.Duplicate {
+				t.Fatalf("expected duplicate %t, got %#v", tc.Duplicate, stats)
+			}
+			if (stats.Modified > 0) != tc.Modified {
+				t.Fatalf("expected modified %t, got %#v", tc.Modified, stats)
+			}
+			if (len(s.Queue()) > 0) != tc.Queued {
+				t.Fatalf("expected queued %t, got %d events", tc.Queued, len(s.Queue()))
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if tc.Modified {
+				expected := []store.Event{{ID: id, Data: TestEvent{Text: "rewritten"}}}
+				if !reflect.DeepEqual(expected, modified) {
+					t.Fatalf("expected modified events %#v, got %#v", expected, modified)
+				}
+			} else if len(modified) > 0 {
+				t.Fatalf("unexpected modified events: %#v", modified)
+			}
+		})
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	if _, err := NewSubscriber(dir, TestEvent{}, DedupWindow(0)); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,130 @@
+package sub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+// durable holds the state for a durable consumer.
+type durable struct {
+	// The name of the consumer. This is used as the name of the checkpoint
+	// file.
+	name string
+
+	// Protects checkpoint.
+	mu sync.Mutex
+
+	// The last acknowledged position, as persisted to the stream.
+	checkpoint store.Checkpoint
+
+	// The events delivered in at-least-once mode that have not been
+	// acknowledged yet. The checkpoint is held back before the oldest of
+	// these, so that they are delivered again after a restart.
+	pending map[string]time.Time
+
+	// The events acknowledged after the oldest pending event, waiting for the
+	// checkpoint to move past them.
+	held []position
+}
+
+// position is the position of an event in the stream.
+type position struct {
+	id   string
+	time time.Time
+}
+
+// before returns true if p is before o in stream order.
+func (p position) before(o position) bool {
+	if p.time.Equal(o.time) {
+		return p.id < o.id
+	}
+	return p.time.Before(o.time)
+}
+
+// Durable makes the subscriber a durable consumer with the supplied name.
+//
+// The position of a durable consumer is persisted alongside the stream each
+// time an event is acknowledged with Ack. When a durable subscriber is
+// started, it first replays any events in the stream published after its last
+// acknowledged position, in the order they were published, before moving on to
+// live events. A consumer with no acknowledged events starts from the position
+// set with StartAt, or replays the whole stream if none has been set.
+//
+// Acknowledgements are expected to be made in the order the events were
+// received - acknowledging an event also acknowledges any event written
+// before it. In at-least-once mode, the checkpoint is instead held back before
+// the oldest event that has been delivered but not acknowledged, so that it
+// is delivered again if the consumer restarts.
+func Durable(name string) Option {
+	return func(s *Subscriber) error {
+		c, err := s.Stream.ReadCheckpoint(name)
+		if err != nil {
+			return err
+		}
+		s.durable = &durable{
+			name:       name,
+			checkpoint: c,
+			pending:    make(map[string]time.Time),
+		}
+		return nil
+	}
+}
+
+// track records the event e as delivered but not acknowledged.
+func (d *durable) track(st *store.Stream, e store.Event) error {
+	t, err := st.EventTime(e.ID)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending[e.ID] = t
+	return nil
+}
+
+// ack moves the consumer's checkpoint forward to the event e, persisting it
+// to the stream. If there are older events still pending, the checkpoint only
+// moves up to the oldest of them, and e is held until it has been
+// acknowledged.
+func (d *durable) ack(st *store.Stream, e store.Event) error {
+	t, err := st.EventTime(e.ID)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.pending, e.ID)
+	d.held = append(d.held, position{id: e.ID, time: t})
+	var oldest *position
+	for id, t := range d.pending {
+		p := position{id: id, time: t}
+		if oldest == nil || p.before(*oldest) {
+			oldest = &p
+		}
+	}
+	c := d.checkpoint
+	var held []position
+	advanced := false
+	for _, p := range d.held {
+		if oldest != nil && oldest.before(p) {
+			held = append(held, p)
+			continue
+		}
+		if !c.Covers(p.id, p.time) {
+			c = c.Advance(p.id, p.time)
+			advanced = true
+		}
+	}
+	d.held = held
+	if !advanced {
+		return nil
+	}
+	if err := st.WriteCheckpoint(d.name, c); err != nil {
+		return err
+	}
+	d.checkpoint = c
+	return nil
+}
@@ -0,0 +1,193 @@
+package sub
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/pub"
+	"github.com/vancluever/fspubsub/store"
+)
+
+// receive reads n events from the source's queue, failing if they do not
+// arrive within a couple of seconds.
+func receive(s Source, n int) ([]store.Event, error) {
+	var es []store.Event
+	timeout := time.After(time.Second * 2)
+	for len(es) < n {
+		select {
+		case e := <-s.Queue():
+			es = append(es, e)
+		case <-s.Done():
+			return es, s.Error()
+		case <-timeout:
+			return es, errors.New("timed out waiting for events")
+		}
+	}
+	return es, nil
+}
+
+// eventTexts returns the sorted text of a TestEvent slice.
+func eventTexts(es []store.Event) []string {
+	var ts []string
+	for _, e := range es {
+		ts = append(ts, e.Data.(TestEvent).Text)
+	}
+	sort.Strings(ts)
+	return ts
+}
+
+func TestDurable(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	p, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	for _, text := range []string{"foo", "bar"} {
+		if _, err := p.Publish(TestEvent{Text: text}); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+
+	// The first run should replay everything.
+	s, err := NewSubscriber(dir, TestEvent{}, Durable("consumer"))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	es, err := receive(s, 2)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if expected, actual := []string{"bar", "foo"}, eventTexts(es); !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+	if err := s.Ack(es[0]); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	s.Close()
+	<-s.Done()
+
+	// Publish an event while the consumer is down.
+	if _, err := p.Publish(TestEvent{Text: "baz"}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// The second run should resume after the acknowledged event, and then pick
+	// up live events.
+	s, err = NewSubscriber(dir, TestEvent{}, Durable("consumer"))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer s.Close()
+	replayed, err := receive(s, 2)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	expected := []string{es[1].Data.(TestEvent).Text, "baz"}
+	sort.Strings(expected)
+	if actual := eventTexts(replayed); !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+	if _, err := p.Publish(TestEvent{Text: "qux"}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	live, err := receive(s, 1)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if expected, actual := []string{"qux"}, eventTexts(live); !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestAckNotDurable(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	s, err := NewSubscriber(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer s.Close()
+	err = s.Ack(store.Event{ID: "foo"})
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if !strings.Contains(err.Error(), "not a durable consumer") {
+		t.Fatalf("expected error to match %q, got %q", "not a durable consumer", err)
+	}
+}
+
+func TestDurableAtLeastOnce(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	p, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	var ids []string
+	for _, text := range []string{"foo", "bar"} {
+		id, err := p.Publish(TestEvent{Text: text})
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		ids = append(ids, id)
+	}
+
+	// Acknowledging the second event must not move the checkpoint past the
+	// first, which is still pending.
+	s, err := NewSubscriber(dir, TestEvent{}, Durable("consumer"), AtLeastOnce(time.Minute, 0))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	es, err := receive(s, 2)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if es[0].ID != ids[0] || es[1].ID != ids[1] {
+		t.Fatalf("expected %q in order, got %#v", ids, es)
+	}
+	if err := s.Ack(es[1]); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	s.Close()
+
+	// Both are delivered again after a restart. Once the first is
+	// acknowledged, the checkpoint covers both.
+	s, err = NewSubscriber(dir, TestEvent{}, Durable("consumer"), AtLeastOnce(time.Minute, 0))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	es, err = receive(s, 2)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if es[0].ID != ids[0] || es[1].ID != ids[1] {
+		t.Fatalf("expected %q in order, got %#v", ids, es)
+	}
+	if err := s.Ack(es[1]); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := s.Ack(es[0]); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	s.Close()
+	c, err := s.Stream.ReadCheckpoint("consumer")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	for _, id := range ids {
+		tt, err := s.Stream.EventTime(id)
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		if !c.Covers(id, tt) {
+			t.Fatalf("expected checkpoint to cover %s", id)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package sub
+
+import (
+	"sync/atomic"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+// Filter adds a predicate that decides which events are delivered. Events for
+// which f returns false are skipped and never show up on the queue. When more
+// than one filter is added, an event must pass all of them.
+//
+// Filters are applied after decoding, on the subscription goroutine. Members
+// of a consumer group complete the claims for events they filter out, so that
+// they are not handed to another member. Skipped events are counted in Stats.
+func Filter(f func(store.Event) bool) Option {
+	return func(s *Subscriber) error {
+		s.filters = append(s.filters, f)
+		return nil
+	}
+}
+
+// filtered returns true if the event e should be skipped.
+func (s *Subscriber) filtered(e store.Event) bool {
+	for _, f := range s.filters {
+		if !f(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// HeaderFilter adds a predicate over the metadata of events, including the
+// headers they were published with, that decides which events are delivered.
+// Header filters are applied before the event data is read, so events that are
+// skipped are never decoded - this makes them cheaper than Filter for
+// subscribers that only want a small part of a busy stream. Events that were
+// published without metadata have zero Metadata.
+//
+// Header filters are otherwise treated the same as filters added with Filter.
+// Events whose metadata cannot be read are handled according to the poison
+// event policy.
+func HeaderFilter(f func(store.Metadata) bool) Option {
+	return func(s *Subscriber) error {
+		s.headerFilters = append(s.headerFilters, f)
+		return nil
+	}
+}
+
+// headerFiltered returns true if the event with the supplied ID should be
+// skipped based on its metadata. The metadata is only read if there are
+// header filters.
+func (s *Subscriber) headerFiltered(id string) (bool, error) {
+	if len(s.headerFilters) == 0 {
+		return false, nil
+	}
+	m, err := s.Stream.ReadMetadata(id)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range s.headerFilters {
+		if !f(m) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// skip skips the event e, which has been filtered out. Members of a consumer
+// group complete their claim on e.
+//
+// false is returned if the subscription was terminated, along with the
+// reason.
+func (s *Subscriber) skip(e store.Event) (bool, error) {
+	atomic.AddUint64(&s.stats.Filtered, 1)
+	if s.group != nil {
+		if err := s.group.ack(s.Stream, e); err != nil && !claimLost(err) {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,106 @@
+package sub
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/pub"
+	"github.com/vancluever/fspubsub/store"
+)
+
+func TestFilter(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	s, err := NewSubscriber(
+		dir,
+		TestEvent{},
+		Filter(func(e store.Event) bool { return strings.HasPrefix(e.Data.(TestEvent).Text, "keep") }),
+		Filter(func(e store.Event) bool { return e.Data.(TestEvent).Text != "keep-not" }),
+	)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer s.Close()
+	p, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	for _, text := range []string{"keep-1", "drop", "keep-not", "keep-2"} {
+		if _, err := p.Publish(TestEvent{Text: text}); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+	es, err := receive(s, 2)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	select {
+	case e := <-s.Queue():
+		t.Fatalf("unexpected event %#v", e)
+	case <-time.After(time.Millisecond * 100):
+	}
+	if expected, actual := []string{"keep-1", "keep-2"}, eventTexts(es); !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestHeaderFilter(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	p, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	var corrupt string
+	for _, text := range []string{"a-1", "b-1", "b-2", "a-2"} {
+		id, err := p.PublishWithHeaders(TestEvent{Text: text}, map[string]string{"tenant": text[:1]})
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		if text == "b-2" {
+			corrupt = id
+		}
+	}
+	// Events that are filtered out by their headers are never decoded, so this
+	// does not stop the subscription.
+	if err := ioutil.WriteFile(dir+"/TestEvent/"+corrupt, []byte("{\"Text\": 42}"), 0666); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	s, err := NewSubscriber(
+		dir,
+		TestEvent{},
+		StartAt(FromBeginning()),
+		HeaderFilter(func(m store.Metadata) bool { return m.Headers["tenant"] == "a" }),
+	)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer s.Close()
+	publishTexts(t, dir, "unlabelled")
+	es, err := receive(s, 2)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if expected, actual := []string{"a-1", "a-2"}, eventTexts(es); !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+	timeout := time.After(time.Second * 2)
+	for s.Stats().Filtered < 3 {
+		select {
+		case <-timeout:
+			t.Fatalf("expected 3 filtered events, got %#v", s.Stats())
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	if len(s.Queue()) != 0 {
+		t.Fatalf("unexpected events on queue: %d", len(s.Queue()))
+	}
+	if es[0].Headers["tenant"] != "a" {
+		t.Fatalf("expected headers on delivered event, got %#v", es[0].Headers)
+	}
+}
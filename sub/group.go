@@ -0,0 +1,198 @@
+package sub
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vancluever/fspubsub/store"
+)
+
+// group holds the state for a member of a consumer group.
+type group struct {
+	// The name of the group.
+	name string
+
+	// The ID of this consumer within the group. This is unique to the
+	// subscriber.
+	consumer string
+
+	// The time after which a claim that has not been refreshed is considered
+	// abandoned.
+	timeout time.Duration
+
+	// Protects claims.
+	mu sync.Mutex
+
+	// The IDs of the events currently claimed by this consumer that have not
+	// been acknowledged yet.
+	claims map[string]struct{}
+}
+
+// Group makes the subscriber a member of the consumer group name.
+//
+// Members of a consumer group compete for events - each event in the stream
+// is claimed by exactly one member of the group, so work can be spread over
+// several subscribers, including subscribers in different processes on the
+// same host. Claims are lock files kept alongside the stream, and a claimed
+// event is only handed to the consumer that claimed it.
+//
+// An event stays claimed until it is acknowledged with Ack, after which it is
+// never handed out again. Claims are refreshed in the background while the
+// subscriber is running. A claim that has not been refreshed within timeout,
+// such as one held by a consumer that has crashed, is released and the event
+// is handed to another member of the group.
+//
+// When the subscriber starts, events in the stream that have not been claimed
+// by the group yet are claimed and delivered as well.
+func Group(name string, timeout time.Duration) Option {
+	return func(s *Subscriber) error {
+		if timeout <= 0 {
+			return errors.New("claim timeout must be greater than zero")
+		}
+		// This also validates the group name and sets up the directories for
+		// the group.
+		if _, err := s.Stream.StaleClaims(name, timeout); err != nil {
+			return err
+		}
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return fmt.Errorf("could not generate consumer ID: %s", err)
+		}
+		s.group = &group{
+			name:     name,
+			consumer: id.String(),
+			timeout:  timeout,
+			claims:   make(map[string]struct{}),
+		}
+		return nil
+	}
+}
+
+// claim claims the event with the supplied ID for this consumer.
+func (g *group) claim(st *store.Stream, id string) (bool, error) {
+	ok, err := st.Claim(g.name, g.consumer, id)
+	if ok {
+		g.track(id)
+	}
+	return ok, err
+}
+
+// steal takes over the stale claim on the event with the supplied ID.
+func (g *group) steal(st *store.Stream, id string) (bool, error) {
+	ok, err := st.StealClaim(g.name, g.consumer, id, g.timeout)
+	if ok {
+		g.track(id)
+	}
+	return ok, err
+}
+
+// track adds the event with the supplied ID to the claims kept refreshed.
+func (g *group) track(id string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.claims[id] = struct{}{}
+}
+
+// ack marks the event e as completed for the group. A store.ClaimLostError is
+// returned if the claim on e has been taken over by another consumer.
+func (g *group) ack(st *store.Stream, e store.Event) error {
+	err := st.CompleteClaim(g.name, g.consumer, e.ID)
+	if err != nil && !claimLost(err) {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.claims, e.ID)
+	return err
+}
+
+// release releases the claim on the event with the supplied ID. A
+// store.ClaimLostError is returned if the claim has been taken over by another
+// consumer.
+func (g *group) release(st *store.Stream, id string) error {
+	err := st.ReleaseClaim(g.name, g.consumer, id)
+	if err != nil && !claimLost(err) {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.claims, id)
+	return err
+}
+
+// claimLost returns true if err is a store.ClaimLostError. A lost claim is
+// left to the consumer that took it over, so it does not stop the
+// subscription.
+func claimLost(err error) bool {
+	_, ok := err.(store.ClaimLostError)
+	return ok
+}
+
+// heartbeat refreshes the consumer's claims until done is closed. Claims that
+// have been lost to another consumer are no longer refreshed.
+func (g *group) heartbeat(st *store.Stream, done <-chan struct{}) {
+	t := time.NewTicker(g.timeout / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			g.mu.Lock()
+			for id := range g.claims {
+				if ok, _ := st.RefreshClaim(g.name, g.consumer, id); !ok {
+					delete(g.claims, id)
+				}
+			}
+			g.mu.Unlock()
+		case <-done:
+			return
+		}
+	}
+}
+
+// reclaim takes over any stale claims in the group, and claims any events
+// that have not been claimed yet, delivering them to the queue. This catches
+// events dropped by crashed consumers, and events published while no member
+// of the group was running.
+//
+// Events are claimed one at a time as they are delivered, so that a consumer
+// does not claim more than it can take while other members are idle.
+//
+// false is returned if the subscription was terminated while delivering, along
+// with the reason.
+func (s *Subscriber) reclaim() (bool, error) {
+	stale, err := s.Stream.StaleClaims(s.group.name, s.group.timeout)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range stale {
+		if ok, err := s.claimAndSend(id, s.group.steal); !ok {
+			return false, err
+		}
+	}
+	unclaimed, err := s.Stream.Unclaimed(s.group.name)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range unclaimed {
+		if ok, err := s.claimAndSend(id, s.group.claim); !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// claimAndSend claims the event with the supplied ID using claim, and sends
+// it to the queue if the claim was successful.
+func (s *Subscriber) claimAndSend(id string, claim func(*store.Stream, string) (bool, error)) (bool, error) {
+	ok, err := claim(s.Stream, id)
+	switch {
+	case err != nil:
+		return false, err
+	case !ok:
+		return true, nil
+	}
+	return s.deliver(id)
+}
@@ -0,0 +1,128 @@
+package sub
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/pub"
+	"github.com/vancluever/fspubsub/store"
+)
+
+func TestGroup(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	p, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// Published before any member is running.
+	if _, err := p.Publish(TestEvent{Text: "0"}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	var mu sync.Mutex
+	var texts []string
+	var wg sync.WaitGroup
+	var subs []*Subscriber
+	for i := 0; i < 3; i++ {
+		s, err := NewSubscriber(dir, TestEvent{}, Group("workers", time.Minute))
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		subs = append(subs, s)
+		wg.Add(1)
+		go func(s *Subscriber) {
+			defer wg.Done()
+			for {
+				select {
+				case e := <-s.Queue():
+					if err := s.Ack(e); err != nil {
+						t.Errorf("bad: %s", err)
+					}
+					mu.Lock()
+					texts = append(texts, e.Data.(TestEvent).Text)
+					mu.Unlock()
+				case <-s.Done():
+					return
+				}
+			}
+		}(s)
+	}
+
+	expected := []string{"0"}
+	for _, text := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+		if _, err := p.Publish(TestEvent{Text: text}); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		expected = append(expected, text)
+	}
+
+	timeout := time.After(time.Second * 2)
+	for {
+		mu.Lock()
+		n := len(texts)
+		mu.Unlock()
+		if n >= len(expected) {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for events, got %d of %d", n, len(expected))
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	// Give any duplicate deliveries a chance to show up.
+	time.Sleep(time.Millisecond * 100)
+	for _, s := range subs {
+		s.Close()
+	}
+	wg.Wait()
+
+	sort.Strings(texts)
+	if !reflect.DeepEqual(expected, texts) {
+		t.Fatalf("expected %q, got %q", expected, texts)
+	}
+}
+
+func TestGroupAbandonedClaim(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	p, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	crashed, err := NewSubscriber(dir, TestEvent{}, Group("workers", time.Millisecond*300))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	id, err := p.Publish(TestEvent{Text: "foo"})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if _, err := receive(crashed, 1); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// Stop without acknowledging, which stops the claim from being refreshed.
+	crashed.Close()
+	<-crashed.Done()
+
+	s, err := NewSubscriber(dir, TestEvent{}, Group("workers", time.Millisecond*300))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer s.Close()
+	es, err := receive(s, 1)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	expected := []store.Event{{ID: id, Data: TestEvent{Text: "foo"}}}
+	if !reflect.DeepEqual(expected, es) {
+		t.Fatalf("expected %#v, got %#v", expected, es)
+	}
+}
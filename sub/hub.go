@@ -0,0 +1,277 @@
+package sub
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+// Hub fans the events from a single subscriber out to any number of
+// in-process consumers. The stream is watched and each event is decoded once,
+// no matter how many consumers there are, which makes a hub cheaper than a
+// subscriber per consumer when many goroutines are interested in the same
+// stream.
+//
+// Every consumer receives its own copy of each event, but the event data is
+// shared between them, so consumers must not modify it.
+type Hub struct {
+	// The subscriber feeding the hub.
+	sub *Subscriber
+
+	// Protects consumers and closed.
+	mu sync.Mutex
+
+	// The attached consumers.
+	consumers map[*Consumer]bool
+
+	// True once the hub has shut down. No more consumers can be attached after
+	// this.
+	closed bool
+
+	// The internal completion channel. Call Done to get a valid one-way
+	// completion channel.
+	done chan struct{}
+}
+
+// NewHub starts watching the stream for event in the base directory dir, and
+// fanning its events out to the consumers attached with Attach. The options in
+// opts are applied to the subscriber feeding the hub. Consumers cannot
+// acknowledge events, so options that need acknowledgements, such as Durable
+// and Group, cannot be used.
+func NewHub(dir string, event interface{}, opts ...Option) (*Hub, error) {
+	s, err := NewSubscriber(dir, event, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if s.acknowledges() {
+		s.Close()
+		return nil, errors.New("hub subscriber cannot require acknowledgements")
+	}
+	h := &Hub{
+		sub:       s,
+		consumers: make(map[*Consumer]bool),
+		done:      make(chan struct{}),
+	}
+	go h.run()
+	return h, nil
+}
+
+// run fans events out to the consumers until the subscription terminates,
+// then shuts the consumers down.
+func (h *Hub) run() {
+	defer close(h.done)
+	for {
+		select {
+		case e := <-h.sub.Queue():
+			h.fanOut(e)
+		case <-h.sub.Done():
+			// Pick up anything the subscriber left in its queue.
+			for {
+				select {
+				case e := <-h.sub.Queue():
+					h.fanOut(e)
+				default:
+					h.shutdown(h.sub.Error())
+					return
+				}
+			}
+		}
+	}
+}
+
+// fanOut sends the event e to each attached consumer, according to the
+// consumer's queue-full policy. Consumers that fail are detached.
+func (h *Hub) fanOut(e store.Event) {
+	h.mu.Lock()
+	cs := make([]*Consumer, 0, len(h.consumers))
+	for c := range h.consumers {
+		cs = append(cs, c)
+	}
+	h.mu.Unlock()
+	for _, c := range cs {
+		if ok, err := enqueue(c.queue, e, c.queueFullPolicy, c.done, &c.stats.Dropped); !ok && err != nil {
+			h.detach(c)
+			c.terminate(err)
+		}
+	}
+}
+
+// detach removes the consumer c from the hub.
+func (h *Hub) detach(c *Consumer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.consumers, c)
+}
+
+// shutdown stops the hub from accepting consumers, and terminates the
+// attached ones with err.
+func (h *Hub) shutdown(err error) {
+	h.mu.Lock()
+	cs := h.consumers
+	h.consumers = nil
+	h.closed = true
+	h.mu.Unlock()
+	for c := range cs {
+		c.terminate(err)
+	}
+}
+
+// Attach attaches a new consumer to the hub. The consumer receives the events
+// delivered by the hub from this point on, until it is closed or the hub shuts
+// down.
+func (h *Hub) Attach(opts ...ConsumerOption) (*Consumer, error) {
+	c := &Consumer{
+		hub:             h,
+		queueBufferSize: defaultBufferSize,
+		done:            make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	c.queue = make(chan store.Event, c.queueBufferSize)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, errors.New("hub is closed")
+	}
+	h.consumers[c] = true
+	return c, nil
+}
+
+// Done returns a channel that closes once the hub has shut down and all of its
+// consumers have been terminated.
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+// Error returns the reason the subscription feeding the hub terminated, if it
+// was for any reason other than the hub being closed. Make sure to block on
+// done before checking this value.
+func (h *Hub) Error() error {
+	return h.sub.Error()
+}
+
+// Stats returns a snapshot of the counters of the subscriber feeding the hub.
+func (h *Hub) Stats() Stats {
+	return h.sub.Stats()
+}
+
+// Close shuts down the hub, terminating all of its consumers, and blocks until
+// the hub has finished. It is safe to call Close more than once.
+func (h *Hub) Close() {
+	h.shutdown(nil)
+	h.sub.Close()
+	<-h.done
+}
+
+// Consumer is an in-process consumer attached to a Hub. Consumers can be used
+// as the source for a Processor or a Batcher.
+type Consumer struct {
+	// The hub the consumer is attached to.
+	hub *Hub
+
+	// The internal queue channel. Call Queue to get a valid one-way event
+	// channel.
+	queue chan store.Event
+
+	// The size of the queue buffer.
+	queueBufferSize int
+
+	// The policy for events received while the queue is full.
+	queueFullPolicy QueueFullPolicy
+
+	// The internal completion channel. Call Done to get a valid one-way
+	// completion channel.
+	done chan struct{}
+
+	// Makes sure the consumer is only terminated once.
+	once sync.Once
+
+	// Protects err.
+	mu sync.Mutex
+
+	// The reason the consumer was terminated, if any.
+	err error
+
+	// Counters for Stats. These are accessed atomically.
+	stats Stats
+}
+
+// ConsumerOption is a functional option that can be passed to Attach to
+// change the behavior of a consumer.
+type ConsumerOption func(*Consumer) error
+
+// ConsumerBufferSize sets the size of the buffer for the channel returned by
+// the consumer's Queue. A size of zero makes the queue unbuffered.
+func ConsumerBufferSize(n int) ConsumerOption {
+	return func(c *Consumer) error {
+		if n < 0 {
+			return errors.New("queue buffer size cannot be negative")
+		}
+		c.queueBufferSize = n
+		return nil
+	}
+}
+
+// ConsumerQueueFull sets the policy for events received while the consumer's
+// queue is full. Under QueueFullBlock, the default, a slow consumer holds up
+// every other consumer of the hub. Under QueueFullFail, the consumer is
+// detached from the hub and terminated with ErrQueueFull.
+func ConsumerQueueFull(p QueueFullPolicy) ConsumerOption {
+	return func(c *Consumer) error {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		c.queueFullPolicy = p
+		return nil
+	}
+}
+
+// terminate closes the completion channel, recording err as the reason.
+func (c *Consumer) terminate(err error) {
+	c.once.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		close(c.done)
+	})
+}
+
+// Queue returns the event channel.
+func (c *Consumer) Queue() <-chan store.Event {
+	return c.queue
+}
+
+// Done returns a channel that closes once the consumer has been detached from
+// the hub, or the hub has shut down.
+func (c *Consumer) Done() <-chan struct{} {
+	return c.done
+}
+
+// Error returns the reason the consumer was terminated, if it was for any
+// reason other than the consumer or the hub being closed. Make sure to block
+// on done before checking this value.
+func (c *Consumer) Error() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Stats returns a snapshot of the consumer's counters. Only Dropped applies to
+// consumers.
+func (c *Consumer) Stats() Stats {
+	return Stats{
+		Dropped: atomic.LoadUint64(&c.stats.Dropped),
+	}
+}
+
+// Close detaches the consumer from the hub. The events left in the queue can
+// still be read. It is safe to call Close more than once.
+func (c *Consumer) Close() {
+	c.hub.detach(c)
+	c.terminate(nil)
+}
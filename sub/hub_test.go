@@ -0,0 +1,161 @@
+package sub
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHub(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	h, err := NewHub(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer h.Close()
+	var cs []*Consumer
+	for i := 0; i < 3; i++ {
+		c, err := h.Attach()
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		cs = append(cs, c)
+	}
+
+	expected := []string{"a", "b", "c"}
+	publishTexts(t, dir, expected...)
+	for _, c := range cs {
+		es, err := receive(c, len(expected))
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		if actual := eventTexts(es); !reflect.DeepEqual(expected, actual) {
+			t.Fatalf("expected %v, got %v", expected, actual)
+		}
+	}
+
+	// A detached consumer stops receiving events, while the others carry on.
+	cs[0].Close()
+	cs[0].Close()
+	select {
+	case <-cs[0].Done():
+	default:
+		t.Fatal("expected detached consumer to be done")
+	}
+	publishTexts(t, dir, "d")
+	for _, c := range cs[1:] {
+		if _, err := receive(c, 1); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+	if len(cs[0].Queue()) != 0 {
+		t.Fatal("expected detached consumer to receive nothing")
+	}
+}
+
+func TestHubQueueFull(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Policy  QueueFullPolicy
+		Err     error
+		Dropped bool
+	}{
+		{
+			Name:    "drop newest",
+			Policy:  QueueFullDropNewest,
+			Dropped: true,
+		},
+		{
+			Name:   "fail",
+			Policy: QueueFullFail,
+			Err:    ErrQueueFull,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "subtest")
+			defer os.RemoveAll(dir)
+			h, err := NewHub(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			defer h.Close()
+			slow, err := h.Attach(ConsumerBufferSize(1), ConsumerQueueFull(tc.Policy))
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			fast, err := h.Attach()
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+
+			// The slow consumer is not read from, so it overflows without
+			// holding up the fast one.
+			publishTexts(t, dir, "a", "b", "c")
+			if _, err := receive(fast, 3); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if tc.Err != nil {
+				select {
+				case <-slow.Done():
+				case <-time.After(time.Second * 2):
+					t.Fatal("timed out waiting for consumer to fail")
+				}
+				if slow.Error() != tc.Err {
+					t.Fatalf("expected error %q, got %v", tc.Err, slow.Error())
+				}
+			}
+			if (slow.Stats().Dropped > 0) != tc.Dropped {
+				t.Fatalf("expected dropped %t, got %#v", tc.Dropped, slow.Stats())
+			}
+		})
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	if _, err := NewHub(dir, TestEvent{}, Durable("foo")); err == nil {
+		t.Fatal("expected error for durable hub, got none")
+	}
+	h, err := NewHub(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if _, err := h.Attach(ConsumerQueueFull(QueueFullPolicy(99))); err == nil {
+		t.Fatal("expected error for unknown queue-full policy, got none")
+	}
+	// A blocked consumer does not stop the hub from closing.
+	c, err := h.Attach(ConsumerBufferSize(0))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	publishTexts(t, dir, "a")
+	time.Sleep(time.Millisecond * 100)
+	closed := make(chan struct{})
+	go func() {
+		h.Close()
+		h.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 2):
+		t.Fatal("timed out waiting for hub to close")
+	}
+	select {
+	case <-c.Done():
+	default:
+		t.Fatal("expected consumer to be done")
+	}
+	if c.Error() != nil || h.Error() != nil {
+		t.Fatalf("expected no errors, got %v, %v", c.Error(), h.Error())
+	}
+	if _, err := h.Attach(); err == nil {
+		t.Fatal("expected error attaching to closed hub, got none")
+	}
+}
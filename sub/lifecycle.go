@@ -0,0 +1,81 @@
+package sub
+
+import (
+	"errors"
+	"time"
+)
+
+// drainPollInterval is the interval the queue is checked on while waiting for
+// it to be drained.
+const drainPollInterval = time.Millisecond * 10
+
+// closePolicy describes what happens to the events left in the queue when a
+// subscription terminates.
+type closePolicy int
+
+const (
+	// closeKeep leaves the events in the queue, where the consumer can still
+	// read them after Done has closed.
+	closeKeep closePolicy = iota
+
+	// closeDrain waits for the consumer to read the events before Done is
+	// closed.
+	closeDrain
+
+	// closeDiscard empties the queue.
+	closeDiscard
+)
+
+// DrainOnClose makes the subscriber wait, when the subscription terminates,
+// for the consumer to read the events left in the queue, up to timeout. No new
+// events are added to the queue in the meantime. Done is closed, and Close
+// returns, once the queue is empty or the timeout has passed.
+//
+// By default, the events are left in the queue, where the consumer can still
+// read them after Done has closed.
+func DrainOnClose(timeout time.Duration) Option {
+	return func(s *Subscriber) error {
+		if timeout <= 0 {
+			return errors.New("drain timeout must be greater than zero")
+		}
+		s.closePolicy = closeDrain
+		s.drainTimeout = timeout
+		return nil
+	}
+}
+
+// DiscardOnClose makes the subscriber discard the events left in the queue
+// when the subscription terminates, so that the consumer does not see any
+// events after Done has closed. Members of a consumer group release their
+// claims on the discarded events, so that other members can pick them up
+// straight away.
+func DiscardOnClose() Option {
+	return func(s *Subscriber) error {
+		s.closePolicy = closeDiscard
+		return nil
+	}
+}
+
+// finish deals with the events left in the queue once the subscription has
+// terminated, according to the close policy.
+func (s *Subscriber) finish() {
+	switch s.closePolicy {
+	case closeDrain:
+		deadline := time.Now().Add(s.drainTimeout)
+		for len(s.queue) > 0 && time.Now().Before(deadline) {
+			time.Sleep(drainPollInterval)
+		}
+	case closeDiscard:
+		for {
+			select {
+			case e := <-s.queue:
+				if s.group != nil {
+					// The claim goes stale if it cannot be released.
+					s.group.release(s.Stream, e.ID)
+				}
+			default:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package sub
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/pub"
+)
+
+// closeWithin closes the subscriber, failing if Close does not return within
+// a couple of seconds.
+func closeWithin(t *testing.T, s *Subscriber) {
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 2):
+		t.Fatal("timed out waiting for Close to return")
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("expected subscriber to be done after Close returned")
+	}
+}
+
+// publishTexts publishes an event for each text to the TestEvent stream in
+// dir.
+func publishTexts(t *testing.T, dir string, texts ...string) {
+	p, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	for _, text := range texts {
+		if _, err := p.Publish(TestEvent{Text: text}); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+}
+
+// waitQueued waits for n events to be buffered in the subscriber's queue.
+func waitQueued(t *testing.T, s *Subscriber, n int) {
+	timeout := time.After(time.Second * 2)
+	for len(s.Queue()) < n {
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for %d queued events, got %d", n, len(s.Queue()))
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	s, err := NewSubscriber(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Error()
+			s.Close()
+			if s.Error() != nil {
+				t.Errorf("bad: %s", s.Error())
+			}
+		}()
+	}
+	wg.Wait()
+	closeWithin(t, s)
+}
+
+func TestCloseAfterError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	s, err := NewSubscriber(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := ioutil.WriteFile(dir+"/TestEvent/bad", []byte("{\"Text\": 42}"), 0666); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second * 2):
+		t.Fatal("timed out waiting for subscriber to stop")
+	}
+	closeWithin(t, s)
+	closeWithin(t, s)
+	if s.Error() == nil {
+		t.Fatal("expected error to be kept after Close, got none")
+	}
+}
+
+func TestCloseBlockedQueue(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	s, err := NewSubscriber(dir, TestEvent{}, QueueBufferSize(0))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// Nothing reads the queue, so the subscriber blocks sending the event.
+	publishTexts(t, dir, "foo")
+	time.Sleep(time.Millisecond * 100)
+	closeWithin(t, s)
+	if s.Error() != nil {
+		t.Fatalf("bad: %s", s.Error())
+	}
+}
+
+func TestClosePolicy(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Opts     []Option
+		Read     bool
+		Expected int
+	}{
+		{
+			Name:     "keep",
+			Expected: 3,
+		},
+		{
+			Name:     "discard",
+			Opts:     []Option{DiscardOnClose()},
+			Expected: 0,
+		},
+		{
+			Name:     "drain",
+			Opts:     []Option{DrainOnClose(time.Second * 2)},
+			Read:     true,
+			Expected: 0,
+		},
+		{
+			Name:     "drain timeout",
+			Opts:     []Option{DrainOnClose(time.Millisecond * 50)},
+			Expected: 3,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "subtest")
+			defer os.RemoveAll(dir)
+			s, err := NewSubscriber(dir, TestEvent{}, tc.Opts...)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			publishTexts(t, dir, "1", "2", "3")
+			waitQueued(t, s, 3)
+
+			var read int
+			var wg sync.WaitGroup
+			if tc.Read {
+				// Read slowly, so that Close has to wait.
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < 3; i++ {
+						time.Sleep(time.Millisecond * 50)
+						<-s.Queue()
+						read++
+					}
+				}()
+			}
+			closeWithin(t, s)
+			wg.Wait()
+			if actual := len(s.Queue()); actual != tc.Expected {
+				t.Fatalf("expected %d events left in queue, got %d", tc.Expected, actual)
+			}
+			if tc.Read && read != 3 {
+				t.Fatalf("expected consumer to read 3 events, got %d", read)
+			}
+		})
+	}
+}
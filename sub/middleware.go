@@ -0,0 +1,78 @@
+package sub
+
+import (
+	"errors"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+// errTerminated is passed back up a middleware chain when the subscription
+// terminated while sending an event to the queue.
+var errTerminated = errors.New("subscription terminated")
+
+// ReceiveFunc receives a decoded event. It is the next step in a middleware
+// chain, ending with the function that sends the event to the queue.
+type ReceiveFunc func(store.Event) error
+
+// Middleware wraps the delivery of each decoded event. A middleware can
+// inspect or change the event before calling next, skip it by returning nil
+// without calling next, or reject it by returning an error.
+//
+// Skipped events are treated as if they had been filtered out with Filter.
+// Rejected events are treated as poison events, and handled according to the
+// poison event policy. Middleware is run on the subscription goroutine, after
+// filters, so it should not block.
+type Middleware func(next ReceiveFunc) ReceiveFunc
+
+// Use adds middleware to the chain run for every event delivered by the
+// subscriber. Middleware is run in the order it is added, so the first
+// middleware added sees the event first.
+func Use(mw ...Middleware) Option {
+	return func(s *Subscriber) error {
+		s.middleware = append(s.middleware, mw...)
+		return nil
+	}
+}
+
+// Validate returns middleware that rejects events that fail their own
+// validation. See store.Validate.
+func Validate() Middleware {
+	return func(next ReceiveFunc) ReceiveFunc {
+		return func(e store.Event) error {
+			if err := store.Validate(e.Data); err != nil {
+				return err
+			}
+			return next(e)
+		}
+	}
+}
+
+// receive runs the middleware chain for the event e, ending in send.
+//
+// false is returned if the subscription was terminated, along with the
+// reason.
+func (s *Subscriber) receive(e store.Event) (bool, error) {
+	var sent bool
+	var ok bool
+	var sendErr error
+	f := func(e store.Event) error {
+		sent = true
+		if ok, sendErr = s.send(e); !ok {
+			return errTerminated
+		}
+		return nil
+	}
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		f = s.middleware[i](f)
+	}
+	err := f(e)
+	switch {
+	case sent && !ok:
+		return false, sendErr
+	case err != nil:
+		return s.poison(e.ID, err)
+	case !sent:
+		return s.skip(e)
+	}
+	return true, nil
+}
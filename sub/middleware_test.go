@@ -0,0 +1,103 @@
+package sub
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+// invalidText is the text that TestEvent treats as invalid.
+const invalidText = "invalid"
+
+func (e TestEvent) Validate() error {
+	if e.Text == invalidText {
+		return errors.New("text is invalid")
+	}
+	return nil
+}
+
+func TestUse(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	var mu sync.Mutex
+	var reported []error
+	var seen []string
+	record := func(next ReceiveFunc) ReceiveFunc {
+		return func(e store.Event) error {
+			mu.Lock()
+			seen = append(seen, e.Data.(TestEvent).Text)
+			mu.Unlock()
+			return next(e)
+		}
+	}
+	upper := func(next ReceiveFunc) ReceiveFunc {
+		return func(e store.Event) error {
+			e.Data = TestEvent{Text: strings.ToUpper(e.Data.(TestEvent).Text)}
+			return next(e)
+		}
+	}
+	skip := func(next ReceiveFunc) ReceiveFunc {
+		return func(e store.Event) error {
+			if e.Data.(TestEvent).Text == "SKIP" {
+				return nil
+			}
+			return next(e)
+		}
+	}
+	s, err := NewSubscriber(
+		dir,
+		TestEvent{},
+		Use(record, Validate(), upper),
+		Use(skip),
+		OnPoison(PoisonSkip),
+		OnError(func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			reported = append(reported, err)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer s.Close()
+	publishTexts(t, dir, "foo", invalidText, "skip", "bar")
+	es, err := receive(s, 2)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if expected, actual := []string{"BAR", "FOO"}, eventTexts(es); !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+	// The invalid and skipped events may still be on their way through the
+	// chain.
+	timeout := time.After(time.Second * 2)
+	for {
+		mu.Lock()
+		n := len(reported)
+		mu.Unlock()
+		if n > 0 && s.Stats().Filtered > 0 {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("expected invalid event to be reported and skipped event to be counted, got %d, %#v", n, s.Stats())
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reported) != 1 || !strings.Contains(reported[0].Error(), "invalid event: text is invalid") {
+		t.Fatalf("expected invalid event to be reported, got %v", reported)
+	}
+	// Events are handled in the order they were published.
+	if expected := []string{"foo", invalidText, "skip", "bar"}; !reflect.DeepEqual(expected, seen) {
+		t.Fatalf("expected events in order %q, got %q", expected, seen)
+	}
+}
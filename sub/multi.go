@@ -0,0 +1,295 @@
+package sub
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+// MultiSubscriber watches several streams, one per event type, and delivers
+// the events from all of them on a single queue. Each event is tagged with the
+// name of the stream it came from in its Stream field.
+//
+// The streams share a lifecycle - if the subscription to any one of them
+// terminates, the subscriptions to the others are closed as well, and the
+// reason is returned by Error.
+//
+// The close policy of the subscribers applies to the shared queue as well.
+// With DrainOnClose, the events left in the queue of each subscriber are
+// forwarded to the shared queue until the subscriber terminates, and Done is
+// closed once the shared queue has been drained too, all within the drain
+// timeout. With DiscardOnClose, the events left in the shared queue are
+// discarded.
+type MultiSubscriber struct {
+	// Protects subs, closed and err.
+	mu sync.Mutex
+
+	// The subscribers for each stream, by stream name.
+	subs map[string]*Subscriber
+
+	// True once the subscriptions have been shut down. No more streams can be
+	// added after this.
+	closed bool
+
+	// The internal queue channel. Call Queue to get a valid one-way event
+	// channel.
+	queue chan store.Event
+
+	// The internal completion channel. Call Done to get a valid one-way
+	// completion channel.
+	done chan struct{}
+
+	// The reason the first subscription to terminate did so.
+	err error
+
+	// Closed to shut down the subscriptions.
+	stop chan struct{}
+
+	// Closed once events are no longer forwarded to the shared queue - when
+	// the subscriptions are shut down, or once the drain timeout has passed
+	// after that if the subscribers drain their queues on close.
+	expired chan struct{}
+
+	// The close policy of the subscribers, set when the subscriptions are
+	// shut down.
+	closePolicy closePolicy
+
+	// Makes sure the subscriptions are only shut down once.
+	once sync.Once
+
+	// Tracks the forwarding goroutines, and any other goroutines that need to
+	// finish before the completion channel is closed.
+	wg sync.WaitGroup
+}
+
+// NewMultiSubscriber starts watching the streams for each of the events in
+// events, in the base directory dir. The options in opts are applied to the
+// subscriber for each stream - a durable consumer, for example, keeps a
+// separate checkpoint in each stream.
+//
+// Events from different streams are delivered in the order they are received,
+// which is not necessarily the order they were published in.
+func NewMultiSubscriber(dir string, events []interface{}, opts ...Option) (*MultiSubscriber, error) {
+	if len(events) == 0 {
+		return nil, errors.New("at least one event type is required")
+	}
+	var subs []*Subscriber
+	names := make(map[string]bool)
+	for _, event := range events {
+		s, err := NewSubscriber(dir, event, opts...)
+		if err == nil && names[s.Stream.Name()] {
+			s.Close()
+			err = fmt.Errorf("duplicate stream %s", s.Stream.Name())
+		}
+		if err != nil {
+			for _, s := range subs {
+				s.Close()
+			}
+			return nil, err
+		}
+		names[s.Stream.Name()] = true
+		subs = append(subs, s)
+	}
+	m := newMultiSubscriber(cap(subs[0].queue))
+	for _, s := range subs {
+		m.add(s)
+	}
+	return m, nil
+}
+
+// newMultiSubscriber returns a MultiSubscriber with no streams, with a queue
+// buffered to queueSize.
+func newMultiSubscriber(queueSize int) *MultiSubscriber {
+	m := &MultiSubscriber{
+		subs:    make(map[string]*Subscriber),
+		queue:   make(chan store.Event, queueSize),
+		done:    make(chan struct{}),
+		stop:    make(chan struct{}),
+		expired: make(chan struct{}),
+	}
+	go m.wait()
+	return m
+}
+
+// add starts forwarding events from the subscriber s. s is closed if the
+// multi-subscriber has already been shut down.
+func (m *MultiSubscriber) add(s *Subscriber) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		s.Close()
+		return
+	}
+	m.subs[s.Stream.Name()] = s
+	m.wg.Add(1)
+	go m.forward(s)
+}
+
+// forward forwards events from the subscriber s to the shared queue, until s
+// terminates, or forwarding expires on shutdown.
+func (m *MultiSubscriber) forward(s *Subscriber) {
+	defer m.wg.Done()
+	name := s.Stream.Name()
+	for {
+		select {
+		case e := <-s.Queue():
+			e.Stream = name
+			select {
+			case m.queue <- e:
+			case <-m.expired:
+				return
+			}
+		case <-s.Done():
+			m.fail(s.Error())
+			return
+		case <-m.expired:
+			return
+		}
+	}
+}
+
+// fail records err as the reason for termination, if it is the first, and
+// shuts down the subscriptions.
+func (m *MultiSubscriber) fail(err error) {
+	m.mu.Lock()
+	if m.err == nil {
+		m.err = err
+	}
+	m.mu.Unlock()
+	m.shutdown()
+}
+
+// wait closes the completion channel once the multi-subscriber has been shut
+// down, all of the subscriptions have terminated, and the shared queue has
+// been dealt with according to the close policy.
+func (m *MultiSubscriber) wait() {
+	<-m.stop
+	m.wg.Wait()
+	for _, s := range m.subs {
+		<-s.Done()
+	}
+	m.finish()
+	close(m.done)
+}
+
+// finish deals with the events left in the shared queue once the
+// subscriptions have terminated, as per Subscriber.finish.
+func (m *MultiSubscriber) finish() {
+	switch m.closePolicy {
+	case closeDrain:
+		for len(m.queue) > 0 {
+			select {
+			case <-m.expired:
+				return
+			case <-time.After(drainPollInterval):
+			}
+		}
+	case closeDiscard:
+		for {
+			select {
+			case e := <-m.queue:
+				if s := m.subs[e.Stream]; s != nil && s.group != nil {
+					// The claim goes stale if it cannot be released.
+					s.group.release(s.Stream, e.ID)
+				}
+			default:
+				return
+			}
+		}
+	}
+}
+
+// shutdown closes all of the subscriptions. They are closed at the same time,
+// and events are forwarded from them until they terminate, so that
+// subscribers draining their queues on close can do so.
+func (m *MultiSubscriber) shutdown() {
+	m.once.Do(func() {
+		m.mu.Lock()
+		m.closed = true
+		var timeout time.Duration
+		for _, s := range m.subs {
+			m.closePolicy, timeout = s.closePolicy, s.drainTimeout
+			break
+		}
+		m.mu.Unlock()
+		if m.closePolicy == closeDrain {
+			time.AfterFunc(timeout, func() { close(m.expired) })
+		} else {
+			close(m.expired)
+		}
+		close(m.stop)
+		for _, s := range m.subs {
+			go s.Close()
+		}
+	})
+}
+
+// Queue returns the event channel.
+func (m *MultiSubscriber) Queue() <-chan store.Event {
+	return m.queue
+}
+
+// Done returns a channel that closes once the subscriptions to all of the
+// streams have terminated.
+func (m *MultiSubscriber) Done() <-chan struct{} {
+	return m.done
+}
+
+// Error returns the reason the first subscription to terminate did so. This
+// is guaranteed to be nil if the subscriptions have not yet terminated, so
+// make sure to block on done before checking this value.
+func (m *MultiSubscriber) Error() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Subscriber returns the subscriber for the named stream, or nil if the
+// multi-subscriber is not watching it.
+func (m *MultiSubscriber) Subscriber(stream string) *Subscriber {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.subs[stream]
+}
+
+// Ack acknowledges the event e with the subscriber for the stream it came
+// from. See Subscriber.Ack for details.
+func (m *MultiSubscriber) Ack(e store.Event) error {
+	s, err := m.subscriberFor(e)
+	if err != nil {
+		return err
+	}
+	return s.Ack(e)
+}
+
+// Nack negatively acknowledges the event e with the subscriber for the stream
+// it came from. See Subscriber.Nack for details.
+func (m *MultiSubscriber) Nack(e store.Event) error {
+	s, err := m.subscriberFor(e)
+	if err != nil {
+		return err
+	}
+	return s.Nack(e)
+}
+
+// subscriberFor returns the subscriber for the stream the event e came from.
+func (m *MultiSubscriber) subscriberFor(e store.Event) (*Subscriber, error) {
+	m.mu.Lock()
+	s, ok := m.subs[e.Stream]
+	m.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("event %s is not from a stream watched by this subscriber", e.ID)
+	}
+	return s, nil
+}
+
+// Close closes the subscriptions to all of the streams. This performs a
+// graceful shutdown of the subscribers, blocking until they have all
+// terminated. It is safe to call Close more than once.
+func (m *MultiSubscriber) Close() {
+	m.shutdown()
+	<-m.done
+}
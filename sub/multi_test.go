@@ -0,0 +1,193 @@
+package sub
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/pub"
+	"github.com/vancluever/fspubsub/store"
+)
+
+type OtherEvent struct {
+	Text string
+}
+
+func TestMultiSubscriber(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	m, err := NewMultiSubscriber(dir, []interface{}{TestEvent{}, OtherEvent{}}, Durable("consumer"))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	tp, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	op, err := pub.NewPublisher(dir, OtherEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if _, err := tp.Publish(TestEvent{Text: "foo"}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if _, err := op.Publish(OtherEvent{Text: "bar"}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	var got []string
+	timeout := time.After(time.Second * 2)
+	for len(got) < 2 {
+		select {
+		case e := <-m.Queue():
+			var text string
+			switch d := e.Data.(type) {
+			case TestEvent:
+				text = d.Text
+			case OtherEvent:
+				text = d.Text
+			}
+			got = append(got, e.Stream+":"+text)
+			if err := m.Ack(e); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for events, got %q", got)
+		}
+	}
+	sort.Strings(got)
+	if expected := []string{"OtherEvent:bar", "TestEvent:foo"}; !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+	for _, name := range []string{"TestEvent", "OtherEvent"} {
+		c, err := m.Subscriber(name).ReadCheckpoint("consumer")
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		if len(c.IDs) != 1 {
+			t.Fatalf("expected %s checkpoint to cover one event, got %#v", name, c)
+		}
+	}
+
+	m.Close()
+	select {
+	case <-m.Done():
+	case <-time.After(time.Second * 2):
+		t.Fatal("timed out waiting for subscriber to stop")
+	}
+	if m.Error() != nil {
+		t.Fatalf("bad: %s", m.Error())
+	}
+}
+
+func TestMultiSubscriberError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	m, err := NewMultiSubscriber(dir, []interface{}{TestEvent{}, OtherEvent{}})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer m.Close()
+	if err := ioutil.WriteFile(dir+"/OtherEvent/bad", []byte("{\"Text\": 42}"), 0666); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	select {
+	case <-m.Done():
+	case <-time.After(time.Second * 2):
+		t.Fatal("timed out waiting for subscriber to stop")
+	}
+	if m.Error() == nil || !strings.Contains(m.Error().Error(), "error unmarshaling event data from") {
+		t.Fatalf("expected unmarshaling error, got %v", m.Error())
+	}
+	select {
+	case <-m.Subscriber("TestEvent").Done():
+	default:
+		t.Fatal("expected TestEvent subscriber to be closed")
+	}
+
+	if _, err := m.subscriberFor(store.Event{ID: "foo", Stream: "NoEvent"}); err == nil {
+		t.Fatal("expected error for unknown stream, got none")
+	}
+}
+
+func TestMultiSubscriberDuplicate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	if _, err := NewMultiSubscriber(dir, []interface{}{TestEvent{}, TestEvent{}}); err == nil {
+		t.Fatal("expected error, got none")
+	}
+}
+
+func TestMultiSubscriberDrainOnClose(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	m, err := NewMultiSubscriber(dir, []interface{}{TestEvent{}, OtherEvent{}}, QueueBufferSize(1), DrainOnClose(time.Second*2))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	op, err := pub.NewPublisher(dir, OtherEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	publishTexts(t, dir, "1", "2")
+	for _, text := range []string{"3", "4"} {
+		if _, err := op.Publish(OtherEvent{Text: text}); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+	// With nothing reading, the events back up into the queues of the
+	// subscribers for each stream.
+	queued := func() bool {
+		inner := len(m.Subscriber("TestEvent").Queue()) + len(m.Subscriber("OtherEvent").Queue())
+		return len(m.Queue()) == 1 && inner == 1
+	}
+	timeout := time.After(time.Second * 2)
+	for !queued() {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for queued events")
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	// Read slowly, so that Close has to wait.
+	var got []string
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		for {
+			time.Sleep(time.Millisecond * 50)
+			select {
+			case e := <-m.Queue():
+				switch d := e.Data.(type) {
+				case TestEvent:
+					got = append(got, d.Text)
+				case OtherEvent:
+					got = append(got, d.Text)
+				}
+			case <-m.Done():
+				return
+			}
+		}
+	}()
+	closed := make(chan struct{})
+	go func() {
+		m.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for Close to return")
+	}
+	<-read
+	sort.Strings(got)
+	if expected := []string{"1", "2", "3", "4"}; !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+}
@@ -0,0 +1,89 @@
+package sub
+
+import (
+	"fmt"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+// PoisonPolicy describes what a subscriber does with a poison event - an
+// event file that cannot be read or decoded.
+type PoisonPolicy int
+
+const (
+	// PoisonStop shuts down the subscriber, with the decoding error available
+	// in Error. This is the default.
+	PoisonStop PoisonPolicy = iota
+
+	// PoisonSkip skips the event, reporting a PoisonEventError to the handler
+	// set with OnError. The event is left in the stream.
+	PoisonSkip
+
+	// PoisonDeadLetter moves the event out of the stream and into the stream's
+	// dead-letter directory along with the decoding error, and reports a
+	// PoisonEventError to the handler set with OnError. Dead-lettered events can
+	// be inspected with store.DumpDeadLetters, and put back into the stream with
+	// store.ReplayDeadLetter.
+	PoisonDeadLetter
+)
+
+// PoisonEventError is reported when an event cannot be decoded and the
+// subscriber has skipped or dead-lettered it.
+type PoisonEventError struct {
+	// The ID of the event.
+	ID string
+
+	// The decoding error.
+	Err error
+}
+
+func (e PoisonEventError) Error() string {
+	return fmt.Sprintf("poison event %s: %s", e.ID, e.Err)
+}
+
+// OnPoison sets the policy for events that cannot be decoded, or that are
+// rejected by middleware. The default is PoisonStop.
+func OnPoison(p PoisonPolicy) Option {
+	return func(s *Subscriber) error {
+		switch p {
+		case PoisonStop, PoisonSkip, PoisonDeadLetter:
+		default:
+			return fmt.Errorf("unknown poison event policy %d", p)
+		}
+		s.poisonPolicy = p
+		return nil
+	}
+}
+
+// poison handles the event with the supplied ID that failed to decode with
+// err, according to the subscriber's poison event policy.
+//
+// Members of a consumer group complete skipped events so that no other member
+// picks them up, and release dead-lettered events so that they can be claimed
+// again once replayed.
+//
+// false is returned if the subscription should be terminated, along with the
+// reason.
+func (s *Subscriber) poison(id string, err error) (bool, error) {
+	switch s.poisonPolicy {
+	case PoisonSkip:
+		if s.group != nil {
+			if err := s.group.ack(s.Stream, store.Event{ID: id}); err != nil && !claimLost(err) {
+				return false, err
+			}
+		}
+	case PoisonDeadLetter:
+		if err := s.Stream.DeadLetter(id, err); err != nil {
+			return false, err
+		}
+		if s.group != nil {
+			if err := s.group.release(s.Stream, id); err != nil && !claimLost(err) {
+				return false, err
+			}
+		}
+	default:
+		return false, err
+	}
+	s.report(PoisonEventError{ID: id, Err: err})
+	return true, nil
+}
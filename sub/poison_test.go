@@ -0,0 +1,118 @@
+package sub
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/pub"
+	"github.com/vancluever/fspubsub/store"
+)
+
+func TestOnPoison(t *testing.T) {
+	cases := []struct {
+		Name       string
+		Policy     PoisonPolicy
+		Err        string
+		DeadLetter bool
+	}{
+		{
+			Name:   "stop",
+			Policy: PoisonStop,
+			Err:    "error unmarshaling event data from",
+		},
+		{
+			Name:   "skip",
+			Policy: PoisonSkip,
+		},
+		{
+			Name:       "dead letter",
+			Policy:     PoisonDeadLetter,
+			DeadLetter: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "subtest")
+			defer os.RemoveAll(dir)
+			var mu sync.Mutex
+			var reported []error
+			s, err := NewSubscriber(dir, TestEvent{}, OnPoison(tc.Policy), OnError(func(err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				reported = append(reported, err)
+			}))
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			defer s.Close()
+			if err := ioutil.WriteFile(dir+"/TestEvent/bad", []byte("{\"Text\": 42}"), 0666); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			p, err := pub.NewPublisher(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if _, err := p.Publish(TestEvent{Text: "good"}); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+
+			if tc.Err != "" {
+				select {
+				case <-s.Done():
+				case <-time.After(time.Second * 2):
+					t.Fatal("timed out waiting for subscriber to stop")
+				}
+				if s.Error() == nil {
+					t.Fatal("expected error, got none")
+				}
+				if !strings.Contains(s.Error().Error(), tc.Err) {
+					t.Fatalf("expected error to match %q, got %q", tc.Err, s.Error())
+				}
+				return
+			}
+			es, err := receive(s, 1)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if es[0].Data.(TestEvent).Text != "good" {
+				t.Fatalf("expected good event, got %#v", es[0])
+			}
+
+			// The poison event is not necessarily handled before the good one.
+			for i := 0; i < 200; i++ {
+				mu.Lock()
+				n := len(reported)
+				mu.Unlock()
+				if n > 0 {
+					break
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(reported) != 1 {
+				t.Fatalf("expected one reported error, got %v", reported)
+			}
+			if perr, ok := reported[0].(PoisonEventError); !ok || perr.ID != "bad" {
+				t.Fatalf("expected PoisonEventError for bad, got %#v", reported[0])
+			}
+
+			ds, err := store.DumpDeadLetters(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			_, statErr := os.Stat(dir + "/TestEvent/bad")
+			switch {
+			case tc.DeadLetter && (len(ds) != 1 || !os.IsNotExist(statErr)):
+				t.Fatalf("expected event to be dead-lettered, got %d dead letters, stat error %v", len(ds), statErr)
+			case !tc.DeadLetter && (len(ds) != 0 || statErr != nil):
+				t.Fatalf("expected event to be left in stream, got %d dead letters, stat error %v", len(ds), statErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package sub
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultPollInterval is the interval the polling watcher scans the stream
+// directory on when it is used as a fallback for inotify.
+const defaultPollInterval = time.Second
+
+// pollFile is the state of a file seen by the polling watcher.
+type pollFile struct {
+	// The size and modification time of the file on the last scan.
+	size    int64
+	modTime time.Time
+
+	// True once a notification has been sent for the file.
+	notified bool
+}
+
+// pollWatcher is a Watcher that scans the stream directory on an interval.
+type pollWatcher struct {
+	// The interval between scans.
+	interval time.Duration
+
+	// The directory being watched.
+	dir string
+
+	// The files in the directory as of the last scan.
+	files map[string]*pollFile
+
+	// The modification time of the directory as of the last full scan, and
+	// the time that scan was made.
+	dirModTime time.Time
+	scanned    time.Time
+
+	// The channel notifications are sent on.
+	out chan Notification
+
+	// Closed to stop scanning.
+	stop chan struct{}
+
+	// Makes sure stop is only closed once.
+	once sync.Once
+}
+
+// NewPollWatcher returns a Watcher that scans the stream directory every
+// interval. This works anywhere the directory can be read, including network
+// filesystems and environments without inotify, at the cost of latency.
+//
+// The directory is only read when its modification time changes, so idle
+// streams are cheap to watch. New files are not reported until their size and
+// modification time have stayed the same for one interval, so that events
+// written in place by other tools are not picked up half written.
+func NewPollWatcher(interval time.Duration) Watcher {
+	return &pollWatcher{
+		interval: interval,
+		files:    make(map[string]*pollFile),
+		out:      make(chan Notification),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Watch implements Watcher for pollWatcher. Files already in the directory
+// are not reported.
+func (w *pollWatcher) Watch(dir string) (<-chan Notification, error) {
+	w.dir = dir
+	if _, err := w.scan(true); err != nil {
+		return nil, err
+	}
+	go w.poll()
+	return w.out, nil
+}
+
+// Stop implements Watcher for pollWatcher.
+func (w *pollWatcher) Stop() {
+	w.once.Do(func() { close(w.stop) })
+}
+
+// poll scans the directory on the interval until the watcher is stopped.
+func (w *pollWatcher) poll() {
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			ids, err := w.scan(false)
+			if err != nil {
+				// The directory may be temporarily unavailable, such as during a
+				// network outage. Anything missed is picked up by a later scan.
+				continue
+			}
+			for _, id := range ids {
+				select {
+				case w.out <- Notification{ID: id}:
+				case <-w.stop:
+					return
+				}
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// scan reads the directory, returning the IDs of the files that are new and
+// have settled since the last scan. If initial is true, all files found are
+// treated as already reported.
+func (w *pollWatcher) scan(initial bool) ([]string, error) {
+	fi, err := os.Stat(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	// The directory modification time only has to change if entries are added
+	// or removed, and may have a coarse granularity, so only skip the read
+	// when it has not changed for some time and no files are still settling.
+	if !initial && fi.ModTime().Equal(w.dirModTime) && w.scanned.Sub(w.dirModTime) > time.Second && !w.settling() {
+		return nil, nil
+	}
+	now := time.Now()
+	entries, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	w.dirModTime = fi.ModTime()
+	w.scanned = now
+
+	var ids []string
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		seen[e.Name()] = true
+		f, ok := w.files[e.Name()]
+		if !ok {
+			w.files[e.Name()] = &pollFile{size: e.Size(), modTime: e.ModTime(), notified: initial}
+			continue
+		}
+		if f.notified {
+			continue
+		}
+		if f.size == e.Size() && f.modTime.Equal(e.ModTime()) {
+			f.notified = true
+			ids = append(ids, e.Name())
+			continue
+		}
+		f.size = e.Size()
+		f.modTime = e.ModTime()
+	}
+	// Forget files that have gone away, so that they are reported again if
+	// they come back.
+	for name := range w.files {
+		if !seen[name] {
+			delete(w.files, name)
+		}
+	}
+	return ids, nil
+}
+
+// settling returns true if any files have been seen but not reported yet.
+func (w *pollWatcher) settling() bool {
+	for _, f := range w.files {
+		if !f.notified {
+			return true
+		}
+	}
+	return false
+}
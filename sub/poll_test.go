@@ -0,0 +1,58 @@
+package sub
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/pub"
+)
+
+func TestPollWatcher(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	p, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if _, err := p.Publish(TestEvent{Text: "old"}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	s, err := NewSubscriber(dir, TestEvent{}, UseWatcher(NewPollWatcher(time.Millisecond*50)))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer s.Close()
+	if _, err := p.Publish(TestEvent{Text: "published"}); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// Written in place, in two parts, as another tool might. The pause is
+	// shorter than the poll interval, so the file never looks settled while
+	// half written.
+	b, _ := json.Marshal(TestEvent{Text: "written"})
+	f, err := os.Create(dir + "/TestEvent/written")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	f.Write(b[:5])
+	time.Sleep(time.Millisecond * 20)
+	f.Write(b[5:])
+	f.Close()
+
+	es, err := receive(s, 2)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	select {
+	case e := <-s.Queue():
+		t.Fatalf("unexpected event %#v", e)
+	case <-time.After(time.Millisecond * 200):
+	}
+	if expected, actual := []string{"published", "written"}, eventTexts(es); !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+}
@@ -0,0 +1,516 @@
+package sub
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+// defaultDrainTimeout is the default amount of time a processor waits for
+// in-flight handlers to finish when shutting down.
+const defaultDrainTimeout = time.Second * 30
+
+// keyBacklog is the number of events a processor ordering events by key holds
+// while they wait for earlier events with the same key to be handled.
+const keyBacklog = 100
+
+// ErrDrainTimeout is returned by Processor.Close when the in-flight handlers
+// did not finish within the drain timeout.
+var ErrDrainTimeout = errors.New("timed out waiting for handlers to finish")
+
+// Handler handles a single event. A handler that returns an error is retried
+// according to the processor's retry policy.
+type Handler func(store.Event) error
+
+// PanicError is the error a handler call fails with when the handler panics.
+type PanicError struct {
+	// The ID of the event being handled.
+	ID string
+
+	// The value passed to panic.
+	Value interface{}
+
+	// The stack trace of the goroutine that panicked.
+	Stack []byte
+}
+
+// Error implements error for PanicError.
+func (e PanicError) Error() string {
+	return fmt.Sprintf("handler panicked on event %s: %v", e.ID, e.Value)
+}
+
+// Source is a subscription that a Processor reads events from. Subscriber and
+// MultiSubscriber are both sources.
+type Source interface {
+	Queue() <-chan store.Event
+	Done() <-chan struct{}
+	Error() error
+	Close()
+}
+
+// acker is a source that events can be acknowledged with.
+type acker interface {
+	Ack(store.Event) error
+
+	// acknowledges returns true if events from the source need to be
+	// acknowledged.
+	acknowledges() bool
+}
+
+// acknowledges implements acker for Subscriber.
+func (s *Subscriber) acknowledges() bool {
+	return s.durable != nil || s.group != nil || s.redelivery != nil
+}
+
+// acknowledges implements acker for MultiSubscriber. The same options are
+// applied to the subscriber for each stream, so any one of them can answer.
+func (m *MultiSubscriber) acknowledges() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.subs {
+		return s.acknowledges()
+	}
+	return false
+}
+
+// drainer is a source that can keep delivering events after it is closed.
+type drainer interface {
+	// drains returns true if the source delivers the events left in its
+	// queue after it is closed, until it terminates.
+	drains() bool
+}
+
+// drains implements drainer for Subscriber.
+func (s *Subscriber) drains() bool {
+	return s.closePolicy == closeDrain
+}
+
+// drains implements drainer for MultiSubscriber. The same options are applied
+// to the subscriber for each stream, so any one of them can answer.
+func (m *MultiSubscriber) drains() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.subs {
+		return s.drains()
+	}
+	return false
+}
+
+// Processor runs a handler for each event from a source, on a pool of
+// workers.
+//
+// Events that are handled successfully are acknowledged with the source, if
+// it is a durable consumer, a member of a consumer group, or in at-least-once
+// mode. Events that still fail after all retries are passed to the failure
+// handler set with OnFailure, and are not acknowledged.
+type Processor struct {
+	// The source of the events.
+	src Source
+
+	// The handler run for each event.
+	handler Handler
+
+	// The number of workers.
+	workers int
+
+	// The function giving the ordering key for an event, if events with the
+	// same key are to be handled in order.
+	key func(store.Event) string
+
+	// The maximum number of attempts for each event, and the bounds of the
+	// delay between them.
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+
+	// The handler for events that still fail after all retries.
+	onFailure func(store.Event, error)
+
+	// The amount of time to wait for in-flight handlers on shutdown.
+	drainTimeout time.Duration
+
+	// Closed to stop dispatching events and abort any pending retries.
+	stop chan struct{}
+
+	// Makes sure stop is only closed once.
+	once sync.Once
+
+	// The internal completion channel. Call Done to get a valid one-way
+	// completion channel.
+	done chan struct{}
+
+	// Set when the handlers did not finish within the drain timeout.
+	timedOut bool
+}
+
+// ProcessorOption is a functional option that can be passed to NewProcessor
+// to change the behavior of the processor.
+type ProcessorOption func(*Processor) error
+
+// Workers sets the number of workers that run the handler concurrently. The
+// default is one.
+func Workers(n int) ProcessorOption {
+	return func(p *Processor) error {
+		if n < 1 {
+			return errors.New("number of workers must be at least 1")
+		}
+		p.workers = n
+		return nil
+	}
+}
+
+// OrderByKey makes the processor handle events with the same key, as given by
+// f, one at a time and in the order they were received. Events with different
+// keys are still handled concurrently - events waiting behind a slow event are
+// queued by key, so they do not hold up the events for other keys. Up to 100
+// events are queued, after which the processor stops taking events from the
+// source until the queue drains.
+func OrderByKey(f func(store.Event) string) ProcessorOption {
+	return func(p *Processor) error {
+		p.key = f
+		return nil
+	}
+}
+
+// Retry makes the processor retry failed handler calls, up to maxAttempts
+// attempts in total. The delay between attempts starts at min and doubles
+// after each attempt, up to max. Retries of an event hold up the worker
+// handling it, and any events ordered after it.
+func Retry(maxAttempts int, min, max time.Duration) ProcessorOption {
+	return func(p *Processor) error {
+		if maxAttempts < 1 {
+			return errors.New("max attempts must be at least 1")
+		}
+		if min <= 0 || max < min {
+			return errors.New("backoff must be greater than zero, with max at least min")
+		}
+		p.maxAttempts = maxAttempts
+		p.minBackoff = min
+		p.maxBackoff = max
+		return nil
+	}
+}
+
+// OnFailure sets a handler for events that still fail after all retries. It
+// is called from the worker that handled the event. Failures, including any
+// failure to acknowledge a handled event, are discarded if no handler is set.
+func OnFailure(f func(store.Event, error)) ProcessorOption {
+	return func(p *Processor) error {
+		p.onFailure = f
+		return nil
+	}
+}
+
+// DrainTimeout sets the amount of time the processor waits for in-flight
+// handlers to finish when it shuts down. The default is 30 seconds.
+func DrainTimeout(d time.Duration) ProcessorOption {
+	return func(p *Processor) error {
+		if d <= 0 {
+			return errors.New("drain timeout must be greater than zero")
+		}
+		p.drainTimeout = d
+		return nil
+	}
+}
+
+// NewProcessor starts running the handler h for the events from src.
+//
+// The processor owns src from this point on - it closes src when the
+// processor is closed, and shuts down when src terminates. Use the processor's
+// Done and Error functions in place of the source's.
+func NewProcessor(src Source, h Handler, opts ...ProcessorOption) (*Processor, error) {
+	p := &Processor{
+		src:          src,
+		handler:      h,
+		workers:      1,
+		maxAttempts:  1,
+		drainTimeout: defaultDrainTimeout,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(p); err != nil {
+			return nil, err
+		}
+	}
+	go p.run()
+	return p, nil
+}
+
+// job is an event handed to a worker, with its ordering key.
+type job struct {
+	event store.Event
+	key   string
+}
+
+// keyQueue holds the events taken off the source that have not been handed to
+// a worker yet, queued by key. Only one event for each key is handled at a
+// time. Without ordering, all events share the empty key, and are not held
+// back by events being handled.
+type keyQueue struct {
+	// The queued events for each key.
+	events map[string][]store.Event
+
+	// The keys with an event ready to be handled, in the order they became
+	// ready.
+	ready []string
+
+	// The keys with an event being handled, if events are ordered.
+	busy map[string]bool
+
+	// True if events are ordered by key.
+	ordered bool
+
+	// The number of queued events.
+	n int
+}
+
+// newKeyQueue returns an empty queue.
+func newKeyQueue(ordered bool) *keyQueue {
+	return &keyQueue{
+		events:  make(map[string][]store.Event),
+		busy:    make(map[string]bool),
+		ordered: ordered,
+	}
+}
+
+// add queues the event e under key.
+func (q *keyQueue) add(e store.Event, key string) {
+	q.events[key] = append(q.events[key], e)
+	q.n++
+	if len(q.events[key]) == 1 && !q.busy[key] {
+		q.ready = append(q.ready, key)
+	}
+}
+
+// next returns the next event ready to be handled, if any.
+func (q *keyQueue) next() (job, bool) {
+	if len(q.ready) == 0 {
+		return job{}, false
+	}
+	key := q.ready[0]
+	return job{event: q.events[key][0], key: key}, true
+}
+
+// take removes the event returned by next, once it has been handed to a
+// worker.
+func (q *keyQueue) take() {
+	key := q.ready[0]
+	q.ready = q.ready[1:]
+	q.n--
+	if q.events[key] = q.events[key][1:]; len(q.events[key]) == 0 {
+		delete(q.events, key)
+	}
+	if !q.ordered {
+		if len(q.events[key]) > 0 {
+			q.ready = append(q.ready, key)
+		}
+		return
+	}
+	q.busy[key] = true
+}
+
+// finish marks the event being handled for key as finished, readying the next
+// event queued for it.
+func (q *keyQueue) finish(key string) {
+	delete(q.busy, key)
+	if len(q.events[key]) > 0 {
+		q.ready = append(q.ready, key)
+	}
+}
+
+// run dispatches events to the workers until the source terminates or the
+// processor is closed, then waits for the workers to finish.
+func (p *Processor) run() {
+	// Without ordering, events are handed off one at a time. With ordering,
+	// events are queued by key, and the workers report back when they finish
+	// an event, so the next event for its key can be handed off.
+	work := make(chan job)
+	var finished chan string
+	dispatching := make(chan struct{})
+	backlog := 1
+	if p.key != nil {
+		finished = make(chan string)
+		backlog = keyBacklog
+	}
+	q := newKeyQueue(p.key != nil)
+	// A source that drains its queue on close is read from until it
+	// terminates, so that the events it drains are handled.
+	stop := p.stop
+	d, drains := p.src.(drainer)
+	drains = drains && d.drains()
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go p.work(work, finished, dispatching, &wg)
+	}
+
+dispatch:
+	for {
+		var in <-chan store.Event
+		if q.n < backlog {
+			in = p.src.Queue()
+		}
+		var out chan job
+		j, ok := q.next()
+		if ok {
+			out = work
+		}
+		select {
+		case e := <-in:
+			var key string
+			if p.key != nil {
+				key = p.key(e)
+			}
+			q.add(e, key)
+		case out <- j:
+			q.take()
+		case key := <-finished:
+			q.finish(key)
+		case <-p.src.Done():
+			break dispatch
+		case <-stop:
+			if !drains {
+				break dispatch
+			}
+			stop = nil
+		}
+	}
+
+	// The queued events count as in flight, so they are still handled if
+	// workers free up before the drain timeout.
+	deadline := time.After(p.drainTimeout)
+drain:
+	for q.n > 0 {
+		var out chan job
+		j, ok := q.next()
+		if ok {
+			out = work
+		}
+		select {
+		case out <- j:
+			q.take()
+		case key := <-finished:
+			q.finish(key)
+		case <-deadline:
+			p.timedOut = true
+			break drain
+		}
+	}
+	close(dispatching)
+	close(work)
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	if !p.timedOut {
+		select {
+		case <-drained:
+		case <-deadline:
+			p.timedOut = true
+		}
+	}
+	p.shutdown()
+	<-p.src.Done()
+	close(p.done)
+}
+
+// work runs the handler for the jobs on c until it is closed. If finished is
+// not nil, the key of each job is reported on it once the job is done, until
+// dispatching is closed.
+func (p *Processor) work(c <-chan job, finished chan<- string, dispatching <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for j := range c {
+		if err := p.process(j.event); err != nil && p.onFailure != nil {
+			p.onFailure(j.event, err)
+		}
+		if finished != nil {
+			select {
+			case finished <- j.key:
+			case <-dispatching:
+			}
+		}
+	}
+}
+
+// process runs the handler for the event e, retrying according to the retry
+// policy, and acknowledges e with the source if it succeeds. Retries are
+// abandoned if the processor shuts down.
+func (p *Processor) process(e store.Event) error {
+	backoff := p.minBackoff
+	var err error
+	for attempt := 1; attempt <= p.maxAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(backoff):
+			case <-p.stop:
+				return err
+			}
+			if backoff *= 2; backoff > p.maxBackoff {
+				backoff = p.maxBackoff
+			}
+		}
+		if err = p.call(e); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if a, ok := p.src.(acker); ok && a.acknowledges() {
+		return a.Ack(e)
+	}
+	return nil
+}
+
+// call runs the handler for the event e, recovering from any panic.
+func (p *Processor) call(e store.Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = PanicError{ID: e.ID, Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return p.handler(e)
+}
+
+// shutdown stops dispatching and closes the source.
+func (p *Processor) shutdown() {
+	p.once.Do(func() {
+		close(p.stop)
+		p.src.Close()
+	})
+}
+
+// Done returns a channel that closes once the processor has shut down, either
+// because it was closed or because the source terminated.
+func (p *Processor) Done() <-chan struct{} {
+	return p.done
+}
+
+// Error returns the reason the source terminated, if it was for any reason
+// other than the processor being closed. Make sure to block on done before
+// checking this value.
+func (p *Processor) Error() error {
+	return p.src.Error()
+}
+
+// Close shuts down the processor gracefully. No new events are handled, and
+// Close waits for the in-flight handlers to finish, up to the drain timeout.
+// If the source drains its queue on close, as set with DrainOnClose, the
+// events it drains are handled too, and the drain timeout starts once the
+// source has terminated.
+// ErrDrainTimeout is returned if they did not finish in time - any handlers
+// still running are left to finish in the background.
+func (p *Processor) Close() error {
+	p.shutdown()
+	<-p.done
+	if p.timedOut {
+		return ErrDrainTimeout
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package sub
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/pub"
+	"github.com/vancluever/fspubsub/store"
+)
+
+// testSource is a Source that delivers events sent to it by the test, in
+// order.
+type testSource struct {
+	queue chan store.Event
+	done  chan struct{}
+}
+
+func newTestSource() *testSource {
+	return &testSource{
+		queue: make(chan store.Event),
+		done:  make(chan struct{}),
+	}
+}
+
+func (s *testSource) Queue() <-chan store.Event { return s.queue }
+func (s *testSource) Done() <-chan struct{}     { return s.done }
+func (s *testSource) Error() error              { return nil }
+func (s *testSource) Close()                    { close(s.done) }
+
+// send sends the events with the supplied texts to the processor.
+func (s *testSource) send(t *testing.T, texts ...string) {
+	for _, text := range texts {
+		select {
+		case s.queue <- store.Event{ID: text, Data: TestEvent{Text: text}}:
+		case <-time.After(time.Second * 2):
+			t.Fatalf("timed out sending event %s", text)
+		}
+	}
+}
+
+func TestProcessorFailures(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Opts     []ProcessorOption
+		Handler  func(calls int) error
+		Calls    int
+		Failures int
+		Err      interface{}
+	}{
+		{
+			Name:    "success",
+			Handler: func(calls int) error { return nil },
+			Calls:   1,
+		},
+		{
+			Name:     "no retries",
+			Handler:  func(calls int) error { return errors.New("failed") },
+			Calls:    1,
+			Failures: 1,
+		},
+		{
+			Name: "succeeds on retry",
+			Opts: []ProcessorOption{Retry(3, time.Millisecond*10, time.Millisecond*20)},
+			Handler: func(calls int) error {
+				if calls < 3 {
+					return errors.New("failed")
+				}
+				return nil
+			},
+			Calls: 3,
+		},
+		{
+			Name:     "retries exhausted",
+			Opts:     []ProcessorOption{Retry(3, time.Millisecond*10, time.Millisecond*20)},
+			Handler:  func(calls int) error { return errors.New("failed") },
+			Calls:    3,
+			Failures: 1,
+		},
+		{
+			Name:     "panic",
+			Handler:  func(calls int) error { panic("boom") },
+			Calls:    1,
+			Failures: 1,
+			Err:      PanicError{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var mu sync.Mutex
+			var calls int
+			var failures []error
+			src := newTestSource()
+			opts := append(tc.Opts, OnFailure(func(e store.Event, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				failures = append(failures, err)
+			}))
+			p, err := NewProcessor(src, func(e store.Event) error {
+				mu.Lock()
+				calls++
+				n := calls
+				mu.Unlock()
+				return tc.Handler(n)
+			}, opts...)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			src.send(t, "foo")
+			time.Sleep(time.Millisecond * 100)
+			if err := p.Close(); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if calls != tc.Calls {
+				t.Fatalf("expected %d calls, got %d", tc.Calls, calls)
+			}
+			if len(failures) != tc.Failures {
+				t.Fatalf("expected %d failures, got %v", tc.Failures, failures)
+			}
+			if tc.Err != nil && reflect.TypeOf(failures[0]) != reflect.TypeOf(tc.Err) {
+				t.Fatalf("expected %T, got %#v", tc.Err, failures[0])
+			}
+		})
+	}
+}
+
+func TestProcessorOrderByKey(t *testing.T) {
+	var mu sync.Mutex
+	handled := make(map[string][]string)
+	src := newTestSource()
+	p, err := NewProcessor(src, func(e store.Event) error {
+		text := e.Data.(TestEvent).Text
+		// Later events for a key finish faster, so they would overtake earlier
+		// ones if handled concurrently.
+		time.Sleep(time.Millisecond * time.Duration(5*('5'-text[1])))
+		mu.Lock()
+		defer mu.Unlock()
+		handled[text[:1]] = append(handled[text[:1]], text)
+		return nil
+	}, Workers(4), OrderByKey(func(e store.Event) string { return e.Data.(TestEvent).Text[:1] }))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	expected := make(map[string][]string)
+	for _, key := range []string{"a", "b", "c"} {
+		for i := 0; i < 5; i++ {
+			expected[key] = append(expected[key], fmt.Sprintf("%s%d", key, i))
+		}
+	}
+	for i := 0; i < 5; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			src.send(t, expected[key][i])
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if !reflect.DeepEqual(expected, handled) {
+		t.Fatalf("expected %q, got %q", expected, handled)
+	}
+}
+
+func TestProcessorOrderByKeyBlocked(t *testing.T) {
+	release := make(chan struct{})
+	handled := make(chan string, 10)
+	src := newTestSource()
+	p, err := NewProcessor(src, func(e store.Event) error {
+		text := e.Data.(TestEvent).Text
+		if text == "a0" {
+			<-release
+		}
+		handled <- text
+		return nil
+	}, Workers(2), OrderByKey(func(e store.Event) string { return e.Data.(TestEvent).Text[:1] }))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// Events for b are handled while a0 blocks, even with a1 waiting behind it.
+	src.send(t, "a0", "a1", "b0", "b1", "b2")
+	var got []string
+	timeout := time.After(time.Second * 2)
+	for len(got) < 3 {
+		select {
+		case text := <-handled:
+			got = append(got, text)
+		case <-timeout:
+			t.Fatalf("timed out waiting for events, got %q", got)
+		}
+	}
+	if expected := []string{"b0", "b1", "b2"}; !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+	close(release)
+	if err := p.Close(); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	close(handled)
+	got = nil
+	for text := range handled {
+		got = append(got, text)
+	}
+	if expected := []string{"a0", "a1"}; !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestProcessorDrainTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	src := newTestSource()
+	p, err := NewProcessor(src, func(e store.Event) error {
+		close(started)
+		<-release
+		return nil
+	}, DrainTimeout(time.Millisecond*50))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	src.send(t, "foo")
+	<-started
+	if err := p.Close(); err != ErrDrainTimeout {
+		t.Fatalf("expected %q, got %v", ErrDrainTimeout, err)
+	}
+}
+
+func TestProcessorAck(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	s, err := NewSubscriber(dir, TestEvent{}, Durable("consumer"))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	handled := make(chan string, 1)
+	p, err := NewProcessor(s, func(e store.Event) error {
+		handled <- e.ID
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	pb, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	id, err := pb.Publish(TestEvent{Text: "foo"})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	select {
+	case <-handled:
+	case <-time.After(time.Second * 2):
+		t.Fatal("timed out waiting for event")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	c, err := s.ReadCheckpoint("consumer")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if !reflect.DeepEqual([]string{id}, c.IDs) {
+		t.Fatalf("expected checkpoint at %s, got %#v", id, c)
+	}
+}
+
+func TestProcessorDrainingSource(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	s, err := NewSubscriber(dir, TestEvent{}, DrainOnClose(time.Second*2))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var handled []string
+	p, err := NewProcessor(s, func(e store.Event) error {
+		started <- struct{}{}
+		<-release
+		mu.Lock()
+		handled = append(handled, e.Data.(TestEvent).Text)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// The first event holds up the worker, the second waits to be dispatched,
+	// and the third is left in the subscriber's queue.
+	publishTexts(t, dir, "1")
+	<-started
+	publishTexts(t, dir, "2", "3")
+	waitQueued(t, s, 1)
+	time.Sleep(time.Millisecond * 50)
+
+	closed := make(chan error)
+	go func() {
+		closed <- p.Close()
+	}()
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for Close to return")
+	}
+	if expected := []string{"1", "2", "3"}; !reflect.DeepEqual(expected, handled) {
+		t.Fatalf("expected %q, got %q", expected, handled)
+	}
+}
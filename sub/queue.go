@@ -0,0 +1,131 @@
+package sub
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+// ErrQueueFull is the error a subscription terminates with when an event
+// cannot be sent because the queue is full, under the QueueFullFail policy.
+var ErrQueueFull = errors.New("subscriber queue is full")
+
+// QueueFullPolicy describes what a subscriber does with an event when its
+// queue is full.
+type QueueFullPolicy int
+
+const (
+	// QueueFullBlock waits for the consumer to make room in the queue. While
+	// waiting, filesystem notifications are not being read, so they may be
+	// dropped and picked up later by a resync. This is the default.
+	QueueFullBlock QueueFullPolicy = iota
+
+	// QueueFullDropOldest discards the oldest event in the queue to make room
+	// for the new one.
+	QueueFullDropOldest
+
+	// QueueFullDropNewest discards the new event, leaving the queue as it is.
+	QueueFullDropNewest
+
+	// QueueFullFail terminates the subscription with ErrQueueFull.
+	QueueFullFail
+)
+
+// NotifyBufferSize sets the size of the buffer for filesystem notifications.
+// The notifier drops notifications when this buffer is full, which the
+// subscriber recovers from with a resync, so this should be large enough to
+// absorb bursts of published events. The buffer must hold at least two
+// notifications.
+func NotifyBufferSize(n int) Option {
+	return func(s *Subscriber) error {
+		if n < 2 {
+			return errors.New("notify buffer size must be at least 2")
+		}
+		s.notifyBufferSize = n
+		return nil
+	}
+}
+
+// QueueBufferSize sets the size of the buffer for the channel returned by
+// Queue. A size of zero makes the queue unbuffered.
+func QueueBufferSize(n int) Option {
+	return func(s *Subscriber) error {
+		if n < 0 {
+			return errors.New("queue buffer size cannot be negative")
+		}
+		s.queueBufferSize = n
+		return nil
+	}
+}
+
+// OnQueueFull sets the policy for events that are ready to be delivered while
+// the queue is full. Dropped events are counted in Stats. In at-least-once
+// mode, dropped events are still redelivered once their visibility timeout
+// expires.
+func OnQueueFull(p QueueFullPolicy) Option {
+	return func(s *Subscriber) error {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		s.queueFullPolicy = p
+		return nil
+	}
+}
+
+// validate returns an error if p is not a known queue-full policy.
+func (p QueueFullPolicy) validate() error {
+	switch p {
+	case QueueFullBlock, QueueFullDropOldest, QueueFullDropNewest, QueueFullFail:
+		return nil
+	}
+	return fmt.Errorf("unknown queue-full policy %d", p)
+}
+
+// enqueue puts the event e on the queue according to the queue-full policy.
+// Under QueueFullBlock, the send is aborted if the subscription terminates
+// first.
+//
+// false is returned if the subscription was terminated, along with the
+// reason.
+func (s *Subscriber) enqueue(e store.Event) (bool, error) {
+	return enqueue(s.queue, e, s.queueFullPolicy, s.stop, &s.stats.Dropped)
+}
+
+// enqueue puts the event e on the queue q according to the queue-full policy
+// p, counting dropped events in dropped. Under QueueFullBlock, the send is
+// aborted if stop is closed first.
+//
+// false is returned if the send was aborted or failed, along with the reason.
+func enqueue(q chan store.Event, e store.Event, p QueueFullPolicy, stop <-chan struct{}, dropped *uint64) (bool, error) {
+	if p == QueueFullBlock {
+		select {
+		case q <- e:
+			return true, nil
+		case <-stop:
+			return false, nil
+		}
+	}
+	for {
+		select {
+		case q <- e:
+			return true, nil
+		default:
+		}
+		switch p {
+		case QueueFullDropNewest:
+			atomic.AddUint64(dropped, 1)
+			return true, nil
+		case QueueFullFail:
+			return false, ErrQueueFull
+		}
+		// Drop the oldest event. The consumer may have taken it already, in
+		// which case there is room now.
+		select {
+		case <-q:
+			atomic.AddUint64(dropped, 1)
+		default:
+		}
+	}
+}
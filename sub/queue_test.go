@@ -0,0 +1,122 @@
+package sub
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/pub"
+)
+
+func TestOnQueueFull(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Policy   QueueFullPolicy
+		Received int
+		Dropped  uint64
+		Err      error
+	}{
+		{
+			Name:     "block",
+			Policy:   QueueFullBlock,
+			Received: 3,
+		},
+		{
+			Name:     "drop oldest",
+			Policy:   QueueFullDropOldest,
+			Received: 1,
+			Dropped:  2,
+		},
+		{
+			Name:     "drop newest",
+			Policy:   QueueFullDropNewest,
+			Received: 1,
+			Dropped:  2,
+		},
+		{
+			Name:   "fail",
+			Policy: QueueFullFail,
+			Err:    ErrQueueFull,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "subtest")
+			defer os.RemoveAll(dir)
+			s, err := NewSubscriber(dir, TestEvent{}, QueueBufferSize(1), OnQueueFull(tc.Policy))
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			defer s.Close()
+			p, err := pub.NewPublisher(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			for _, text := range []string{"0", "1", "2"} {
+				if _, err := p.Publish(TestEvent{Text: text}); err != nil {
+					t.Fatalf("bad: %s", err)
+				}
+			}
+
+			if tc.Err != nil {
+				select {
+				case <-s.Done():
+				case <-time.After(time.Second * 2):
+					t.Fatal("timed out waiting for subscriber to stop")
+				}
+				if s.Error() != tc.Err {
+					t.Fatalf("expected error %q, got %q", tc.Err, s.Error())
+				}
+				return
+			}
+
+			// Let the subscriber fill the queue before reading from it. The
+			// order notifications arrive in is not deterministic, so only the
+			// number of events is checked.
+			time.Sleep(time.Millisecond * 200)
+			var received int
+		loop:
+			for {
+				select {
+				case <-s.Queue():
+					received++
+				case <-time.After(time.Millisecond * 200):
+					break loop
+				}
+			}
+			if received != tc.Received {
+				t.Fatalf("expected %d events, got %d", tc.Received, received)
+			}
+			if actual := s.Stats().Dropped; actual != tc.Dropped {
+				t.Fatalf("expected %d dropped events, got %d", tc.Dropped, actual)
+			}
+		})
+	}
+}
+
+func TestBufferSizeOptions(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	if _, err := NewSubscriber(dir, TestEvent{}, NotifyBufferSize(0)); err == nil {
+		t.Fatal("expected error for notify buffer size, got none")
+	}
+	if _, err := NewSubscriber(dir, TestEvent{}, NotifyBufferSize(1)); err == nil {
+		t.Fatal("expected error for notify buffer size of one, got none")
+	}
+	if _, err := NewSubscriber(dir, TestEvent{}, QueueBufferSize(-1)); err == nil {
+		t.Fatal("expected error for queue buffer size, got none")
+	}
+	if _, err := NewSubscriber(dir, TestEvent{}, OnQueueFull(QueueFullPolicy(99))); err == nil {
+		t.Fatal("expected error for unknown queue-full policy, got none")
+	}
+	s, err := NewSubscriber(dir, TestEvent{}, NotifyBufferSize(64), QueueBufferSize(0))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer s.Close()
+	if cap(s.Queue()) != 0 {
+		t.Fatalf("expected unbuffered queue, got capacity %d", cap(s.Queue()))
+	}
+}
@@ -0,0 +1,185 @@
+package sub
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+// MaxAttemptsError is reported when an event is given up on after it has
+// been delivered the maximum number of times without being acknowledged.
+type MaxAttemptsError struct {
+	// The event that was given up on. Attempt holds the number of times it was
+	// delivered.
+	Event store.Event
+}
+
+func (e MaxAttemptsError) Error() string {
+	return fmt.Sprintf("event %s not acknowledged after %d delivery attempts", e.Event.ID, e.Event.Attempt)
+}
+
+// delivery is an event that has been delivered but not acknowledged.
+type delivery struct {
+	// The event, as it was last delivered.
+	event store.Event
+
+	// The time after which the event is delivered again.
+	deadline time.Time
+}
+
+// redelivery holds the state for at-least-once delivery.
+type redelivery struct {
+	// The visibility timeout - the time an event can go unacknowledged before
+	// it is delivered again.
+	timeout time.Duration
+
+	// The maximum number of delivery attempts for an event. Zero means no
+	// limit.
+	maxAttempts int
+
+	// Protects inflight.
+	mu sync.Mutex
+
+	// The events that are awaiting acknowledgement, keyed by ID.
+	inflight map[string]*delivery
+
+	// Signals the watcher goroutine that an event has been negatively
+	// acknowledged. This is buffered so that Nack never blocks.
+	wake chan struct{}
+}
+
+// AtLeastOnce turns on at-least-once delivery for the subscriber.
+//
+// In this mode, each event delivered on the queue must be acknowledged with
+// Ack once it has been processed. An event that has not been acknowledged
+// within the visibility timeout is delivered again, as is an event that has
+// been negatively acknowledged with Nack. The Attempt field of a delivered
+// event holds the number of times it has been delivered, starting at 1.
+//
+// The visibility timeout starts when the event is sent to the queue, so it
+// should allow for the time that events can spend waiting in the queue buffer.
+//
+// If maxAttempts is greater than zero, an event is given up on once it has
+// been delivered that many times without being acknowledged, and a
+// MaxAttemptsError is reported to the handler set with OnError. Members of a
+// consumer group mark given up events as completed, so that the event is not
+// picked up by another member, and durable consumers move their checkpoint
+// past them.
+func AtLeastOnce(timeout time.Duration, maxAttempts int) Option {
+	return func(s *Subscriber) error {
+		if timeout <= 0 {
+			return errors.New("visibility timeout must be greater than zero")
+		}
+		if maxAttempts < 0 {
+			return errors.New("maximum delivery attempts cannot be negative")
+		}
+		s.redelivery = &redelivery{
+			timeout:     timeout,
+			maxAttempts: maxAttempts,
+			inflight:    make(map[string]*delivery),
+			wake:        make(chan struct{}, 1),
+		}
+		return nil
+	}
+}
+
+// track records the event e as awaiting acknowledgement.
+func (r *redelivery) track(e store.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inflight[e.ID] = &delivery{
+		event:    e,
+		deadline: time.Now().Add(r.timeout),
+	}
+}
+
+// ack removes the event with the supplied ID from the events awaiting
+// acknowledgement.
+func (r *redelivery) ack(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.inflight, id)
+}
+
+// nack marks the event with the supplied ID for immediate redelivery.
+func (r *redelivery) nack(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.inflight[id]
+	if !ok {
+		return fmt.Errorf("event %s is not awaiting acknowledgement", id)
+	}
+	d.deadline = time.Time{}
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// expired removes the events whose visibility timeout has passed from the
+// events awaiting acknowledgement and returns them, in the order they were
+// due.
+func (r *redelivery) expired() []store.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	var ds []*delivery
+	for id, d := range r.inflight {
+		if d.deadline.After(now) {
+			continue
+		}
+		ds = append(ds, d)
+		delete(r.inflight, id)
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i].deadline.Before(ds[j].deadline) })
+	es := make([]store.Event, len(ds))
+	for i, d := range ds {
+		es[i] = d.event
+	}
+	return es
+}
+
+// redeliver delivers the events whose visibility timeout has passed again,
+// giving up on those that have reached the maximum number of attempts.
+//
+// false is returned if the subscription was terminated while delivering, along
+// with the reason.
+func (s *Subscriber) redeliver() (bool, error) {
+	for _, e := range s.redelivery.expired() {
+		if s.redelivery.maxAttempts > 0 && e.Attempt >= s.redelivery.maxAttempts {
+			if s.group != nil {
+				if err := s.group.ack(s.Stream, e); err != nil && !claimLost(err) {
+					return false, err
+				}
+			}
+			if s.durable != nil {
+				if err := s.durable.ack(s.Stream, e); err != nil {
+					return false, err
+				}
+			}
+			s.report(MaxAttemptsError{Event: e})
+			continue
+		}
+		if ok, err := s.send(e); !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Nack negatively acknowledges the event e, delivering it again straight
+// away rather than waiting for the visibility timeout to pass.
+//
+// An error is returned if the subscriber is not in at-least-once mode, or if
+// the event is not awaiting acknowledgement.
+func (s *Subscriber) Nack(e store.Event) error {
+	if s.redelivery == nil {
+		return errors.New("subscriber is not in at-least-once mode")
+	}
+	return s.redelivery.nack(e.ID)
+}
@@ -0,0 +1,123 @@
+package sub
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/pub"
+	"github.com/vancluever/fspubsub/store"
+)
+
+func TestAtLeastOnce(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Timeout  time.Duration
+		Handle   func(*Subscriber, store.Event) error
+		Attempts []int
+		GivenUp  bool
+	}{
+		{
+			Name:     "acknowledged",
+			Timeout:  time.Millisecond * 100,
+			Handle:   func(s *Subscriber, e store.Event) error { return s.Ack(e) },
+			Attempts: []int{1},
+		},
+		{
+			Name:     "visibility timeout",
+			Timeout:  time.Millisecond * 100,
+			Handle:   func(s *Subscriber, e store.Event) error { return nil },
+			Attempts: []int{1, 2, 3},
+			GivenUp:  true,
+		},
+		{
+			Name:    "negative acknowledgement",
+			Timeout: time.Minute,
+			Handle: func(s *Subscriber, e store.Event) error {
+				if e.Attempt < 3 {
+					return s.Nack(e)
+				}
+				return s.Ack(e)
+			},
+			Attempts: []int{1, 2, 3},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "subtest")
+			defer os.RemoveAll(dir)
+			var reported []error
+			s, err := NewSubscriber(dir, TestEvent{}, AtLeastOnce(tc.Timeout, 3), OnError(func(err error) { reported = append(reported, err) }))
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			p, err := pub.NewPublisher(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			id, err := p.Publish(TestEvent{Text: "foo"})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+
+			var attempts []int
+			timeout := time.After(time.Second * 2)
+		loop:
+			for {
+				select {
+				case e := <-s.Queue():
+					if e.ID != id {
+						t.Fatalf("expected event %s, got %s", id, e.ID)
+					}
+					attempts = append(attempts, e.Attempt)
+					if err := tc.Handle(s, e); err != nil {
+						t.Fatalf("bad: %s", err)
+					}
+				case <-time.After(time.Millisecond * 300):
+					break loop
+				case <-timeout:
+					break loop
+				}
+			}
+			s.Close()
+			<-s.Done()
+
+			if len(attempts) != len(tc.Attempts) {
+				t.Fatalf("expected attempts %v, got %v", tc.Attempts, attempts)
+			}
+			for i := range attempts {
+				if attempts[i] != tc.Attempts[i] {
+					t.Fatalf("expected attempts %v, got %v", tc.Attempts, attempts)
+				}
+			}
+			if tc.GivenUp {
+				if len(reported) != 1 {
+					t.Fatalf("expected one reported error, got %v", reported)
+				}
+				if _, ok := reported[0].(MaxAttemptsError); !ok {
+					t.Fatalf("expected MaxAttemptsError, got %#v", reported[0])
+				}
+			}
+		})
+	}
+}
+
+func TestNackNotAtLeastOnce(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	s, err := NewSubscriber(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer s.Close()
+	err = s.Nack(store.Event{ID: "foo"})
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if !strings.Contains(err.Error(), "not in at-least-once mode") {
+		t.Fatalf("expected error to match %q, got %q", "not in at-least-once mode", err)
+	}
+}
@@ -0,0 +1,229 @@
+package sub
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+// defaultTrackWindow is the default amount of time the subscriber remembers
+// delivered events for. Repeated notifications for an event are only
+// suppressed within this window.
+const defaultTrackWindow = time.Minute
+
+// trackedEvent is an event handled by the subscriber.
+type trackedEvent struct {
+	// The time the event was handled.
+	at time.Time
+
+	// The sum of the event's data when it was handled.
+	sum [sha256.Size]byte
+
+	// True if the event was skipped without its data being read.
+	skipped bool
+}
+
+// tracker records the events recently handled by the subscriber, so that
+// repeated notifications for the same event can be suppressed. Events are
+// forgotten once they have been tracked for longer than the window. Only the
+// watcher goroutine accesses the tracker.
+type tracker struct {
+	// The amount of time an event is remembered for.
+	window time.Duration
+
+	// The handled events, by ID.
+	seen map[string]trackedEvent
+
+	// The time the tracker was last pruned.
+	pruned time.Time
+}
+
+// newTracker returns a tracker that remembers events for window.
+func newTracker(window time.Duration) *tracker {
+	now := time.Now()
+	return &tracker{
+		window: window,
+		seen:   make(map[string]trackedEvent),
+		pruned: now,
+	}
+}
+
+// record records the event with the supplied ID as handled, with the sum of
+// its data.
+func (t *tracker) record(id string, sum [sha256.Size]byte) {
+	now := time.Now()
+	t.seen[id] = trackedEvent{at: now, sum: sum}
+	if now.Sub(t.pruned) < t.window/4 {
+		return
+	}
+	for id, e := range t.seen {
+		if now.Sub(e.at) > t.window {
+			delete(t.seen, id)
+		}
+	}
+	t.pruned = now
+}
+
+// skip records the event with the supplied ID as handled without its data
+// being read.
+func (t *tracker) skip(id string) {
+	t.record(id, [sha256.Size]byte{})
+	e := t.seen[id]
+	e.skipped = true
+	t.seen[id] = e
+}
+
+// get returns the event with the supplied ID, and true if it has been handled
+// within the window.
+func (t *tracker) get(id string) (trackedEvent, bool) {
+	e, ok := t.seen[id]
+	if !ok || time.Since(e.at) > t.window {
+		return trackedEvent{}, false
+	}
+	return e, true
+}
+
+// has returns true if the event with the supplied ID has been handled within
+// the window.
+func (t *tracker) has(id string) bool {
+	_, ok := t.get(id)
+	return ok
+}
+
+// highWater records the position of the newest event handled by the
+// subscriber, so that a resync can scan the stream from there. Notifications
+// are dropped when the notification buffer is full, so the events missed are
+// always newer than the events handled before the overflow was reported.
+//
+// As events do not always become visible in the order of their publish
+// times, the events handled within store.VisibilityWindow of the newest are
+// remembered, and the scan starts that far back. Only the watcher goroutine
+// accesses the high-water mark.
+type highWater struct {
+	// The publish time of the newest event handled.
+	time time.Time
+
+	// The events handled within the window, by ID, with their publish times.
+	recent map[string]time.Time
+
+	// The time the events were last pruned.
+	pruned time.Time
+
+	// Events published before this are not considered by a resync, as they
+	// were in the stream before the subscriber started.
+	floor time.Time
+}
+
+// newHighWater returns a high-water mark starting at t. If floor is true,
+// events published before t are never considered by a resync.
+func newHighWater(t time.Time, floor bool) *highWater {
+	h := &highWater{
+		time:   t,
+		recent: make(map[string]time.Time),
+		pruned: t,
+	}
+	if floor {
+		h.floor = t
+	}
+	return h
+}
+
+// advance records the event with the supplied ID and publish time as handled.
+func (h *highWater) advance(id string, t time.Time) {
+	if t.After(h.time) {
+		h.time = t
+	}
+	since := h.since()
+	if t.Before(since) {
+		return
+	}
+	h.recent[id] = t
+	if h.time.Sub(h.pruned) < store.VisibilityWindow {
+		return
+	}
+	for id, t := range h.recent {
+		if t.Before(since) {
+			delete(h.recent, id)
+		}
+	}
+	h.pruned = h.time
+}
+
+// since returns the earliest publish time an event can have to be considered
+// by a resync.
+func (h *highWater) since() time.Time {
+	since := h.time.Add(-store.VisibilityWindow)
+	if since.Before(h.floor) {
+		return h.floor
+	}
+	return since
+}
+
+// has returns true if the event with the supplied ID was handled within the
+// window.
+func (h *highWater) has(id string) bool {
+	t, ok := h.recent[id]
+	return ok && !t.Before(h.since())
+}
+
+// handled moves the subscriber's high-water mark forward to the event with
+// the supplied ID.
+func (s *Subscriber) handled(id string) {
+	if s.group != nil {
+		return
+	}
+	t, err := s.Stream.EventTime(id)
+	if err != nil {
+		// The event is gone, so there is nothing to resync.
+		return
+	}
+	s.highWater.advance(id, t)
+}
+
+// ResyncInterval makes the subscriber resync with the stream every interval,
+// in addition to when it detects that filesystem notifications may have been
+// dropped.
+//
+// The subscriber detects dropped notifications by watching for its
+// notification buffer filling up, and for the kernel reporting that its own
+// queue overflowed. A periodic resync is a safety net for notifications lost
+// in ways neither of these can detect.
+func ResyncInterval(interval time.Duration) Option {
+	return func(s *Subscriber) error {
+		if interval <= 0 {
+			return errors.New("resync interval must be greater than zero")
+		}
+		s.resyncInterval = interval
+		return nil
+	}
+}
+
+// resync scans the stream for events written since the newest event the
+// subscriber has handled, and delivers those it has not handled. Members of a
+// consumer group claim unclaimed events instead.
+//
+// false is returned if the subscription was terminated while delivering, along
+// with the reason.
+func (s *Subscriber) resync() (bool, error) {
+	atomic.AddUint64(&s.stats.Resyncs, 1)
+	if s.group != nil {
+		return s.reclaim()
+	}
+	ids, _, err := s.Stream.EventIDsAfter(store.Checkpoint{Time: s.highWater.since()})
+	if err != nil {
+		return false, err
+	}
+	for _, id := range ids {
+		if s.tracker.has(id) || s.highWater.has(id) || s.replayed(id) {
+			continue
+		}
+		atomic.AddUint64(&s.stats.ResyncedEvents, 1)
+		if ok, err := s.deliver(id); !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,141 @@
+package sub
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/pub"
+)
+
+func TestResyncOverflow(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	s, err := NewSubscriber(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer s.Close()
+	p, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// Nothing is reading the queue while publishing, so the watcher blocks and
+	// the notification buffer overruns.
+	n := defaultBufferSize * 5
+	for i := 0; i < n; i++ {
+		if _, err := p.Publish(TestEvent{Text: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+	// Give the notifier time to overrun the buffer.
+	time.Sleep(time.Millisecond * 200)
+	es, err := receive(s, n)
+	if err != nil {
+		t.Fatalf("bad: got %d of %d events: %s", len(es), n, err)
+	}
+	seen := make(map[string]bool)
+	for _, e := range es {
+		if seen[e.ID] {
+			t.Fatalf("event %s delivered twice", e.ID)
+		}
+		seen[e.ID] = true
+	}
+	stats := s.Stats()
+	if stats.Overflows == 0 || stats.Resyncs == 0 || stats.ResyncedEvents == 0 {
+		t.Fatalf("expected overflows and resyncs, got %#v", stats)
+	}
+}
+
+func TestResyncAfterStall(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	w := &testWatcher{c: make(chan Notification)}
+	s, err := NewSubscriber(dir, TestEvent{}, UseWatcher(w), DedupWindow(time.Millisecond))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer s.Close()
+	p, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	n := 30
+	var ids []string
+	for i := 0; i < n; i++ {
+		id, err := p.Publish(TestEvent{Text: fmt.Sprint(i)})
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		ids = append(ids, id)
+	}
+	w.c <- Notification{Overflow: true}
+	es, err := receive(s, n)
+	if err != nil {
+		t.Fatalf("bad: got %d of %d events: %s", len(es), n, err)
+	}
+
+	// The notifications left in the buffer arrive after the dedup window has
+	// passed, which must not deliver the resynced events again.
+	time.Sleep(time.Millisecond * 10)
+	for _, id := range ids {
+		w.c <- Notification{ID: id}
+	}
+	id, err := p.Publish(TestEvent{Text: "last"})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	w.c <- Notification{ID: id}
+	es, err = receive(s, 1)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if es[0].ID != id {
+		t.Fatalf("expected event %s, got %s delivered again", id, es[0].ID)
+	}
+	if stats := s.Stats(); stats.Overflows != 1 || stats.ResyncedEvents != uint64(n) {
+		t.Fatalf("expected one overflow and %d resynced events, got %#v", n, stats)
+	}
+}
+
+func TestResyncInterval(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	s, err := NewSubscriber(dir, TestEvent{}, ResyncInterval(time.Millisecond*100))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer s.Close()
+
+	// Linking the event into the stream does not generate a notification that
+	// the subscriber listens for, so only a resync will find it.
+	b, _ := json.Marshal(TestEvent{Text: "foo"})
+	if err := ioutil.WriteFile(dir+"/foo", b, 0666); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// The event has no metadata, so it is ordered by its modification time,
+	// which the filesystem may have rounded down to before the subscriber
+	// started.
+	now := time.Now()
+	if err := os.Chtimes(dir+"/foo", now, now); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := os.Link(dir+"/foo", dir+"/TestEvent/foo"); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	es, err := receive(s, 1)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if es[0].ID != "foo" {
+		t.Fatalf("expected event foo, got %#v", es[0])
+	}
+	if stats := s.Stats(); stats.Resyncs == 0 || stats.ResyncedEvents != 1 {
+		t.Fatalf("expected one resynced event, got %#v", stats)
+	}
+}
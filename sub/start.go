@@ -0,0 +1,158 @@
+package sub
+
+import (
+	"errors"
+	"time"
+
+	"github.com/vancluever/fspubsub/store"
+)
+
+// StartPosition describes where in the stream a subscriber starts delivering
+// events from. Use FromBeginning, FromEnd, AfterEvent or AtTime to get one.
+type StartPosition struct {
+	// True if the events already in the stream are replayed.
+	beginning bool
+
+	// The ID of the event to replay the stream after, if any.
+	afterID string
+
+	// The time to replay the stream from, if any.
+	at time.Time
+}
+
+// FromBeginning starts the subscriber at the beginning of the stream. The
+// events already in the stream are replayed, in the order they were published,
+// before moving on to live events.
+func FromBeginning() StartPosition {
+	return StartPosition{beginning: true}
+}
+
+// FromEnd starts the subscriber at the end of the stream, so that only events
+// published after the subscriber has started are delivered. This is the
+// default for subscribers that are not durable consumers.
+func FromEnd() StartPosition {
+	return StartPosition{}
+}
+
+// AfterEvent starts the subscriber just after the event with the supplied ID.
+// The events published after it are replayed, in the order they were
+// published, before moving on to live events. The event must exist when the
+// subscriber is created.
+func AfterEvent(id string) StartPosition {
+	return StartPosition{afterID: id}
+}
+
+// AtTime starts the subscriber at the time t. The events published at or
+// after t are replayed, in the order they were published, before moving on to
+// live events.
+func AtTime(t time.Time) StartPosition {
+	return StartPosition{at: t}
+}
+
+// checkpoint returns the position in the stream st to replay from, or nil if
+// nothing is replayed.
+func (p StartPosition) checkpoint(st *store.Stream) (*store.Checkpoint, error) {
+	switch {
+	case p.beginning:
+		return &store.Checkpoint{}, nil
+	case p.afterID != "":
+		c, err := st.CheckpointAt(p.afterID)
+		if err != nil {
+			return nil, err
+		}
+		return &c, nil
+	case !p.at.IsZero():
+		return &store.Checkpoint{Time: p.at}, nil
+	}
+	return nil, nil
+}
+
+// StartAt sets the position in the stream the subscriber starts from. For
+// durable consumers, this only applies when the consumer has no acknowledged
+// position yet.
+//
+// Consumer groups always start from the oldest unclaimed event, so this
+// cannot be used with Group.
+func StartAt(p StartPosition) Option {
+	return func(s *Subscriber) error {
+		s.start = &p
+		return nil
+	}
+}
+
+// startPosition works out the position to replay the stream from, once all
+// options have been applied. A durable consumer resumes from its checkpoint,
+// falling back to the start position, and then to the beginning of the
+// stream.
+func (s *Subscriber) startPosition() (*store.Checkpoint, error) {
+	if s.start != nil && s.group != nil {
+		return nil, errors.New("start position cannot be set for members of a consumer group")
+	}
+	if s.durable != nil {
+		c := s.durable.checkpoint
+		if !c.Time.IsZero() || len(c.IDs) > 0 {
+			return &c, nil
+		}
+		if s.start == nil {
+			return FromBeginning().checkpoint(s.Stream)
+		}
+	}
+	if s.start == nil {
+		return nil, nil
+	}
+	return s.start.checkpoint(s.Stream)
+}
+
+// replay delivers the events in the stream after the subscriber's start
+// position. The stream is scanned again after each pass so that events
+// published while replaying are picked up as well, finishing when a pass comes
+// up empty.
+//
+// false is returned if the subscription was terminated during replay, along
+// with the reason.
+func (s *Subscriber) replay() (bool, error) {
+	for {
+		ids, c, err := s.Stream.EventIDsAfter(*s.replayedTo)
+		if err != nil {
+			return false, err
+		}
+		if len(ids) == 0 {
+			return true, nil
+		}
+		for _, id := range ids {
+			if ok, err := s.deliver(id); !ok {
+				return false, err
+			}
+		}
+		*s.replayedTo = c
+	}
+}
+
+// replayed returns true if the event with the supplied ID has already been
+// delivered during replay.
+func (s *Subscriber) replayed(id string) bool {
+	if s.replayedTo == nil {
+		return false
+	}
+	t, err := s.Stream.EventTime(id)
+	if err != nil {
+		// Let the decoder report the error.
+		return false
+	}
+	return s.replayedTo.Covers(id, t)
+}
+
+// startFromBeginningByDefault starts the subscriber at the beginning of the
+// stream if no start position has been set, and it is not a member of a
+// consumer group. This is used for streams that are discovered after a
+// subscription has started, so that events published before they were found
+// are not missed. It needs to be applied after all other options.
+func startFromBeginningByDefault() Option {
+	return func(s *Subscriber) error {
+		if s.start == nil && s.group == nil {
+			p := FromBeginning()
+			s.start = &p
+		}
+		return nil
+	}
+}
@@ -0,0 +1,153 @@
+package sub
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/pub"
+)
+
+func TestStartAt(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Opts     []Option
+		Expected []string
+	}{
+		{
+			Name:     "default",
+			Expected: []string{"new"},
+		},
+		{
+			Name:     "from end",
+			Opts:     []Option{StartAt(FromEnd())},
+			Expected: []string{"new"},
+		},
+		{
+			Name:     "from beginning",
+			Opts:     []Option{StartAt(FromBeginning())},
+			Expected: []string{"new", "old"},
+		},
+		{
+			Name:     "durable default",
+			Opts:     []Option{Durable("consumer")},
+			Expected: []string{"new", "old"},
+		},
+		{
+			Name:     "durable from end",
+			Opts:     []Option{Durable("consumer"), StartAt(FromEnd())},
+			Expected: []string{"new"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "subtest")
+			defer os.RemoveAll(dir)
+			p, err := pub.NewPublisher(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			if _, err := p.Publish(TestEvent{Text: "old"}); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			s, err := NewSubscriber(dir, TestEvent{}, tc.Opts...)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			defer s.Close()
+			if _, err := p.Publish(TestEvent{Text: "new"}); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			es, err := receive(s, len(tc.Expected))
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			select {
+			case e := <-s.Queue():
+				t.Fatalf("unexpected event %#v", e)
+			case <-time.After(time.Millisecond * 100):
+			}
+			if actual := eventTexts(es); !reflect.DeepEqual(tc.Expected, actual) {
+				t.Fatalf("expected %q, got %q", tc.Expected, actual)
+			}
+		})
+	}
+}
+
+func TestStartAtGroup(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	_, err := NewSubscriber(dir, TestEvent{}, Group("workers", time.Minute), StartAt(FromBeginning()))
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+}
+
+func TestStartAtPointInStream(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	p, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	first, err := p.Publish(TestEvent{Text: "1"})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	since := time.Now()
+	for _, text := range []string{"2", "3"} {
+		if _, err := p.Publish(TestEvent{Text: text}); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+
+	cases := []struct {
+		Name     string
+		Start    StartPosition
+		Expected []string
+	}{
+		{
+			Name:     "after event",
+			Start:    AfterEvent(first),
+			Expected: []string{"2", "3"},
+		},
+		{
+			Name:     "at time",
+			Start:    AtTime(since),
+			Expected: []string{"2", "3"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			s, err := NewSubscriber(dir, TestEvent{}, StartAt(tc.Start))
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			defer s.Close()
+			es, err := receive(s, len(tc.Expected))
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			select {
+			case e := <-s.Queue():
+				t.Fatalf("unexpected event %#v", e)
+			case <-time.After(time.Millisecond * 100):
+			}
+			var actual []string
+			for _, e := range es {
+				actual = append(actual, e.Data.(TestEvent).Text)
+			}
+			// Replayed events are delivered in publish order.
+			if !reflect.DeepEqual(tc.Expected, actual) {
+				t.Fatalf("expected %q, got %q", tc.Expected, actual)
+			}
+		})
+	}
+
+	if _, err := NewSubscriber(dir, TestEvent{}, StartAt(AfterEvent("nope"))); err == nil {
+		t.Fatal("expected error for missing event, got none")
+	}
+}
@@ -0,0 +1,46 @@
+package sub
+
+import "sync/atomic"
+
+// Stats holds counters describing the work done by a subscriber.
+type Stats struct {
+	// The number of times the subscriber has detected that filesystem
+	// notifications may have been dropped.
+	Overflows uint64
+
+	// The number of times the subscriber has rescanned the stream for missed
+	// events, either due to an overflow or on the resync interval.
+	Resyncs uint64
+
+	// The number of missed events found and delivered by resyncs. Events
+	// claimed by members of a consumer group during a resync are not counted.
+	ResyncedEvents uint64
+
+	// The number of events discarded because the queue was full.
+	Dropped uint64
+
+	// The number of events skipped by filters.
+	Filtered uint64
+
+	// The number of repeated notifications suppressed for events that had
+	// already been delivered.
+	Duplicates uint64
+
+	// The number of events found to have been modified after they were
+	// delivered.
+	Modified uint64
+}
+
+// Stats returns a snapshot of the subscriber's counters. It is safe to call
+// at any time.
+func (s *Subscriber) Stats() Stats {
+	return Stats{
+		Overflows:      atomic.LoadUint64(&s.stats.Overflows),
+		Resyncs:        atomic.LoadUint64(&s.stats.Resyncs),
+		ResyncedEvents: atomic.LoadUint64(&s.stats.ResyncedEvents),
+		Dropped:        atomic.LoadUint64(&s.stats.Dropped),
+		Filtered:       atomic.LoadUint64(&s.stats.Filtered),
+		Duplicates:     atomic.LoadUint64(&s.stats.Duplicates),
+		Modified:       atomic.LoadUint64(&s.stats.Modified),
+	}
+}
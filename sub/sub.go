@@ -5,18 +5,22 @@
 package sub
 
 import (
-	"fmt"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/rjeczalik/notify"
 	"github.com/vancluever/fspubsub/store"
 )
 
-// defaultNotifyBufferSize describes the default buffer size. This is used for
-// both the filesystem and event buffer at this point in time.
+// defaultBufferSize describes the default buffer size. This is used for both
+// the inotify and event buffer, unless they are changed with NotifyBufferSize
+// and QueueBufferSize.
 //
 // This needs to be adequately tuned to the needs of the application - the
-// filesystem notifier does not block sending events, so the subscriber will
-// miss events if there is an overrun.
+// inotify watcher does not block sending events, so notifications are
+// dropped if there is an overrun. The subscriber detects this and resyncs with
+// the stream to recover the missed events, but this is expensive.
 const defaultBufferSize = 10
 
 // Subscriber is a simple event subscriber, designed to read events from the
@@ -42,16 +46,111 @@ type Subscriber struct {
 	// completion channel.
 	done chan struct{}
 
+	// Protects err.
+	mu sync.Mutex
+
 	// The internal error field. Call Error to receive this externally.
 	err error
 
-	// An error channel used to pass errors through and control the subscription
-	// lifecycle.
-	errch chan error
+	// Closed by Close to stop the subscription.
+	stop chan struct{}
+
+	// Makes sure stop is only closed once.
+	closeOnce sync.Once
+
+	// What happens to the events left in the queue when the subscription
+	// terminates, and how long to wait for them to be drained.
+	closePolicy  closePolicy
+	drainTimeout time.Duration
+
+	// The watcher used to find out about new events.
+	watcher Watcher
+
+	// The sizes of the inotify notification and queue buffers.
+	notifyBufferSize int
+	queueBufferSize  int
+
+	// The policy for events that are ready while the queue is full.
+	queueFullPolicy QueueFullPolicy
+
+	// The start position set with StartAt, if any.
+	start *StartPosition
+
+	// The position up to which events have been delivered by replay, or nil if
+	// the subscriber does not replay the stream. Live events covered by this
+	// position are skipped, as they have already been delivered. This is only
+	// accessed by the watcher goroutine.
+	replayedTo *store.Checkpoint
+
+	// The predicates events must pass to be delivered.
+	filters []func(store.Event) bool
+
+	// The predicates the metadata of events must pass to be decoded and
+	// delivered.
+	headerFilters []func(store.Metadata) bool
+
+	// The middleware run for each delivered event, outermost first.
+	middleware []Middleware
+
+	// The durable consumer state, if this is a durable subscriber.
+	durable *durable
+
+	// The consumer group state, if this subscriber is a member of a consumer
+	// group.
+	group *group
+
+	// The at-least-once delivery state, if enabled.
+	redelivery *redelivery
+
+	// The handler for errors that do not terminate the subscription.
+	onError func(error)
+
+	// The policy for events that cannot be decoded.
+	poisonPolicy PoisonPolicy
+
+	// Records the events handled by the subscriber, for duplicate
+	// suppression.
+	tracker *tracker
+
+	// The position of the newest event handled by the subscriber, for
+	// resyncs.
+	highWater *highWater
+
+	// The handler for events that are modified after being delivered, if
+	// any.
+	onModified func(store.Event)
+
+	// The interval on which to resync with the stream, if any.
+	resyncInterval time.Duration
+
+	// Counters for Stats. These are accessed atomically.
+	stats Stats
 }
 
-// Queue returns the event channel. This is buffered to the size of the file
-// system notification buffer.
+// Option is a functional option that can be passed to NewSubscriber to
+// change the behavior of the subscriber.
+type Option func(*Subscriber) error
+
+// OnError sets a handler for errors that do not terminate the subscription,
+// such as a MaxAttemptsError or a PoisonEventError. The handler is called from
+// the subscription goroutine, so it should not block. These errors are
+// discarded if no handler is set.
+func OnError(f func(error)) Option {
+	return func(s *Subscriber) error {
+		s.onError = f
+		return nil
+	}
+}
+
+// report passes err to the handler set with OnError, if any.
+func (s *Subscriber) report(err error) {
+	if s.onError != nil {
+		s.onError(err)
+	}
+}
+
+// Queue returns the event channel. This is buffered to the size set with
+// QueueBufferSize.
 func (s *Subscriber) Queue() <-chan store.Event {
 	return s.queue
 }
@@ -66,6 +165,8 @@ func (s *Subscriber) Done() <-chan struct{} {
 // to be nil if the stream has not yet been terminated, so make sure to block
 // on done before checking this value.
 func (s *Subscriber) Error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.err
 }
 
@@ -85,47 +186,255 @@ func (s *Subscriber) Error() error {
 // function (nil means no error). If the stream is interrupted for any other
 // reason than the subscriber being closed with Close, Error will contain the
 // reason for failure.  This includes bad event data, which will shut down the
-// subscriber.
-func NewSubscriber(dir string, event interface{}) (*Subscriber, error) {
+// subscriber unless a different policy has been set with OnPoison.
+//
+// Additional behavior, such as buffer sizes, the start position, durable
+// consumption or membership of a consumer group, can be configured by passing
+// one or more Options.
+func NewSubscriber(dir string, event interface{}, opts ...Option) (*Subscriber, error) {
 	stream, err := store.NewStream(dir, event)
 	if err != nil {
 		return nil, err
 	}
+	return newSubscriber(stream, opts)
+}
 
+// newSubscriber starts watching the stream, with the supplied options.
+func newSubscriber(stream *store.Stream, opts []Option) (*Subscriber, error) {
+	var err error
 	s := &Subscriber{
-		Stream: stream,
-		queue:  make(chan store.Event, defaultBufferSize),
-		done:   make(chan struct{}, 1),
-		errch:  make(chan error, 1),
+		Stream:           stream,
+		done:             make(chan struct{}, 1),
+		stop:             make(chan struct{}),
+		tracker:          newTracker(defaultTrackWindow),
+		notifyBufferSize: defaultBufferSize,
+		queueBufferSize:  defaultBufferSize,
 	}
-	c := make(chan notify.EventInfo, defaultBufferSize)
-	if err := notify.Watch(s.Stream.Dir(), c, notify.InCloseWrite); err != nil {
-		return nil, fmt.Errorf("error watching directory %s: %s", s.Stream.Dir(), err)
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	if s.durable != nil && s.group != nil {
+		return nil, errors.New("durable consumers cannot be members of a consumer group")
+	}
+	if s.replayedTo, err = s.startPosition(); err != nil {
+		return nil, err
+	}
+	if s.replayedTo != nil {
+		s.highWater = newHighWater(s.replayedTo.Time, false)
+	} else {
+		s.highWater = newHighWater(time.Now(), true)
+	}
+	s.queue = make(chan store.Event, s.queueBufferSize)
+	c, err := s.watchStream()
+	if err != nil {
+		return nil, err
 	}
 	go s.watch(c)
 	return s, nil
 }
 
-func (s *Subscriber) watch(c chan notify.EventInfo) {
-	defer notify.Stop(c)
+// watch runs the subscription, and cleans up after it terminates.
+func (s *Subscriber) watch(c <-chan Notification) {
+	err := s.run(c)
+	s.watcher.Stop()
+	s.finish()
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+	close(s.done)
+}
+
+// run processes events until the subscription terminates, returning the
+// reason for termination.
+func (s *Subscriber) run(c <-chan Notification) error {
+	if s.replayedTo != nil {
+		if ok, err := s.replay(); !ok {
+			return err
+		}
+	}
+	var tick <-chan time.Time
+	if s.group != nil {
+		go s.group.heartbeat(s.Stream, s.done)
+		t := time.NewTicker(s.group.timeout / 2)
+		defer t.Stop()
+		tick = t.C
+		if ok, err := s.reclaim(); !ok {
+			return err
+		}
+	}
+	var expire <-chan time.Time
+	var wake <-chan struct{}
+	if s.redelivery != nil {
+		t := time.NewTicker(s.redelivery.timeout / 4)
+		defer t.Stop()
+		expire = t.C
+		wake = s.redelivery.wake
+	}
+	var resync <-chan time.Time
+	if s.resyncInterval > 0 {
+		t := time.NewTicker(s.resyncInterval)
+		defer t.Stop()
+		resync = t.C
+	}
 	for {
 		select {
-		case ei := <-c:
-			e, err := store.DecodeEvent(ei.Path(), s.Stream.EventType())
+		case n := <-c:
+			if n.Err != nil {
+				return n.Err
+			}
+			if n.Overflow {
+				atomic.AddUint64(&s.stats.Overflows, 1)
+				if ok, err := s.resync(); !ok {
+					return err
+				}
+				continue
+			}
+			if ok, err := s.notified(n.ID); !ok {
+				return err
+			}
+		case <-resync:
+			if ok, err := s.resync(); !ok {
+				return err
+			}
+		case <-tick:
+			if ok, err := s.reclaim(); !ok {
+				return err
+			}
+		case <-expire:
+			if ok, err := s.redeliver(); !ok {
+				return err
+			}
+		case <-wake:
+			if ok, err := s.redeliver(); !ok {
+				return err
+			}
+		case <-s.stop:
+			return nil
+		}
+	}
+}
+
+// notified handles a notification for the event with the supplied ID. For an
+// event published in a batch, nothing is delivered until the batch is
+// complete, and then the whole batch is delivered in order.
+//
+// false is returned if the subscription was terminated, along with the
+// reason.
+func (s *Subscriber) notified(id string) (bool, error) {
+	if s.tracker.has(id) {
+		return s.duplicate(id)
+	}
+	ids, err := s.Stream.BatchIDs(id)
+	if err != nil {
+		return s.poison(id, err)
+	}
+	for _, id := range ids {
+		// Events handled longer ago than the dedup window are still remembered
+		// by the high-water mark, which catches notifications left in the
+		// buffer for events a resync has already delivered.
+		if s.tracker.has(id) || s.highWater.has(id) || s.replayed(id) {
+			continue
+		}
+		if s.group != nil {
+			ok, err := s.group.claim(s.Stream, id)
 			if err != nil {
-				s.errch <- err
-				break
+				return false, err
+			}
+			if !ok {
+				continue
 			}
-			s.queue <- e
-		case s.err = <-s.errch:
-			close(s.done)
-			return
+		}
+		if ok, err := s.deliver(id); !ok {
+			return false, err
 		}
 	}
+	return true, nil
+}
+
+// deliver decodes the event with the supplied ID and sends it to the queue
+// through the middleware chain, unless it is skipped by a filter. Events that
+// cannot be decoded are handled according to the poison event policy.
+//
+// false is returned if the subscription was terminated, along with the
+// reason.
+func (s *Subscriber) deliver(id string) (bool, error) {
+	s.handled(id)
+	skip, err := s.headerFiltered(id)
+	if err != nil {
+		return s.poison(id, err)
+	}
+	if skip {
+		s.tracker.skip(id)
+		return s.skip(store.Event{ID: id})
+	}
+	e, sum, err := store.DecodeEventSum(s.Stream.Dir()+"/"+id, s.Stream.EventType())
+	s.tracker.record(id, sum)
+	if err != nil {
+		return s.poison(id, err)
+	}
+	if s.filtered(e) {
+		return s.skip(e)
+	}
+	return s.receive(e)
+}
+
+// send sends the event e to the queue, according to the queue-full policy.
+// false is returned if the subscription was terminated, along with the reason.
+//
+// In at-least-once mode, the event's delivery attempt is counted and the
+// event is tracked until it is acknowledged. Durable consumers hold their
+// checkpoint back before it until then.
+func (s *Subscriber) send(e store.Event) (bool, error) {
+	if s.redelivery != nil {
+		e.Attempt++
+		s.redelivery.track(e)
+		if s.durable != nil {
+			if err := s.durable.track(s.Stream, e); err != nil {
+				return false, err
+			}
+		}
+	}
+	return s.enqueue(e)
+}
+
+// Ack acknowledges the event e.
+//
+// In at-least-once mode, this stops e from being delivered again. For durable
+// consumers, this moves the consumer's checkpoint forward to e. For members of
+// a consumer group, this marks e as completed so that it is not handed to
+// another consumer. Checkpoints and completions are persisted before Ack
+// returns. A member of a group whose claim on e was taken over by another
+// consumer - because it was not refreshed in time - gets a
+// store.ClaimLostError, as e is now being handled by the other consumer.
+//
+// An error is returned if the subscriber is none of the above.
+func (s *Subscriber) Ack(e store.Event) error {
+	if s.redelivery != nil {
+		s.redelivery.ack(e.ID)
+	}
+	switch {
+	case s.durable != nil:
+		return s.durable.ack(s.Stream, e)
+	case s.group != nil:
+		return s.group.ack(s.Stream, e)
+	case s.redelivery != nil:
+		return nil
+	}
+	return errors.New("subscriber is not a durable consumer, a member of a consumer group, or in at-least-once mode")
 }
 
 // Close signals to the Subscriber that we are done and that the subscription
-// is no longer needed. This performs a graceful shutdown of the subscriber.
+// is no longer needed. This performs a graceful shutdown of the subscriber,
+// blocking until the subscription goroutine has exited. What happens to the
+// events left in the queue can be changed with DrainOnClose and
+// DiscardOnClose.
+//
+// It is safe to call Close more than once, and after the subscription has
+// terminated on its own. Close must not be called from an OnError handler, as
+// these run on the subscription goroutine.
 func (s *Subscriber) Close() {
-	close(s.errch)
+	s.closeOnce.Do(func() { close(s.stop) })
+	<-s.done
 }
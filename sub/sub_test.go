@@ -20,6 +20,20 @@ type TestEvent struct {
 	Text string
 }
 
+// testWatcher is a Watcher that passes on the notifications sent to it by a
+// test.
+type testWatcher struct {
+	c chan Notification
+}
+
+// Watch implements Watcher for testWatcher.
+func (w *testWatcher) Watch(dir string) (<-chan Notification, error) {
+	return w.c, nil
+}
+
+// Stop implements Watcher for testWatcher.
+func (w *testWatcher) Stop() {}
+
 func TestNewSubscriber(t *testing.T) {
 	cases := []struct {
 		Name        string
@@ -103,7 +117,7 @@ func TestNewSubscriber(t *testing.T) {
 			}
 
 			if !reflect.DeepEqual(expectedStream, sub.Stream) {
-				t.Fatalf("expected:\n\n%s\ngot:\n\n%s\n", expectedStream, sub.Stream)
+				t.Fatalf("expected:\n\n%s\ngot:\n\n%s\n", expectedStream.Dir(), sub.Stream.Dir())
 			}
 		})
 	}
@@ -243,3 +257,150 @@ func BenchmarkWatch(b *testing.B) {
 		})
 	}
 }
+
+func TestWatchBatch(t *testing.T) {
+	cases := []struct {
+		Name string
+		Opts []Option
+	}{
+		{
+			Name: "plain",
+		},
+		{
+			Name: "group",
+			Opts: []Option{Group("foo", time.Second*5)},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "subtest")
+			defer os.RemoveAll(dir)
+			s, err := NewSubscriber(dir, TestEvent{}, tc.Opts...)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			defer s.Close()
+			p, err := pub.NewPublisher(dir, TestEvent{})
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			publishTexts(t, dir, "before")
+			batch := []interface{}{TestEvent{Text: "1"}, TestEvent{Text: "2"}, TestEvent{Text: "3"}, TestEvent{Text: "4"}}
+			ids, err := p.PublishBatch(batch...)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			publishTexts(t, dir, "after")
+
+			es, err := receive(s, len(batch)+2)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			// The batch is delivered as a whole, in order, with nothing in
+			// between.
+			var actual []string
+			for i, e := range es {
+				if e.ID != ids[0] {
+					continue
+				}
+				for _, e := range es[i:] {
+					if len(actual) == len(ids) {
+						break
+					}
+					actual = append(actual, e.ID)
+				}
+			}
+			if !reflect.DeepEqual(ids, actual) {
+				t.Fatalf("expected batch %q, got %q", ids, actual)
+			}
+		})
+	}
+}
+
+func TestWatchPublishAt(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	s, err := NewSubscriber(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer s.Close()
+	p, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	id, err := p.PublishAt(time.Now().Add(200*time.Millisecond), TestEvent{Text: "foo"})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	sc, err := pub.NewScheduler(dir, TestEvent{}, pub.ScheduleInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer sc.Close()
+	select {
+	case e := <-s.Queue():
+		t.Fatalf("expected nothing before the event is due, got %#v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+	es, err := receive(s, 1)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if es[0].ID != id {
+		t.Fatalf("expected event %s, got %#v", id, es[0])
+	}
+}
+
+func TestWatchPublishWithID(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	s, err := NewSubscriber(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer s.Close()
+	p, err := pub.NewPublisher(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// The retry is not delivered again.
+	for i := 0; i < 2; i++ {
+		if _, err := p.PublishWithID("foo", TestEvent{Text: "foo"}); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+	es, err := receive(s, 1)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if es[0].ID != "foo" {
+		t.Fatalf("expected event foo, got %#v", es[0])
+	}
+	select {
+	case e := <-s.Queue():
+		t.Fatalf("unexpected event %#v", e)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestWatchWatcherError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	w := &testWatcher{c: make(chan Notification)}
+	s, err := NewSubscriber(dir, TestEvent{}, UseWatcher(w))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer s.Close()
+	w.c <- Notification{Err: errors.New("watcher failed")}
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second * 2):
+		t.Fatal("timed out waiting for the subscriber to terminate")
+	}
+	if err := s.Error(); err == nil || err.Error() != "watcher failed" {
+		t.Fatalf("expected watcher error, got %v", err)
+	}
+}
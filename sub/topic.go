@@ -0,0 +1,159 @@
+package sub
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rjeczalik/notify"
+	"github.com/vancluever/fspubsub/store"
+)
+
+// topicScanInterval is the interval the base directory is scanned on for new
+// topics matching a topic subscriber's pattern. New topic directories are
+// normally picked up straight away through inotify - this catches any that
+// are missed, or finds them when inotify is not available.
+const topicScanInterval = time.Second
+
+// NewTopicSubscriber starts watching the topics in the base directory dir
+// that match pattern, delivering their events on a single queue. Events are
+// tagged with the topic they were published to in their Stream field.
+//
+// Patterns are topics that can contain wildcards as whole segments. A
+// single-level wildcard, "*", matches exactly one segment, so
+// "orders.*.created" matches "orders.eu.created" but not "orders.created". A
+// multi-level wildcard, ">", matches one or more segments at the end of a
+// topic, so "orders.>" matches both "orders.eu" and "orders.eu.created".
+//
+// Topics created after the subscription starts are picked up as they appear.
+// The events already published to these topics are delivered, as they were
+// published after the subscription started - this can be changed with
+// StartAt. The options in opts are applied to the subscriber for each topic.
+func NewTopicSubscriber(dir, pattern string, event interface{}, opts ...Option) (*MultiSubscriber, error) {
+	if err := store.ValidTopicPattern(pattern); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(store.TopicsDir(dir), 0777); err != nil {
+		return nil, fmt.Errorf("error creating topics directory: %s", err)
+	}
+	topics, err := store.Topics(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	var subs []*Subscriber
+	for _, topic := range topics {
+		s, err := newTopicSubscriber(dir, topic, event, opts)
+		if err != nil {
+			for _, s := range subs {
+				s.Close()
+			}
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	size := defaultBufferSize
+	if len(subs) > 0 {
+		size = cap(subs[0].queue)
+	}
+	m := newMultiSubscriber(size)
+	for _, s := range subs {
+		m.add(s)
+	}
+	m.wg.Add(1)
+	go m.discover(dir, pattern, event, opts)
+	return m, nil
+}
+
+// newTopicSubscriber starts watching a single topic.
+func newTopicSubscriber(dir, topic string, event interface{}, opts []Option) (*Subscriber, error) {
+	stream, err := store.NewTopicStream(dir, topic, event)
+	if err != nil {
+		return nil, err
+	}
+	return newSubscriber(stream, opts)
+}
+
+// discover watches the base directory dir for new topics matching pattern,
+// adding a subscriber for each one found, until the multi-subscriber is shut
+// down.
+//
+// Only the directories new matching topics can be created in are watched, and
+// only for new entries, so publishing to existing topics does not wake it.
+func (m *MultiSubscriber) discover(dir, pattern string, event interface{}, opts []Option) {
+	defer m.wg.Done()
+	opts = append(append([]Option{}, opts...), startFromBeginningByDefault())
+	c := make(chan notify.EventInfo, defaultBufferSize)
+	defer notify.Stop(c)
+	watched := make(map[string]bool)
+	t := time.NewTicker(topicScanInterval)
+	defer t.Stop()
+	for {
+		if !m.watchParents(dir, pattern, c, watched) {
+			return
+		}
+		topics, err := store.Topics(dir, pattern)
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		for _, topic := range topics {
+			if m.Subscriber(topic) != nil {
+				continue
+			}
+			s, err := newTopicSubscriber(dir, topic, event, opts)
+			if err != nil {
+				m.fail(err)
+				return
+			}
+			m.add(s)
+		}
+		if !m.waitForDir(c, t.C) {
+			return
+		}
+	}
+}
+
+// waitForDir waits for a new directory to be reported on c, or for a tick,
+// returning false if the multi-subscriber is shut down first.
+func (m *MultiSubscriber) waitForDir(c <-chan notify.EventInfo, tick <-chan time.Time) bool {
+	for {
+		select {
+		case ei := <-c:
+			if strings.HasPrefix(filepath.Base(ei.Path()), ".") {
+				continue
+			}
+			if fi, err := os.Stat(ei.Path()); err != nil || !fi.IsDir() {
+				continue
+			}
+			return true
+		case <-tick:
+			return true
+		case <-m.stop:
+			return false
+		}
+	}
+}
+
+// watchParents adds watches on c for the directories new topics matching
+// pattern can be created in, skipping those already in watched. If inotify
+// is not available, nothing is watched, and new topics are found by the
+// periodic scan. It returns false if the scan failed.
+func (m *MultiSubscriber) watchParents(dir, pattern string, c chan notify.EventInfo, watched map[string]bool) bool {
+	parents, err := store.TopicParents(dir, pattern)
+	if err != nil {
+		m.fail(err)
+		return false
+	}
+	for _, p := range parents {
+		if watched[p] {
+			continue
+		}
+		if err := notify.Watch(p, c, dirCreated); err != nil {
+			continue
+		}
+		watched[p] = true
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package sub
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/vancluever/fspubsub/pub"
+)
+
+func TestTopicSubscriber(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	publishers := make(map[string]*pub.Publisher)
+	publish := func(topic, text string) {
+		p, ok := publishers[topic]
+		if !ok {
+			var err error
+			if p, err = pub.NewTopicPublisher(dir, topic, TestEvent{}); err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			publishers[topic] = p
+		}
+		if _, err := p.Publish(TestEvent{Text: text}); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+	// Existing topics start from the end of the stream.
+	publish("orders.eu.created", "old")
+
+	m, err := NewTopicSubscriber(dir, "orders.*.created", TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer m.Close()
+	publish("orders.eu.created", "eu")
+	publish("orders.eu.shipped", "shipped")
+	publish("payments.eu.created", "payment")
+	// Created after the subscription started.
+	publish("orders.us.created", "us")
+
+	var got []string
+	timeout := time.After(time.Second * 3)
+	for len(got) < 2 {
+		select {
+		case e := <-m.Queue():
+			got = append(got, e.Stream+":"+e.Data.(TestEvent).Text)
+		case <-m.Done():
+			t.Fatalf("subscriber stopped: %v", m.Error())
+		case <-timeout:
+			t.Fatalf("timed out waiting for events, got %q", got)
+		}
+	}
+	select {
+	case e := <-m.Queue():
+		t.Fatalf("unexpected event %#v", e)
+	case <-time.After(time.Millisecond * 200):
+	}
+	sort.Strings(got)
+	if expected := []string{"orders.eu.created:eu", "orders.us.created:us"}; !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestTopicSubscriberBadPattern(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	if _, err := NewTopicSubscriber(dir, "orders.>.created", TestEvent{}); err == nil {
+		t.Fatal("expected error, got none")
+	}
+}
@@ -0,0 +1,71 @@
+package sub
+
+import (
+	"fmt"
+)
+
+// Notification is sent by a Watcher when an event file appears in the stream
+// directory.
+type Notification struct {
+	// The ID of the event, which is the name of the event file.
+	ID string
+
+	// True if the watcher may have missed notifications. ID is empty in this
+	// case, and the subscriber resyncs with the stream to find any events it
+	// missed. Overflows must be reported before the notifications for any
+	// event published after the first missed one, as the resync only looks
+	// for events newer than those the subscriber has already handled.
+	Overflow bool
+
+	// Set if the watcher has failed, and will not send any more
+	// notifications. ID is empty in this case, and the subscription is
+	// terminated with this error.
+	Err error
+}
+
+// Watcher watches a stream directory for new event files. A Watcher is used
+// by a single subscriber, which calls Watch once when it starts and Stop once
+// when it shuts down.
+type Watcher interface {
+	// Watch starts watching the directory dir, returning the channel
+	// notifications are sent on.
+	Watch(dir string) (<-chan Notification, error)
+
+	// Stop stops watching the directory. No notifications are sent after Stop
+	// returns.
+	Stop()
+}
+
+// UseWatcher sets the watcher the subscriber uses to find out about new
+// events. By default, the subscriber watches the stream with inotify, falling
+// back to a polling watcher if inotify cannot be set up.
+func UseWatcher(w Watcher) Option {
+	return func(s *Subscriber) error {
+		s.watcher = w
+		return nil
+	}
+}
+
+// watchStream starts the subscriber's watcher on the stream directory. If no
+// watcher has been set, an inotify watcher is tried first, and a polling
+// watcher is used if that fails, as it always does on systems other than
+// Linux.
+func (s *Subscriber) watchStream() (<-chan Notification, error) {
+	if s.watcher != nil {
+		c, err := s.watcher.Watch(s.Stream.Dir())
+		if err != nil {
+			return nil, fmt.Errorf("error watching directory %s: %s", s.Stream.Dir(), err)
+		}
+		return c, nil
+	}
+	s.watcher = NewNotifyWatcher(s.notifyBufferSize)
+	if c, err := s.watcher.Watch(s.Stream.Dir()); err == nil {
+		return c, nil
+	}
+	s.watcher = NewPollWatcher(defaultPollInterval)
+	c, err := s.watcher.Watch(s.Stream.Dir())
+	if err != nil {
+		return nil, fmt.Errorf("error watching directory %s: %s", s.Stream.Dir(), err)
+	}
+	return c, nil
+}
@@ -0,0 +1,181 @@
+package sub
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"github.com/rjeczalik/notify"
+	"golang.org/x/sys/unix"
+)
+
+// dirCreated is the event topic subscribers watch for new topic directories
+// with. inotify reports the creation of a directory on its own, leaving out
+// the events renamed into a stream.
+const dirCreated = notify.InCreate
+
+// inotifyReadSize is the size of the buffer inotify events are read into.
+const inotifyReadSize = (unix.SizeofInotifyEvent + unix.NAME_MAX + 1) * 64
+
+// notifyWatcher is a Watcher that uses inotify.
+//
+// The watcher reads from inotify directly, on a single goroutine, rather than
+// through the notify package, which hands each event to the watcher on a
+// goroutine of its own. This keeps notifications in the order the event files
+// appeared in, so subscribers handle events in the order they were
+// published.
+type notifyWatcher struct {
+	// The directory being watched.
+	dir string
+
+	// The inotify instance, and the pipe used to wake the reader up when the
+	// watcher is stopped. These are closed by Stop, once the reader has
+	// returned.
+	fd   int
+	wake [2]int
+
+	// The buffered channel notifications are sent on. The reader does not
+	// block when this is full, dropping the notification instead.
+	out chan Notification
+
+	// Closed to stop reading.
+	stop chan struct{}
+
+	// Closed when the reader returns.
+	done chan struct{}
+
+	// Makes sure the watcher is only stopped once.
+	once sync.Once
+}
+
+// NewNotifyWatcher returns a Watcher that uses inotify, with a notification
+// buffer of the supplied size.
+//
+// inotify is only available on Linux, and does not see writes made to network
+// filesystems by other hosts. Notifications are dropped when the buffer
+// overruns, or when the kernel's own queue overflows, which the watcher
+// detects and reports as an overflow.
+func NewNotifyWatcher(bufferSize int) Watcher {
+	return &notifyWatcher{
+		fd:   -1,
+		out:  make(chan Notification, bufferSize),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// Watch implements Watcher for notifyWatcher.
+func (w *notifyWatcher) Watch(dir string) (<-chan Notification, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("error starting inotify: %s", err)
+	}
+	if _, err := unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_ONLYDIR); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("error adding inotify watch on %s: %s", dir, err)
+	}
+	if err := unix.Pipe2(w.wake[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("error starting inotify: %s", err)
+	}
+	w.dir = dir
+	w.fd = fd
+	go w.read()
+	return w.out, nil
+}
+
+// Stop implements Watcher for notifyWatcher. The reader is woken up and
+// waited for before the inotify instance is closed, so that it never reads
+// from a closed file descriptor.
+func (w *notifyWatcher) Stop() {
+	w.once.Do(func() {
+		close(w.stop)
+		if w.fd < 0 {
+			return
+		}
+		unix.Write(w.wake[1], []byte{0})
+		<-w.done
+		unix.Close(w.fd)
+		unix.Close(w.wake[0])
+		unix.Close(w.wake[1])
+	})
+}
+
+// read reads events from inotify until the watcher is stopped, sending a
+// notification for each event file. If the events can no longer be read, the
+// error is sent as the last notification.
+//
+// Once a notification has been dropped, all notifications after it are
+// dropped too, until the overflow has been reported. The overflow is
+// reported before the notifications for any event that appeared after the
+// first missed one, as Notification requires.
+func (w *notifyWatcher) read() {
+	defer close(w.done)
+	buf := make([]byte, inotifyReadSize)
+	fds := []unix.PollFd{
+		{Fd: int32(w.fd), Events: unix.POLLIN},
+		{Fd: int32(w.wake[0]), Events: unix.POLLIN},
+	}
+	overrun := false
+	for {
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			w.fail(fmt.Errorf("error waiting for inotify events on %s: %s", w.dir, err))
+			return
+		}
+		if fds[1].Revents != 0 {
+			return
+		}
+		n, err := unix.Read(w.fd, buf)
+		switch {
+		case err == unix.EAGAIN || err == unix.EINTR:
+			continue
+		case err != nil:
+			w.fail(fmt.Errorf("error reading inotify events on %s: %s", w.dir, err))
+			return
+		case n < unix.SizeofInotifyEvent:
+			w.fail(fmt.Errorf("error reading inotify events on %s: short read of %d bytes", w.dir, n))
+			return
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			e := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(e.Len)]
+			off += unix.SizeofInotifyEvent + int(e.Len)
+			switch {
+			case e.Mask&unix.IN_Q_OVERFLOW != 0:
+				overrun = true
+			case e.Mask&unix.IN_ISDIR != 0 || e.Len == 0:
+			case overrun:
+			default:
+				select {
+				case w.out <- Notification{ID: string(bytes.TrimRight(name, "\x00"))}:
+				default:
+					overrun = true
+				}
+			}
+		}
+		// The reader blocks until the overflow is reported. Events appearing
+		// in the meantime queue up in the kernel, which reports an overflow of
+		// its own if its queue fills up.
+		if overrun {
+			select {
+			case w.out <- Notification{Overflow: true}:
+				overrun = false
+			case <-w.stop:
+				return
+			}
+		}
+	}
+}
+
+// fail sends err as the last notification, unless the watcher is stopped
+// first.
+func (w *notifyWatcher) fail(err error) {
+	select {
+	case w.out <- Notification{Err: err}:
+	case <-w.stop:
+	}
+}
@@ -0,0 +1,96 @@
+//go:build linux
+// +build linux
+
+package sub
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNotifyWatcherOverflow(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	w := NewNotifyWatcher(2)
+	defer w.Stop()
+	c, err := w.Watch(dir)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// Nothing is reading the notifications while the files are written, so
+	// the buffer overruns.
+	n := 20
+	for i := 0; i < n; i++ {
+		if err := ioutil.WriteFile(fmt.Sprintf("%s/%02d", dir, i), []byte("{}"), 0666); err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+	}
+	var ns []Notification
+	for {
+		select {
+		case n := <-c:
+			ns = append(ns, n)
+			continue
+		case <-time.After(time.Millisecond * 200):
+		}
+		break
+	}
+
+	// The notifications that were not dropped arrive in order, and every gap
+	// is preceded by an overflow.
+	next := 0
+	overflow := false
+	for _, n := range ns {
+		switch {
+		case n.Err != nil:
+			t.Fatalf("bad: %s", n.Err)
+		case n.Overflow:
+			overflow = true
+		case n.ID == fmt.Sprintf("%02d", next):
+			next++
+		case !overflow:
+			t.Fatalf("expected %02d or an overflow, got %s in %v", next, n.ID, ns)
+		default:
+			var i int
+			if _, err := fmt.Sscanf(n.ID, "%d", &i); err != nil || i < next {
+				t.Fatalf("unexpected notification %s in %v", n.ID, ns)
+			}
+			next = i + 1
+			overflow = false
+		}
+	}
+	if len(ns) == n {
+		t.Fatalf("expected notifications to be dropped, got %v", ns)
+	}
+	if !ns[len(ns)-1].Overflow && ns[len(ns)-1].ID != fmt.Sprintf("%02d", n-1) {
+		t.Fatalf("expected the last notification to be an overflow or for the last file, got %v", ns)
+	}
+}
+
+func TestNotifyWatcherStop(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+
+	// Stopping a watcher that never started is a no-op.
+	NewNotifyWatcher(defaultBufferSize).Stop()
+
+	w := NewNotifyWatcher(defaultBufferSize)
+	c, err := w.Watch(dir)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	w.Stop()
+	w.Stop()
+	if err := ioutil.WriteFile(dir+"/foo", []byte("{}"), 0666); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	select {
+	case n := <-c:
+		t.Fatalf("unexpected notification after stop: %#v", n)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !linux
+// +build !linux
+
+package sub
+
+import (
+	"errors"
+
+	"github.com/rjeczalik/notify"
+)
+
+// dirCreated is the event topic subscribers watch for new topic directories
+// with.
+const dirCreated = notify.Create
+
+// errNoInotify is returned by the notify watcher on systems without inotify.
+var errNoInotify = errors.New("inotify is only available on Linux")
+
+// notifyWatcher is a Watcher that uses inotify. It always fails to watch on
+// systems other than Linux.
+type notifyWatcher struct{}
+
+// NewNotifyWatcher returns a Watcher that uses inotify, with a notification
+// buffer of the supplied size.
+//
+// inotify is only available on Linux. On other systems, Watch always returns
+// an error, and subscribers fall back to a polling watcher.
+func NewNotifyWatcher(bufferSize int) Watcher {
+	return &notifyWatcher{}
+}
+
+// Watch implements Watcher for notifyWatcher.
+func (w *notifyWatcher) Watch(dir string) (<-chan Notification, error) {
+	return nil, errNoInotify
+}
+
+// Stop implements Watcher for notifyWatcher.
+func (w *notifyWatcher) Stop() {}
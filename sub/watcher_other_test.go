@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package sub
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestNotifyWatcherUnavailable(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtest")
+	defer os.RemoveAll(dir)
+	if _, err := NewNotifyWatcher(defaultBufferSize).Watch(dir); err == nil {
+		t.Fatal("expected error, got none")
+	}
+	// The subscriber falls back to polling.
+	s, err := NewSubscriber(dir, TestEvent{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	defer s.Close()
+	if _, ok := s.watcher.(*pollWatcher); !ok {
+		t.Fatalf("expected polling watcher, got %T", s.watcher)
+	}
+}